@@ -6,7 +6,9 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 
+	"github.com/eshyong/lettuce/reply"
 	"github.com/eshyong/lettuce/utils"
 )
 
@@ -33,6 +35,10 @@ func (cli *Cli) Run() {
 	serverOut := utils.OutChanFromConn(cli.server, "server")
 	userIn := cli.getInput()
 
+	// Requests are sent as soon as they're read, so input piped in from a file is
+	// pipelined. Replies come back in the same order.
+	pending := 0
+
 	// Prompt user.
 	fmt.Print("> ")
 loop:
@@ -42,15 +48,39 @@ loop:
 			if !ok {
 				break loop
 			}
+			if strings.HasPrefix(message, utils.PUSH+utils.DELIMITER) {
+				// Pushed without a request, so print it over the prompt.
+				fmt.Print("\r")
+				message = strings.TrimPrefix(message, utils.PUSH+utils.DELIMITER)
+			} else if pending > 0 {
+				pending--
+			}
 			if message != "" {
 				fmt.Println(message)
 			}
+			if userIn == nil && pending == 0 {
+				break loop
+			}
 			fmt.Print("> ")
 		case input, ok := <-userIn:
 			if !ok {
-				break loop
+				// Wait on the replies to whatever is still on its way.
+				userIn = nil
+				if pending == 0 {
+					break loop
+				}
+				continue
+			}
+			// Catch unbalanced quotes here, rather than waiting on the server for them.
+			if args, err := utils.SplitArgs(input); err != nil {
+				fmt.Println(reply.Error(err.Error()))
+				fmt.Print("> ")
+			} else if len(args) == 0 {
+				fmt.Print("> ")
+			} else {
+				serverOut <- input
+				pending++
 			}
-			serverOut <- input
 		}
 	}
 	fmt.Println("Goodbye!")
@@ -0,0 +1,363 @@
+// Package client lets Go programs talk to a Lettuce master, without building requests or
+// reading replies by hand.
+//
+//	c := client.NewClient(client.Options{})
+//	defer c.Close()
+//	err := c.Set(ctx, "greeting", "hello world", 0)
+//	greeting, err := c.Get(ctx, "greeting")
+//
+// A Client is safe to use from many goroutines. It keeps a pool of connections to the
+// master, which speak RESP3.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Defaults for the options that aren't set.
+const (
+	DEFAULT_POOL_SIZE    = 10
+	DEFAULT_DIAL_TIMEOUT = utils.DEADLINE
+	DEFAULT_MAX_RETRIES  = 3
+
+	// Time to wait before the first retry, which doubles with each retry after it.
+	RETRY_BACKOFF = 50 * time.Millisecond
+)
+
+var (
+	// Returned in place of a value that isn't there, like the value of a missing key.
+	ErrNil = errors.New("lettuce: nil")
+
+	// Returned once the client has been closed.
+	ErrClosed = errors.New("lettuce: client is closed")
+
+	// Returned when the reply isn't of the type the method expects.
+	ErrUnexpectedReply = errors.New("lettuce: unexpected reply")
+
+	// Returned for requests that change the state of a connection, like SELECT or
+	// SUBSCRIBE, which can't be sent on a connection from the pool.
+	ErrStateful = errors.New("lettuce: command changes the connection, which pooled connections can't do")
+
+	errEmptyRequest = errors.New("lettuce: empty request")
+)
+
+// An error reply from the master, like "WRONGTYPE Operation against a key holding the
+// wrong kind of value".
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Code + " " + err.Message
+}
+
+// Requests that change the state of the connection they're sent on. Transactions can be
+// sent whole in a pipeline.
+var statefulCommands = map[string]bool{
+	"select":       true,
+	"hello":        true,
+	"quit":         true,
+	"multi":        true,
+	"exec":         true,
+	"discard":      true,
+	"watch":        true,
+	"unwatch":      true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+}
+
+type Options struct {
+	// Address of the master, "127.0.0.1:8000" by default.
+	Addr string
+
+	// Database that every connection selects.
+	DB int
+
+	// Most connections open at once. Requests wait for one to be free beyond that.
+	PoolSize int
+
+	DialTimeout time.Duration
+
+	// Times a request is tried again on a new connection when its connection fails before
+	// any of it was written, or -1 to never try again. Once a request has been written
+	// the master may have run it, so it's never sent again.
+	MaxRetries int
+}
+
+type Client struct {
+	options Options
+
+	// Idle connections, and a token for each connection that may be opened or in use.
+	idle   chan *conn
+	tokens chan struct{}
+
+	// Opens connections to the master.
+	dialContext func(ctx context.Context, network string, address string) (net.Conn, error)
+
+	lock   sync.Mutex
+	closed bool
+}
+
+// A connection to the master, its buffers, and the number of bytes written to it, which
+// tells whether a request that failed got as far as the master.
+type conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	written int64
+}
+
+func NewClient(options Options) *Client {
+	if options.Addr == "" {
+		options.Addr = utils.LOCALHOST + utils.DELIMITER + utils.CLI_CLIENT_PORT
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = DEFAULT_POOL_SIZE
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = DEFAULT_MAX_RETRIES
+	} else if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	}
+	dialer := &net.Dialer{Timeout: options.DialTimeout}
+	client := &Client{options: options,
+		idle:        make(chan *conn, options.PoolSize),
+		tokens:      make(chan struct{}, options.PoolSize),
+		dialContext: dialer.DialContext}
+	for i := 0; i < options.PoolSize; i++ {
+		client.tokens <- struct{}{}
+	}
+	return client
+}
+
+// Closes every idle connection. Connections in use are closed as they're given back.
+func (client *Client) Close() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.closed {
+		return ErrClosed
+	}
+	client.closed = true
+	for {
+		select {
+		case cn := <-client.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (client *Client) isClosed() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.closed
+}
+
+// Sends a request and returns its reply. Error replies are returned as a reply, not as an
+// error, which is only for requests that never got a reply.
+func (client *Client) Do(ctx context.Context, args ...string) (reply.Reply, error) {
+	if len(args) == 0 {
+		return reply.Reply{}, errEmptyRequest
+	}
+	if statefulCommands[strings.ToLower(args[0])] {
+		return reply.Reply{}, ErrStateful
+	}
+	replies, err := client.process(ctx, [][]string{args})
+	if err != nil {
+		return reply.Reply{}, err
+	}
+	return replies[0], nil
+}
+
+// Sends requests on a connection from the pool and reads their replies. They're tried
+// again on a new connection if the one before fails before any of them were written, but
+// never once they may have reached the master.
+func (client *Client) process(ctx context.Context, requests [][]string) ([]reply.Reply, error) {
+	var err error
+	for attempt := 0; attempt <= client.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.NewTimer(RETRY_BACKOFF << uint(attempt-1))
+			select {
+			case <-ctx.Done():
+				backoff.Stop()
+				return nil, ctx.Err()
+			case <-backoff.C:
+			}
+		}
+
+		var cn *conn
+		if cn, err = client.get(ctx); err != nil {
+			if err == ErrClosed || ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		var replies []reply.Reply
+		written := cn.written
+		replies, err = cn.roundTrip(ctx, requests)
+		sent := cn.written != written
+		client.put(cn, err != nil)
+		if err == nil {
+			return replies, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if sent {
+			// The master may have run the requests, which mustn't run twice.
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Takes a connection from the pool, or opens a new one if there's room for it. Idle
+// connections that the master has closed are thrown away, rather than failing the request
+// after it has been written to them.
+func (client *Client) get(ctx context.Context) (*conn, error) {
+	if client.isClosed() {
+		return nil, ErrClosed
+	}
+	select {
+	case <-client.tokens:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case cn := <-client.idle:
+		if cn.alive() {
+			return cn, nil
+		}
+		cn.Close()
+	default:
+	}
+	cn, err := client.dial(ctx)
+	if err != nil {
+		client.tokens <- struct{}{}
+		return nil, err
+	}
+	return cn, nil
+}
+
+// Gives a connection back to the pool, or closes it if it failed or the client is closed.
+func (client *Client) put(cn *conn, failed bool) {
+	client.lock.Lock()
+	if failed || client.closed {
+		cn.Close()
+	} else {
+		client.idle <- cn
+	}
+	client.lock.Unlock()
+	client.tokens <- struct{}{}
+}
+
+// Connects to the master, switches the connection to RESP3, and selects the database.
+func (client *Client) dial(ctx context.Context) (*conn, error) {
+	netConn, err := client.dialContext(ctx, "tcp", client.options.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	cn.writer = bufio.NewWriter(cn)
+
+	handshake := [][]string{{"HELLO", "3"}}
+	if client.options.DB != 0 {
+		handshake = append(handshake, []string{utils.SELECT, strconv.Itoa(client.options.DB)})
+	}
+	replies, err := cn.roundTrip(ctx, handshake)
+	if err == nil {
+		for _, result := range replies {
+			if result.IsError() {
+				err = &Error{Code: result.ErrorCode(), Message: result.Str}
+				break
+			}
+		}
+	}
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// Counts the bytes written to the connection on their way through the writer.
+func (cn *conn) Write(b []byte) (int, error) {
+	n, err := cn.Conn.Write(b)
+	cn.written += int64(n)
+	return n, err
+}
+
+// Returns whether an idle connection is still open. Nothing is sent on an idle connection,
+// so anything there to read, even an EOF, means it's no good.
+func (cn *conn) alive() bool {
+	if cn.reader.Buffered() > 0 {
+		return false
+	}
+	cn.SetReadDeadline(time.Unix(1, 0))
+	_, err := cn.reader.Peek(1)
+	cn.SetReadDeadline(time.Time{})
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Writes every request at once, then reads a reply for each. The context's deadline
+// applies to the whole exchange, and cancelling it interrupts it.
+func (cn *conn) roundTrip(ctx context.Context, requests [][]string) ([]reply.Reply, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		// Unblocks any read or write in progress.
+		cn.SetDeadline(time.Unix(1, 0))
+	})
+	replies, err := cn.exchange(requests)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil && hasDeadline && !time.Now().Before(deadline) {
+		// The connection's deadline can go off just before the context's.
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return replies, err
+}
+
+func (cn *conn) exchange(requests [][]string) ([]reply.Reply, error) {
+	for _, args := range requests {
+		// A request is an array of bulk strings.
+		cn.writer.WriteString(reply.EncodeRESP2(reply.Bulks(args)))
+	}
+	if err := cn.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]reply.Reply, 0, len(requests))
+	for len(replies) < len(requests) {
+		result, err := reply.ReadRESP(cn.reader)
+		if err != nil {
+			return nil, err
+		}
+		if result.Type == reply.PUSH {
+			// Nothing here subscribes, but a push is never the reply to a request.
+			continue
+		}
+		replies = append(replies, result)
+	}
+	return replies, nil
+}
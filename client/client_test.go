@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// A master played by the test. Each connection the client dials is one end of a pipe, and
+// the master answers the requests that come in on the other end with what handle returns
+// for them, or closes the connection if it returns false.
+type fakeMaster struct {
+	handle func(args []string) (reply.Reply, bool)
+
+	lock      sync.Mutex
+	dials     int
+	failDials int
+	requests  []string
+	conns     []net.Conn
+}
+
+// Returns a client whose connections go to a fake master.
+func newTestClient(t *testing.T, options Options, handle func(args []string) (reply.Reply, bool)) (*Client, *fakeMaster) {
+	master := &fakeMaster{handle: handle}
+	client := NewClient(options)
+	client.dialContext = master.dial
+	t.Cleanup(func() {
+		client.Close()
+		master.lock.Lock()
+		defer master.lock.Unlock()
+		for _, conn := range master.conns {
+			conn.Close()
+		}
+	})
+	return client, master
+}
+
+func (master *fakeMaster) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+	master.dials++
+	if master.dials <= master.failDials {
+		return nil, errors.New("connection refused")
+	}
+	conn, other := net.Pipe()
+	master.conns = append(master.conns, other)
+	go master.serve(other)
+	return conn, nil
+}
+
+func (master *fakeMaster) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := reply.ReadRESP(reader)
+		if err != nil {
+			return
+		}
+		args := make([]string, len(request.Elements))
+		for i, arg := range request.Elements {
+			args[i] = arg.Str
+		}
+
+		// Connections are set up the same way every time, which the tests don't see.
+		result, ok := reply.OK, true
+		if strings.ToUpper(args[0]) == "HELLO" {
+			result = reply.Map(reply.Bulk("proto"), reply.Integer(3))
+		} else if strings.ToUpper(args[0]) != "SELECT" {
+			master.lock.Lock()
+			master.requests = append(master.requests, strings.Join(args, " "))
+			master.lock.Unlock()
+			result, ok = master.handle(args)
+		}
+		if !ok {
+			return
+		}
+		if _, err := conn.Write([]byte(reply.EncodeRESP3(result))); err != nil {
+			return
+		}
+	}
+}
+
+// Returns the number of connections dialed, and the requests the master has seen.
+func (master *fakeMaster) seen() (int, []string) {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+	return master.dials, append([]string{}, master.requests...)
+}
+
+func answerOK(args []string) (reply.Reply, bool) {
+	return reply.OK, true
+}
+
+func TestPoolLimitsConnections(t *testing.T) {
+	var lock sync.Mutex
+	running, most := 0, 0
+	client, master := newTestClient(t, Options{PoolSize: 2}, func(args []string) (reply.Reply, bool) {
+		lock.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return reply.OK, true
+	})
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if err := client.Set(context.Background(), "a", "1", 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	dials, requests := master.seen()
+	if dials > 2 || most > 2 || len(requests) != 20 {
+		t.Errorf("%d dials, %d at once, %d requests, want at most 2, 2, and 20", dials, most, len(requests))
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		failDials  int
+		closes     bool
+		err        bool
+		dials      int
+		requests   int
+	}{
+		// Nothing was written, so the request is tried again.
+		{"dial fails", 0, 2, false, false, 3, 1},
+		{"dial keeps failing", 0, 10, false, true, 4, 0},
+		{"retries off", -1, 1, false, true, 1, 0},
+
+		// The master may have run it, so it isn't.
+		{"closed after the request", 0, 0, true, true, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, master := newTestClient(t, Options{MaxRetries: test.maxRetries},
+				func(args []string) (reply.Reply, bool) {
+					return reply.Integer(1), !test.closes
+				})
+			master.failDials = test.failDials
+			_, err := client.Incr(context.Background(), "counter")
+			if (err != nil) != test.err {
+				t.Errorf("err = %v, want an error: %v", err, test.err)
+			}
+			if dials, requests := master.seen(); dials != test.dials || len(requests) != test.requests {
+				t.Errorf("%d dials and requests %q, want %d and %d", dials, requests, test.dials, test.requests)
+			}
+		})
+	}
+}
+
+func TestClosedIdleConnectionReplaced(t *testing.T) {
+	client, master := newTestClient(t, Options{}, answerOK)
+	if err := client.Set(context.Background(), "a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The master goes away while the connection is idle, so the next request goes out on
+	// a new one, once.
+	master.lock.Lock()
+	master.conns[0].Close()
+	master.lock.Unlock()
+	if err := client.Set(context.Background(), "a", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if dials, requests := master.seen(); dials != 2 || len(requests) != 2 {
+		t.Errorf("%d dials and requests %q, want 2 and 2", dials, requests)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	client, master := newTestClient(t, Options{DB: 3}, func(args []string) (reply.Reply, bool) {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			return reply.Bulk("v"), true
+		case "INCR":
+			return reply.Integer(1), true
+		case "MULTI":
+			return reply.OK, true
+		case "EXEC":
+			return reply.Array(reply.Integer(2)), true
+		}
+		return reply.QUEUED, true
+	})
+
+	pipe := client.Pipeline()
+	pipe.Do("GET", "a")
+	pipe.Do("INCR", "n")
+	pipe.Do("MULTI")
+	pipe.Do("INCR", "n")
+	pipe.Do("EXEC")
+	if pipe.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", pipe.Len())
+	}
+	replies, err := pipe.Exec(context.Background())
+	want := []reply.Reply{reply.Bulk("v"), reply.Integer(1), reply.OK, reply.Integer(1),
+		reply.Array(reply.Integer(2))}
+	if err != nil || !reflect.DeepEqual(replies, want) || pipe.Len() != 0 {
+		t.Errorf("Exec() = %v, %v, want %v", replies, err, want)
+	}
+
+	// A transaction has to be over by the end of the pipeline.
+	pipe.Do("MULTI")
+	pipe.Do("INCR", "n")
+	if _, err := pipe.Exec(context.Background()); err != ErrStateful {
+		t.Errorf("Exec() with an open MULTI = %v, want ErrStateful", err)
+	}
+	if dials, requests := master.seen(); dials != 1 || len(requests) != 5 {
+		t.Errorf("%d dials and requests %q, want 1 and 5", dials, requests)
+	}
+}
+
+func TestContextInterruptsRequest(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	client, master := newTestClient(t, Options{}, func(args []string) (reply.Reply, bool) {
+		if args[0] == "BLPOP" {
+			<-release
+		}
+		return reply.OK, true
+	})
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := client.Do(cancelled, "BLPOP", "l", "0"); err != context.Canceled {
+		t.Errorf("Do() = %v, want context.Canceled", err)
+	}
+	timedOut, stop := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer stop()
+	if _, err := client.Do(timedOut, "BLPOP", "l", "0"); err != context.DeadlineExceeded {
+		t.Errorf("Do() = %v, want context.DeadlineExceeded", err)
+	}
+
+	// The interrupted connections aren't used again.
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dials, requests := master.seen(); dials != 3 || len(requests) != 3 {
+		t.Errorf("%d dials and requests %q, want 3 and 3", dials, requests)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	client, _ := newTestClient(t, Options{}, func(args []string) (reply.Reply, bool) {
+		switch args[1] {
+		case "missing":
+			return reply.Null(), true
+		case "list":
+			return reply.CodedError("WRONGTYPE", "Operation against a key holding the wrong kind of value"), true
+		}
+		return reply.Integer(1), true
+	})
+	ctx := context.Background()
+
+	if _, err := client.Get(ctx, "missing"); err != ErrNil {
+		t.Errorf("Get(missing) = %v, want ErrNil", err)
+	}
+	_, err := client.Get(ctx, "list")
+	var replyErr *Error
+	if !errors.As(err, &replyErr) || replyErr.Code != "WRONGTYPE" {
+		t.Errorf("Get(list) = %v, want a WRONGTYPE *Error", err)
+	}
+	if _, err := client.Get(ctx, "number"); err != ErrUnexpectedReply {
+		t.Errorf("Get(number) = %v, want ErrUnexpectedReply", err)
+	}
+	for _, command := range []string{"SELECT", "subscribe", "MULTI"} {
+		if _, err := client.Do(ctx, command, "x"); err != ErrStateful {
+			t.Errorf("Do(%s) = %v, want ErrStateful", command, err)
+		}
+	}
+	if _, err := client.Do(ctx); err != errEmptyRequest {
+		t.Errorf("Do() = %v, want errEmptyRequest", err)
+	}
+
+	client.Close()
+	if _, err := client.Get(ctx, "missing"); err != ErrClosed {
+		t.Errorf("Get after Close = %v, want ErrClosed", err)
+	}
+	if err := client.Close(); err != ErrClosed {
+		t.Errorf("Close twice = %v, want ErrClosed", err)
+	}
+}
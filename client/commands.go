@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// Sends a request, and returns an error reply as an *Error.
+func (client *Client) do(ctx context.Context, args ...string) (reply.Reply, error) {
+	result, err := client.Do(ctx, args...)
+	if err != nil {
+		return result, err
+	}
+	if result.IsError() {
+		return result, &Error{Code: result.ErrorCode(), Message: result.Str}
+	}
+	return result, nil
+}
+
+// Reads a string, or ErrNil for a null.
+func stringReply(result reply.Reply, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch result.Type {
+	case reply.BULK, reply.STATUS:
+		return result.Str, nil
+	case reply.NULL, reply.NULL_ARRAY:
+		return "", ErrNil
+	}
+	return "", ErrUnexpectedReply
+}
+
+func intReply(result reply.Reply, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if result.Type != reply.INTEGER {
+		return 0, ErrUnexpectedReply
+	}
+	return result.Integer, nil
+}
+
+// Reads an integer that is 1 for yes and 0 for no.
+func boolReply(result reply.Reply, err error) (bool, error) {
+	n, err := intReply(result, err)
+	return n == 1, err
+}
+
+func floatReply(result reply.Reply, err error) (float64, error) {
+	str, err := stringReply(result, err)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// Reads an array of strings, where nulls are empty strings.
+func stringsReply(result reply.Reply, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if result.Type != reply.ARRAY {
+		return nil, ErrUnexpectedReply
+	}
+	strs := make([]string, len(result.Elements))
+	for i, element := range result.Elements {
+		if element.Type != reply.BULK && element.Type != reply.STATUS && element.Type != reply.NULL {
+			return nil, ErrUnexpectedReply
+		}
+		strs[i] = element.Str
+	}
+	return strs, nil
+}
+
+// Reads a map, or an array of keys each followed by its value.
+func mapReply(result reply.Reply, err error) (map[string]string, error) {
+	if err == nil && result.Type == reply.MAP {
+		result.Type = reply.ARRAY
+	}
+	strs, err := stringsReply(result, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(strs)%2 != 0 {
+		return nil, ErrUnexpectedReply
+	}
+	values := make(map[string]string, len(strs)/2)
+	for i := 0; i < len(strs); i += 2 {
+		values[strs[i]] = strs[i+1]
+	}
+	return values, nil
+}
+
+// Reads OK, or any other status.
+func statusReply(result reply.Reply, err error) error {
+	if err != nil {
+		return err
+	}
+	if result.Type != reply.STATUS {
+		return ErrUnexpectedReply
+	}
+	return nil
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+func (client *Client) Ping(ctx context.Context) error {
+	return statusReply(client.do(ctx, "PING"))
+}
+
+// Returns the value of a key, or ErrNil if there isn't one.
+func (client *Client) Get(ctx context.Context, key string) (string, error) {
+	return stringReply(client.do(ctx, "GET", key))
+}
+
+// Sets the value of a key, which expires after the given time unless it's 0.
+func (client *Client) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	if expiration > 0 {
+		return statusReply(client.do(ctx, "SET", key, value, "PX", formatMillis(expiration)))
+	}
+	return statusReply(client.do(ctx, "SET", key, value))
+}
+
+func (client *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return intReply(client.do(ctx, "INCR", key))
+}
+
+func (client *Client) IncrBy(ctx context.Context, key string, increment int64) (int64, error) {
+	return intReply(client.do(ctx, "INCRBY", key, strconv.FormatInt(increment, 10)))
+}
+
+func (client *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return intReply(client.do(ctx, "DECR", key))
+}
+
+// Deletes keys of any type, and returns how many there were.
+func (client *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return intReply(client.do(ctx, append([]string{"DEL"}, keys...)...))
+}
+
+// Returns how many of the keys exist.
+func (client *Client) Exists(ctx context.Context, keys ...string) (int64, error) {
+	return intReply(client.do(ctx, append([]string{"EXISTS"}, keys...)...))
+}
+
+func (client *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return stringsReply(client.do(ctx, "KEYS", pattern))
+}
+
+// Makes a key expire after the given time. Returns false if there's no such key.
+func (client *Client) Expire(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	return boolReply(client.do(ctx, "PEXPIRE", key, formatMillis(expiration)))
+}
+
+// Returns the time until a key expires, -1 if it never does, or ErrNil if there's no
+// such key.
+func (client *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := intReply(client.do(ctx, "PTTL", key))
+	if err != nil {
+		return 0, err
+	}
+	if ms == -2 {
+		return 0, ErrNil
+	} else if ms == -1 {
+		return -1, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Pushes a value onto the head of a list, and returns the length of the list.
+func (client *Client) LPush(ctx context.Context, key string, value string) (int64, error) {
+	return intReply(client.do(ctx, "LPUSH", key, value))
+}
+
+// Pushes a value onto the tail of a list, and returns the length of the list.
+func (client *Client) RPush(ctx context.Context, key string, value string) (int64, error) {
+	return intReply(client.do(ctx, "RPUSH", key, value))
+}
+
+// Pops the head of a list, or returns ErrNil if it's empty.
+func (client *Client) LPop(ctx context.Context, key string) (string, error) {
+	return stringReply(client.do(ctx, "LPOP", key))
+}
+
+// Pops the tail of a list, or returns ErrNil if it's empty.
+func (client *Client) RPop(ctx context.Context, key string) (string, error) {
+	return stringReply(client.do(ctx, "RPOP", key))
+}
+
+func (client *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return intReply(client.do(ctx, "LLEN", key))
+}
+
+func (client *Client) LRange(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	return stringsReply(client.do(ctx, "LRANGE", key, strconv.FormatInt(start, 10),
+		strconv.FormatInt(stop, 10)))
+}
+
+// Sets a field of a hash. Returns true if the field is new.
+func (client *Client) HSet(ctx context.Context, key string, field string, value string) (bool, error) {
+	return boolReply(client.do(ctx, "HSET", key, field, value))
+}
+
+// Returns a field of a hash, or ErrNil if there's no such field.
+func (client *Client) HGet(ctx context.Context, key string, field string) (string, error) {
+	return stringReply(client.do(ctx, "HGET", key, field))
+}
+
+func (client *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return mapReply(client.do(ctx, "HGETALL", key))
+}
+
+func (client *Client) HKeys(ctx context.Context, key string) ([]string, error) {
+	return stringsReply(client.do(ctx, "HKEYS", key))
+}
+
+func (client *Client) HLen(ctx context.Context, key string) (int64, error) {
+	return intReply(client.do(ctx, "HLEN", key))
+}
+
+// Adds members to a set, and returns how many weren't in it already.
+func (client *Client) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	return intReply(client.do(ctx, append([]string{"SADD", key}, members...)...))
+}
+
+// Removes members from a set, and returns how many were in it.
+func (client *Client) SRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return intReply(client.do(ctx, append([]string{"SREM", key}, members...)...))
+}
+
+func (client *Client) SIsMember(ctx context.Context, key string, member string) (bool, error) {
+	return boolReply(client.do(ctx, "SISMEMBER", key, member))
+}
+
+func (client *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return stringsReply(client.do(ctx, "SMEMBERS", key))
+}
+
+// Adds a member to a sorted set, or changes its score. Returns 1 if the member is new.
+func (client *Client) ZAdd(ctx context.Context, key string, score float64, member string) (int64, error) {
+	return intReply(client.do(ctx, "ZADD", key, strconv.FormatFloat(score, 'g', -1, 64), member))
+}
+
+// Returns the score of a member, or ErrNil if it isn't in the sorted set.
+func (client *Client) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	return floatReply(client.do(ctx, "ZSCORE", key, member))
+}
+
+func (client *Client) ZRange(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	return stringsReply(client.do(ctx, "ZRANGE", key, strconv.FormatInt(start, 10),
+		strconv.FormatInt(stop, 10)))
+}
+
+// Publishes a message, and returns the number of sessions it went to.
+func (client *Client) Publish(ctx context.Context, channel string, message string) (int64, error) {
+	return intReply(client.do(ctx, "PUBLISH", channel, message))
+}
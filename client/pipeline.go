@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// Requests that are sent together on one connection, without waiting on each reply. A
+// pipeline is also the way to send a transaction, since MULTI, EXEC and the requests in
+// between have to go on the same connection:
+//
+//	pipe := c.Pipeline()
+//	pipe.Do("MULTI")
+//	pipe.Do("INCR", "counter")
+//	pipe.Do("EXEC")
+//	replies, err := pipe.Exec(ctx)
+//
+// A pipeline isn't safe to use from many goroutines.
+type Pipeline struct {
+	client   *Client
+	requests [][]string
+}
+
+func (client *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: client}
+}
+
+// Queues a request.
+func (pipe *Pipeline) Do(args ...string) {
+	pipe.requests = append(pipe.requests, args)
+}
+
+// Returns the number of queued requests.
+func (pipe *Pipeline) Len() int {
+	return len(pipe.requests)
+}
+
+// Sends the queued requests, and returns a reply for each, in the same order. Error
+// replies are returned as replies. The pipeline is empty afterwards, whether or not it
+// succeeded.
+func (pipe *Pipeline) Exec(ctx context.Context) ([]reply.Reply, error) {
+	requests := pipe.requests
+	pipe.requests = nil
+	if len(requests) == 0 {
+		return []reply.Reply{}, nil
+	}
+	// Transactions have to be over by the end, so the connection can go back to the pool.
+	inMulti, watching := false, false
+	for _, args := range requests {
+		if len(args) == 0 {
+			return nil, errEmptyRequest
+		}
+		switch command := strings.ToLower(args[0]); command {
+		case "multi":
+			inMulti = true
+		case "watch":
+			watching = true
+		case "exec", "discard":
+			inMulti, watching = false, false
+		case "unwatch":
+			watching = watching && inMulti
+		default:
+			if statefulCommands[command] {
+				return nil, ErrStateful
+			}
+		}
+	}
+	if inMulti || watching {
+		return nil, ErrStateful
+	}
+	return pipe.client.process(ctx, requests)
+}
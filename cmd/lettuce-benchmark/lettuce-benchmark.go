@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eshyong/lettuce/client"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Sends the same kind of request over and over from a number of clients, and reports how
+// many went through each second, and how long they took.
+func main() {
+	addr := flag.String("addr", utils.LOCALHOST+utils.DELIMITER+utils.CLI_CLIENT_PORT,
+		"address of the master")
+	requests := flag.Int("n", 10000, "total number of requests")
+	clients := flag.Int("c", 10, "number of clients sending requests at once")
+	pipeline := flag.Int("P", 1, "number of requests each client sends before waiting on the replies")
+	tests := flag.String("t", "set,get,incr,lpush,lpop",
+		"comma-separated requests to benchmark: set, get, incr, lpush, lpop or ping")
+	flag.Parse()
+	if *requests <= 0 || *clients <= 0 || *pipeline <= 0 {
+		log.Fatal("-n, -c and -P have to be positive")
+	}
+
+	c := client.NewClient(client.Options{Addr: *addr, PoolSize: *clients})
+	defer c.Close()
+	if err := c.Ping(context.Background()); err != nil {
+		log.Fatal("Couldn't reach the master: ", err)
+	}
+	for _, test := range strings.Split(*tests, ",") {
+		request, ok := benchmarkRequests[strings.TrimSpace(test)]
+		if !ok {
+			log.Fatal("Unknown request: ", test)
+		}
+		run(c, strings.ToUpper(test), request, *requests, *clients, *pipeline)
+	}
+}
+
+// Requests to benchmark, each given a number that's different for every request.
+var benchmarkRequests = map[string]func(n int) []string{
+	"ping":  func(n int) []string { return []string{"PING"} },
+	"set":   func(n int) []string { return []string{"SET", "key:" + strconv.Itoa(n%1000), "xxx"} },
+	"get":   func(n int) []string { return []string{"GET", "key:" + strconv.Itoa(n%1000)} },
+	"incr":  func(n int) []string { return []string{"INCR", "counter"} },
+	"lpush": func(n int) []string { return []string{"LPUSH", "list", "xxx"} },
+	"lpop":  func(n int) []string { return []string{"LPOP", "list"} },
+}
+
+func run(c *client.Client, name string, request func(n int) []string, requests int, clients int,
+	pipeline int) {
+	// The latency of each pipeline, from sending it to reading the last reply.
+	latencies := make([]time.Duration, 0, requests/pipeline+clients)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	var firstErr error
+
+	next := make(chan int, clients)
+	go func() {
+		for n := 0; n < requests; n += pipeline {
+			next <- n
+		}
+		close(next)
+	}()
+
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				pipe := c.Pipeline()
+				for j := n; j < n+pipeline && j < requests; j++ {
+					pipe.Do(request(j)...)
+				}
+				sent := time.Now()
+				_, err := pipe.Exec(context.Background())
+				latency := time.Since(sent)
+
+				lock.Lock()
+				latencies = append(latencies, latency)
+				if err != nil {
+					if failed == 0 {
+						firstErr = err
+					}
+					failed++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("%s: %d requests in %v, %.0f requests per second\n", name, requests,
+		elapsed.Round(time.Millisecond), float64(requests)/elapsed.Seconds())
+	fmt.Printf("  latency p50 %v, p99 %v, max %v\n", percentile(0.5), percentile(0.99), percentile(1))
+	if failed > 0 {
+		fmt.Printf("  %d pipelines failed, the first with: %v\n", failed, firstErr)
+	}
+}
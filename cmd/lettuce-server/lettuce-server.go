@@ -1,13 +1,44 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
 
+	"github.com/eshyong/lettuce/db"
 	"github.com/eshyong/lettuce/server"
 )
 
 func main() {
+	fsync := flag.String("appendfsync", db.FSYNC_EVERYSEC,
+		"when to fsync the append-only log: always, everysec or never")
+	save := flag.String("save", db.DEFAULT_SAVE_RULES,
+		"save after a number of changes in a number of seconds, as pairs of \"seconds changes\"")
+	notify := flag.String("notify-keyspace-events", "",
+		"classes of keyspace events to publish, e.g. \"KEA\" for all of them")
+	maxMemory := flag.String("maxmemory", "0",
+		"most memory the store may use, e.g. \"100mb\", or 0 for no limit")
+	maxMemoryPolicy := flag.String("maxmemory-policy", db.MAXMEMORY_NOEVICTION,
+		"keys to evict past maxmemory: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, "+
+			"volatile-lru or volatile-ttl")
+	flag.Parse()
+
 	s := server.NewServer()
+	if err := s.SetFsyncPolicy(*fsync); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.SetSaveRules(*save); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.SetNotifyKeyspaceEvents(*notify); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.SetMaxMemory(*maxMemory); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.SetMaxMemoryPolicy(*maxMemoryPolicy); err != nil {
+		log.Fatal(err)
+	}
 	s.ConnectToMaster()
 	fmt.Println("DB server running!")
 	s.Serve()
@@ -0,0 +1,357 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Append-only log constants. Each record in the log is the length of a request and a
+// CRC32 of it, both 4 bytes, followed by the request itself.
+const (
+	AOF_FILENAME         = "aof"
+	AOF_REWRITE_FILENAME = "aof.rewrite"
+	AOF_HEADER_LENGTH    = 8
+	AOF_SYNC_PERIOD      = time.Second
+
+	// A rewritten log starts with this record, and holds every key in the store, so
+	// the dump isn't needed to replay it.
+	AOF_BASE_MARKER = "\x00BASE"
+
+	// Marks where a snapshot was taken, followed by the snapshot's id. Only the writes
+	// after the marker need to be replayed on top of that snapshot.
+	AOF_SNAPSHOT_MARKER = "\x00SNAPSHOT "
+
+	// Rewrite the log automatically once it's at least this big, and has doubled in
+	// size since the last rewrite.
+	AOF_REWRITE_MIN_SIZE = 64 * 1024 * 1024
+
+	// Policies for when to fsync the log.
+	FSYNC_ALWAYS   = "always"
+	FSYNC_EVERYSEC = "everysec"
+	FSYNC_NEVER    = "never"
+)
+
+// Opens the append-only log, replaying whatever it holds on top of the snapshot that was
+// just loaded. A record that was only partially written when we crashed is cut off.
+func (store *Store) openLog(filename string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	valid, err := store.replayLog(data)
+	if err != nil {
+		log.Fatal("Unable to replay ", filename, ": ", err)
+	}
+
+	store.aof, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if valid < len(data) {
+		log.Printf("Discarding %d bytes of truncated log record", len(data)-valid)
+		if err := store.aof.Truncate(int64(valid)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	store.aofSize, store.aofBaseSize = int64(valid), int64(valid)
+
+	// New writes go after the last database the log selected, but requests start out
+	// in the first one, just like the backup's.
+	store.loggedDB = store.db
+	store.selectDB(0)
+	go store.syncLog()
+}
+
+// Executes every complete record in the log that isn't already in the loaded snapshot,
+// and returns the length of the valid prefix.
+func (store *Store) replayLog(data []byte) (int, error) {
+	store.loading = true
+	defer func() { store.loading = false }()
+
+	offset := store.logStart(data)
+	for offset < len(data) {
+		request, n, err := decodeLogRecord(data[offset:])
+		if err == errTruncatedRecord {
+			// Only the final record is allowed to be incomplete.
+			return offset, nil
+		} else if err != nil {
+			return offset, fmt.Errorf("%v at offset %d", err, offset)
+		}
+		if request == AOF_BASE_MARKER {
+			// The log holds everything, so start over without the dump.
+			store.reset()
+		} else if strings.HasPrefix(request, AOF_SNAPSHOT_MARKER) {
+			// The writes after a marker start out in the first database, since
+			// they may be replayed on their own.
+			store.selectDB(0)
+		} else {
+			store.Execute(request)
+		}
+		offset += n
+	}
+	return offset, nil
+}
+
+// Returns the offset just past the marker for the loaded snapshot, or 0 if there isn't one,
+// in which case every write in the log came after the snapshot.
+func (store *Store) logStart(data []byte) int {
+	if store.snapshotID == 0 {
+		return 0
+	}
+	marker := AOF_SNAPSHOT_MARKER + strconv.FormatUint(store.snapshotID, 10)
+	start := 0
+	for offset := 0; offset < len(data); {
+		request, n, err := decodeLogRecord(data[offset:])
+		if err != nil {
+			break
+		}
+		offset += n
+		if request == marker {
+			start = offset
+		}
+	}
+	return start
+}
+
+// The last record in the log was torn by a crash while it was written: it runs past the
+// end of the file, or its checksum doesn't match.
+var errTruncatedRecord = errors.New("truncated log record")
+
+// Returns the request in the record at the start of data, and the length of the record.
+func decodeLogRecord(data []byte) (string, int, error) {
+	if len(data) < AOF_HEADER_LENGTH {
+		return "", len(data), errTruncatedRecord
+	}
+	length := int64(binary.BigEndian.Uint32(data))
+	sum := binary.BigEndian.Uint32(data[4:])
+	end := AOF_HEADER_LENGTH + length
+	if end > int64(len(data)) {
+		return "", len(data), errTruncatedRecord
+	}
+	request := data[AOF_HEADER_LENGTH:end]
+	if crc32.ChecksumIEEE(request) != sum {
+		if end == int64(len(data)) {
+			return "", int(end), errTruncatedRecord
+		}
+		return "", int(end), errors.New("log record checksum mismatch")
+	}
+	return string(request), int(end), nil
+}
+
+func encodeLogRecord(request string) []byte {
+	record := make([]byte, AOF_HEADER_LENGTH+len(request))
+	binary.BigEndian.PutUint32(record, uint32(len(request)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE([]byte(request)))
+	copy(record[AOF_HEADER_LENGTH:], request)
+	return record
+}
+
+// Appends a write to the log. Called with the store locked, before the reply goes out.
+func (store *Store) appendLog(request string) {
+	if store.aof == nil || store.loading {
+		return
+	}
+	record := encodeLogRecord(request)
+	if _, err := store.aof.Write(record); err != nil {
+		log.Fatal("Unable to append to log: ", err)
+	}
+	if store.fsync == FSYNC_ALWAYS {
+		if err := store.aof.Sync(); err != nil {
+			log.Fatal("Unable to sync log: ", err)
+		}
+	}
+	store.aofSize += int64(len(record))
+
+	if store.rewriting {
+		// The rewritten log won't have this write, so it gets added at the end.
+		store.rewriteBuf = append(store.rewriteBuf, request)
+	} else if store.aofSize > AOF_REWRITE_MIN_SIZE && store.aofSize > 2*store.aofBaseSize {
+		store.startRewrite()
+	}
+}
+
+// Fsyncs the log once a second under the "everysec" policy.
+func (store *Store) syncLog() {
+	ticker := time.NewTicker(AOF_SYNC_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.stop:
+			return
+		}
+		store.lock.Lock()
+		aof, fsync := store.aof, store.fsync
+		store.lock.Unlock()
+
+		// Syncing doesn't need the lock, so writers aren't held up by the disk.
+		if aof != nil && fsync == FSYNC_EVERYSEC {
+			aof.Sync()
+		}
+	}
+}
+
+// Sets when the log gets fsynced: after every write, once a second, or never.
+func (store *Store) SetFsyncPolicy(policy string) error {
+	if policy != FSYNC_ALWAYS && policy != FSYNC_EVERYSEC && policy != FSYNC_NEVER {
+		return errors.New("unknown fsync policy: " + policy)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.fsync = policy
+	return nil
+}
+
+// Empties the log once its writes are safely in a snapshot.
+func (store *Store) truncateLog() {
+	if store.aof == nil {
+		return
+	}
+	if err := store.aof.Truncate(0); err != nil {
+		log.Fatal(err)
+	}
+	store.aofSize, store.aofBaseSize = 0, 0
+	store.loggedDB = 0
+}
+
+func bgrewriteaof(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"BGREWRITEAOF\", expected 0")
+	}
+	if store.rewriting {
+		return reply.Error("Background append only file rewriting already in progress")
+	}
+	store.startRewrite()
+	return reply.Status("Background append only file rewriting started")
+}
+
+// Starts rewriting the log in the background. Must be called with the store locked.
+func (store *Store) startRewrite() {
+	store.rewriting = true
+	store.rewriteBuf = nil
+	store.rewriteDB = store.loggedDB
+	go store.rewriteLog(store.openView())
+}
+
+// Writes the shortest log that rebuilds the store as of the view, then adds the writes
+// made since then, and swaps it in for the current log.
+func (store *Store) rewriteLog(v *view) {
+	err := store.writeRewrite(v)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.closeView(v)
+	store.rewriting = false
+	store.rewriteBuf = nil
+	if err != nil {
+		fmt.Println("Log rewrite failed:", err)
+		os.Remove(store.path(AOF_REWRITE_FILENAME))
+		return
+	}
+	fmt.Println("Log rewrite finished")
+}
+
+func (store *Store) writeRewrite(v *view) error {
+	file, err := os.Create(store.path(AOF_REWRITE_FILENAME))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	out.Write(encodeLogRecord(AOF_BASE_MARKER))
+
+	// Only the encoding happens under the lock; the disk is written to without it.
+	var records []byte
+	selected := 0
+	v.each(store, func(index int, key string, src *database) {
+		if index != selected {
+			records = append(records, encodeLogRecord(selectRequest(index))...)
+			selected = index
+		}
+		for _, request := range keyCommands(src, key) {
+			records = append(records, encodeLogRecord(request)...)
+		}
+	}, func() {
+		out.Write(records)
+		records = records[:0]
+	})
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	// Writers are held up from here on, until the new log has replaced the old one.
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if selected != store.rewriteDB {
+		// The writes made since were logged after the database selected back then.
+		out.Write(encodeLogRecord(selectRequest(store.rewriteDB)))
+	}
+	for _, request := range store.rewriteBuf {
+		out.Write(encodeLogRecord(request))
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(store.path(AOF_REWRITE_FILENAME), store.path(AOF_FILENAME)); err != nil {
+		return err
+	}
+	aof, err := os.OpenFile(store.path(AOF_FILENAME), os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.aof.Close()
+	store.aof = aof
+	store.aofSize, store.aofBaseSize = info.Size(), info.Size()
+	return nil
+}
+
+// Returns the requests that recreate a key, as it is in the given database.
+func keyCommands(src *database, key string) []string {
+	requests := make([]string, 0)
+	if val, present := src.stringStore[key]; present {
+		requests = append(requests, utils.JoinArgs("SET", key, val))
+	}
+	if l, present := src.listStore[key]; present {
+		for e := l.Front(); e != nil; e = e.Next() {
+			requests = append(requests, utils.JoinArgs("RPUSH", key, e.Value.(string)))
+		}
+	}
+	if hash, present := src.hashStore[key]; present {
+		for field, val := range hash {
+			requests = append(requests, utils.JoinArgs("HSET", key, field, val))
+		}
+	}
+	if set, present := src.setStore[key]; present {
+		requests = append(requests, utils.JoinArgs(append([]string{"SADD", key}, setMembers(set)...)...))
+	}
+	if zset, present := src.zsetStore[key]; present {
+		args := []string{"ZADD", key}
+		for x := zset.zsl.header.levels[0].forward; x != nil; x = x.levels[0].forward {
+			args = append(args, formatScore(x.score), x.member)
+		}
+		requests = append(requests, utils.JoinArgs(args...))
+	}
+	if deadline, present := src.expires[key]; present {
+		requests = append(requests, utils.JoinArgs("PEXPIREAT", key, formatMillis(deadline)))
+	}
+	return requests
+}
@@ -0,0 +1,47 @@
+package db
+
+import "testing"
+
+func TestReplayLog(t *testing.T) {
+	first, second := encodeLogRecord("SET a 1"), encodeLogRecord("SET b 2")
+	badSum := encodeLogRecord("SET c 3")
+	badSum[len(badSum)-1] ^= 0xff
+
+	join := func(records ...[]byte) []byte {
+		var data []byte
+		for _, record := range records {
+			data = append(data, record...)
+		}
+		return data
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		valid   int
+		corrupt bool
+	}{
+		{"empty", nil, 0, false},
+		{"whole records", join(first, second), len(first) + len(second), false},
+		{"truncated request", join(first, second[:len(second)-2]), len(first), false},
+		{"header only", join(first, second[:AOF_HEADER_LENGTH]), len(first), false},
+		{"truncated header", join(first, second[:AOF_HEADER_LENGTH-1]), len(first), false},
+		{"bad checksum mid-file", join(first, badSum, second), len(first), true},
+		{"bad checksum at the end", join(first, badSum), len(first), false},
+		{"bad checksum before a torn record", join(first, badSum, second[:3]), len(first), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			valid, err := store.replayLog(test.data)
+			if valid != test.valid {
+				t.Errorf("valid = %d, want %d", valid, test.valid)
+			}
+			if corrupt := err != nil; corrupt != test.corrupt {
+				t.Errorf("err = %v, want corrupt = %v", err, test.corrupt)
+			}
+			if len(test.data) > 0 && store.Execute("GET a").Str != "1" {
+				t.Errorf("the record before the bad one wasn't replayed")
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// A client waiting on a blocking pop, until one of its lists is pushed to or it times out.
+type waiter struct {
+	client   string
+	request  string
+	db       int
+	keys     []string
+	deadline time.Time
+
+	// The reply it gets if it times out.
+	timedOut reply.Reply
+
+	// Set when its request has to wait for an item, in which case its reply is thrown away.
+	blocked bool
+}
+
+// A reply for a client that was waiting on a blocking pop.
+type Wakeup struct {
+	Client string
+	Reply  reply.Reply
+}
+
+func (w *waiter) waitsOn(keys map[dbKey]bool) bool {
+	for _, key := range w.keys {
+		if keys[dbKey{w.db, key}] {
+			return true
+		}
+	}
+	return false
+}
+
+// Marks a list in the selected database as pushed to, so the clients waiting on it get
+// another try.
+func (store *Store) signalReady(key string) {
+	if len(store.waiters) > 0 {
+		store.ready[dbKey{store.db, key}] = true
+	}
+}
+
+// Leaves the client of the request being executed waiting on the given lists, until it
+// gets the timedOut reply. The timeout starts when it first waits, and 0 waits forever.
+func (store *Store) block(keys []string, timeout time.Duration, timedOut reply.Reply) reply.Reply {
+	w := store.waiting
+	if w == nil {
+		// Nobody to reply to later, as in a transaction.
+		return timedOut
+	}
+	if w.keys == nil {
+		w.keys = keys
+		w.timedOut = timedOut
+		if timeout > 0 {
+			w.deadline = time.Now().Add(timeout)
+		}
+	}
+	w.blocked = true
+	return timedOut
+}
+
+// Serves the waiting clients whose lists have been pushed to, in the order they started
+// waiting, and times out the ones that have waited too long. Returns their replies.
+func (store *Store) Unblocked() []Wakeup {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	wakeups := make([]Wakeup, 0)
+	if len(store.waiters) == 0 {
+		return wakeups
+	}
+
+	// Serving a BLMOVE can push to another list that clients are waiting on.
+	for len(store.ready) > 0 {
+		ready := store.ready
+		store.ready = make(map[dbKey]bool)
+		remaining := make([]*waiter, 0, len(store.waiters))
+		for _, w := range store.waiters {
+			if !w.waitsOn(ready) {
+				remaining = append(remaining, w)
+				continue
+			}
+			var result reply.Reply
+			w.blocked = false
+			store.waiting = w
+			store.inDB(w.db, func() {
+				result = store.execute(w.request)
+			})
+			store.waiting = nil
+			if w.blocked {
+				// Someone ahead of it got the item.
+				remaining = append(remaining, w)
+			} else {
+				wakeups = append(wakeups, Wakeup{Client: w.client, Reply: result})
+			}
+		}
+		store.waiters = remaining
+	}
+
+	now := time.Now()
+	remaining := make([]*waiter, 0, len(store.waiters))
+	for _, w := range store.waiters {
+		if !w.deadline.IsZero() && now.After(w.deadline) {
+			wakeups = append(wakeups, Wakeup{Client: w.client, Reply: w.timedOut})
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	store.waiters = remaining
+	return wakeups
+}
+
+// Stops a client from waiting, once it has gone away.
+func (store *Store) Disconnect(client string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	remaining := make([]*waiter, 0, len(store.waiters))
+	for _, w := range store.waiters {
+		if w.client != client {
+			remaining = append(remaining, w)
+		}
+	}
+	store.waiters = remaining
+}
+
+// Parses the timeout of a blocking pop, in seconds.
+func parseTimeout(arg string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// Pops from the first of the lists that isn't empty, or waits for one of them to be
+// pushed to.
+func (store *Store) blockingPop(args []string, left bool, name string) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"" + name + "\", expected at least 2")
+	}
+	timeout, ok := parseTimeout(args[len(args)-1])
+	if !ok {
+		return reply.Error("timeout is not a float or out of range")
+	}
+
+	// Only the pop itself gets replicated, never the wait.
+	store.rewrite()
+	keys := make([]string, len(args)-1)
+	for i, arg := range args[:len(args)-1] {
+		keys[i] = arg
+		store.expireIfNeeded(keys[i])
+		if item, present := store.popList(keys[i], left); present {
+			if left {
+				store.rewrite(utils.JoinArgs("LPOP", keys[i]))
+			} else {
+				store.rewrite(utils.JoinArgs("RPOP", keys[i]))
+			}
+			store.dirty++
+			return reply.Array(reply.Bulk(keys[i]), reply.Bulk(item))
+		}
+	}
+	return store.block(keys, timeout, reply.NullArray())
+}
+
+func blpop(args []string, store *Store) reply.Reply {
+	return store.blockingPop(args, true, "BLPOP")
+}
+
+func brpop(args []string, store *Store) reply.Reply {
+	return store.blockingPop(args, false, "BRPOP")
+}
+
+func blmove(args []string, store *Store) reply.Reply {
+	if len(args) != 5 {
+		return reply.Error("wrong number of arguments for \"BLMOVE\", expected 5")
+	}
+	_, fromOk := parseEnd(args[2])
+	_, toOk := parseEnd(args[3])
+	if !fromOk || !toOk {
+		return reply.Error("ends must be LEFT or RIGHT")
+	}
+	timeout, ok := parseTimeout(args[4])
+	if !ok {
+		return reply.Error("timeout is not a float or out of range")
+	}
+
+	store.rewrite()
+	item, present := store.moveList(args[:4])
+	if !present {
+		return store.block([]string{args[0]}, timeout, reply.Null())
+	}
+	store.rewrite(utils.JoinArgs(append([]string{"LMOVE"}, args[:4]...)...))
+	return reply.Bulk(item)
+}
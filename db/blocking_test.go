@@ -0,0 +1,50 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+func TestBlockingTimeoutReplies(t *testing.T) {
+	tests := []struct {
+		request string
+		reply   reply.Reply
+	}{
+		// Pops time out with a null array, like an aborted EXEC, and moves with a null
+		// string, like the LMOVE they stand for.
+		{"BLPOP a b 0.01", reply.NullArray()},
+		{"BRPOP a 0.01", reply.NullArray()},
+		{"BLMOVE a b LEFT RIGHT 0.01", reply.Null()},
+	}
+	for _, test := range tests {
+		t.Run(test.request, func(t *testing.T) {
+			store := newTestStore(t)
+			if _, done := store.ExecuteFor("CLI0", 0, test.request); done {
+				t.Fatalf("%s didn't wait", test.request)
+			}
+			time.Sleep(20 * time.Millisecond)
+			wakeups := store.Unblocked()
+			if len(wakeups) != 1 || !reflect.DeepEqual(wakeups[0].Reply, test.reply) {
+				t.Errorf("wakeups = %v, want %v", wakeups, test.reply)
+			}
+
+			// Nobody waits in a transaction, which gets the timeout reply straight away.
+			result := store.Execute(Batch([]string{test.request}))
+			if !reflect.DeepEqual(result, reply.Array(test.reply)) {
+				t.Errorf("EXEC %s = %#v, want %#v", test.request, result, reply.Array(test.reply))
+			}
+		})
+	}
+}
+
+func TestAbortedExecIsNullArray(t *testing.T) {
+	store := newTestStore(t)
+	store.Execute("SET a 1")
+	watched := []WatchedKey{{DB: 0, Key: "a", Version: 0}}
+	if result := store.Execute(WatchedBatch([]string{"GET a"}, watched)); result.Type != reply.NULL_ARRAY {
+		t.Errorf("aborted EXEC = %#v, want a null array", result)
+	}
+}
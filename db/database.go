@@ -0,0 +1,213 @@
+package db
+
+import (
+	"container/list"
+	"strconv"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// Number of logical databases in a store, numbered from 0.
+const DATABASES = 16
+
+const DB_OUT_OF_RANGE = "DB index is out of range"
+
+// One of the numbered databases, each an independent keyspace.
+type database struct {
+	stringStore map[string]string
+	hashStore   map[string]map[string]string
+	listStore   map[string]*list.List
+	setStore    map[string]map[string]bool
+	zsetStore   map[string]*sortedSet
+	expires     map[string]time.Time
+
+	// The version of each key that has ever been changed, for WATCH.
+	versions map[string]uint64
+
+	// The estimated memory used by each key, and when it was accessed, for eviction.
+	sizes  map[string]int64
+	access map[string]keyAccess
+
+	// Indexes that the iterations of SCAN and the like continue from.
+	scans map[scanTarget]*scanIndex
+}
+
+func newDatabase() *database {
+	return &database{listStore: make(map[string]*list.List),
+		hashStore:   make(map[string]map[string]string),
+		stringStore: make(map[string]string),
+		setStore:    make(map[string]map[string]bool),
+		zsetStore:   make(map[string]*sortedSet),
+		expires:     make(map[string]time.Time),
+		versions:    make(map[string]uint64),
+		sizes:       make(map[string]int64),
+		access:      make(map[string]keyAccess),
+		scans:       make(map[scanTarget]*scanIndex)}
+}
+
+// Returns a full set of empty databases.
+func newDatabases() []*database {
+	dbs := make([]*database, DATABASES)
+	for i := range dbs {
+		dbs[i] = newDatabase()
+	}
+	return dbs
+}
+
+// Returns the name of every key in the database, once each.
+func (d *database) keys() []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0, len(d.stringStore))
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for key := range d.stringStore {
+		add(key)
+	}
+	for key := range d.listStore {
+		add(key)
+	}
+	for key := range d.hashStore {
+		add(key)
+	}
+	for key := range d.setStore {
+		add(key)
+	}
+	for key := range d.zsetStore {
+		add(key)
+	}
+	return keys
+}
+
+// A key in one of the databases.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// Parses the index of a database.
+func parseDB(arg string) (int, bool) {
+	index, err := strconv.Atoi(arg)
+	if err != nil || index < 0 || index >= DATABASES {
+		return 0, false
+	}
+	return index, true
+}
+
+// Returns the request that selects a database in the log or on the backup.
+func selectRequest(index int) string {
+	return "SELECT " + strconv.Itoa(index)
+}
+
+// Makes requests run against the given database from now on.
+func (store *Store) selectDB(index int) {
+	store.db = index
+	store.database = store.dbs[index]
+}
+
+// Runs fn with another database selected, and selects the current one again after.
+func (store *Store) inDB(index int, fn func()) {
+	current := store.db
+	store.selectDB(index)
+	fn()
+	store.selectDB(current)
+}
+
+// Clients select a database through the master, which sends it along with each request.
+// Only the log and the backup see SELECT, in front of writes to another database.
+func selectCommand(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"SELECT\", expected 1")
+	}
+	index, ok := parseDB(args[0])
+	if !ok {
+		return reply.Error(DB_OUT_OF_RANGE)
+	}
+	store.selectDB(index)
+	return reply.OK
+}
+
+// Moves a key to another database, unless it already has a key of that name.
+func move(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"MOVE\", expected 2")
+	}
+	key := args[0]
+	target, ok := parseDB(args[1])
+	if !ok {
+		return reply.Error(DB_OUT_OF_RANGE)
+	}
+	if target == store.db {
+		return reply.Error("source and destination objects are the same")
+	}
+	if !store.exists(key) {
+		return reply.Integer(0)
+	}
+
+	source, moved := store.database, false
+	store.inDB(target, func() {
+		store.expireIfNeeded(key)
+		if store.exists(key) {
+			return
+		}
+		store.touch(key)
+		moveValue(store.database, key, source, key)
+		store.notify(NOTIFY_GENERIC, "move_to", key)
+		if _, present := store.listStore[key]; present {
+			store.signalReady(key)
+		}
+		moved = true
+	})
+	if !moved {
+		return reply.Integer(0)
+	}
+	store.removeKey(key)
+	store.notify(NOTIFY_GENERIC, "move_from", key)
+	store.dirty++
+	return reply.Integer(1)
+}
+
+// Swaps the contents of two databases, so clients of one see the keys of the other.
+func swapdb(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"SWAPDB\", expected 2")
+	}
+	first, firstOk := parseDB(args[0])
+	second, secondOk := parseDB(args[1])
+	if !firstOk || !secondOk {
+		return reply.Error(DB_OUT_OF_RANGE)
+	}
+	if first == second {
+		return reply.OK
+	}
+
+	// Views read by index, so they need a copy of every key that's about to change
+	// places. The versions move along with the keys, which is enough to fail a watch on
+	// any key that changes in the swap.
+	for _, index := range []int{first, second} {
+		store.inDB(index, func() {
+			if len(store.views) > 0 {
+				for _, key := range store.keys() {
+					store.touch(key)
+				}
+			}
+		})
+	}
+	store.dbs[first], store.dbs[second] = store.dbs[second], store.dbs[first]
+	store.selectDB(store.db)
+
+	// Clients waiting on a list in either database may find it there now.
+	for _, index := range []int{first, second} {
+		store.inDB(index, func() {
+			for key := range store.listStore {
+				store.signalReady(key)
+			}
+		})
+	}
+	store.dirty++
+	return reply.OK
+}
@@ -2,33 +2,68 @@ package db
 
 import (
 	"bufio"
+	"bytes"
 	"container/list"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
 )
 
 // Integer constants.
 const (
 	MAXINT                = 9223372036854775807
 	MININT                = -9223372036854775808
-	INITIAL_LOG_CAPACITY  = 8192
 	INITIAL_LIST_CAPACITY = 1024
 )
 
 // Lookup table for function requests.
-var funcmap = map[string]func(args []string, store *Store) string{
+var funcmap = map[string]func(args []string, store *Store) reply.Reply{
 	// String operations.
 	"get":    getValue,
 	"set":    setValue,
 	"incr":   incr,
 	"incrby": incrby,
 	"decr":   decr,
-	"del":    del,
+
+	// Keyspace operations, on keys of any type.
+	"del":       del,
+	"unlink":    unlink,
+	"keys":      keys,
+	"exists":    exists,
+	"type":      keyType,
+	"rename":    rename,
+	"renamenx":  renamenx,
+	"copy":      copyCommand,
+	"dbsize":    dbsize,
+	"randomkey": randomkey,
+	"flushdb":   flushdb,
+
+	// Server operations.
+	"info":   info,
+	"memory": memory,
+
+	// Database operations.
+	"select": selectCommand,
+	"move":   move,
+	"swapdb": swapdb,
+
+	// Expiration operations.
+	"expire":    expire,
+	"pexpire":   pexpire,
+	"expireat":  expireat,
+	"pexpireat": pexpireat,
+	"ttl":       ttl,
+	"pttl":      pttl,
+	"persist":   persist,
 
 	// List operations.
 	"lpush":  lpush,
@@ -37,6 +72,12 @@ var funcmap = map[string]func(args []string, store *Store) string{
 	"rpop":   rpop,
 	"llen":   llen,
 	"lrange": lrange,
+	"lmove":  lmove,
+
+	// Blocking list operations.
+	"blpop":  blpop,
+	"brpop":  brpop,
+	"blmove": blmove,
 
 	// Hash operations.
 	"hset":    hset,
@@ -45,349 +86,722 @@ var funcmap = map[string]func(args []string, store *Store) string{
 	"hkeys":   hkeys,
 	"hvals":   hvals,
 	"hgetall": hgetall,
+
+	// Persistence operations.
+	"save":         save,
+	"bgsave":       bgsave,
+	"lastsave":     lastsave,
+	"bgrewriteaof": bgrewriteaof,
+
+	// Set operations.
+	"sadd":        sadd,
+	"srem":        srem,
+	"sismember":   sismember,
+	"scard":       scard,
+	"smembers":    smembers,
+	"spop":        spop,
+	"srandmember": srandmember,
+	"smove":       smove,
+	"sinter":      sinter,
+	"sunion":      sunion,
+	"sdiff":       sdiff,
+	"sinterstore": sinterstore,
+	"sunionstore": sunionstore,
+	"sdiffstore":  sdiffstore,
+
+	// Sorted set operations.
+	"zadd":             zadd,
+	"zrem":             zrem,
+	"zcard":            zcard,
+	"zscore":           zscore,
+	"zincrby":          zincrby,
+	"zrank":            zrank,
+	"zrevrank":         zrevrank,
+	"zrange":           zrange,
+	"zrevrange":        zrevrange,
+	"zrangebyscore":    zrangebyscore,
+	"zrangebylex":      zrangebylex,
+	"zcount":           zcount,
+	"zremrangebyscore": zremrangebyscore,
+	"zremrangebylex":   zremrangebylex,
+	"zremrangebyrank":  zremrangebyrank,
+
+	// Iteration operations.
+	"scan":  scan,
+	"hscan": hscan,
+	"sscan": sscan,
+	"zscan": zscan,
+
+	// Transaction operations.
+	"watch":   watch,
+	"unwatch": unwatch,
 }
 
 type Store struct {
-	stringStore map[string]string
-	hashStore   map[string]map[string]string
-	listStore   map[string]*list.List
-	logs        []Record
-	lock        sync.Mutex
+	// The selected database, which requests run against, and its index.
+	*database
+	db   int
+	dbs  []*database
+	lock sync.Mutex
+
+	// Append-only log of writes since the last snapshot.
+	aof         *os.File
+	aofSize     int64
+	aofBaseSize int64
+	fsync       string
+	loading     bool
+
+	// The database that the log and the backup have last seen selected.
+	loggedDB     int
+	replicatedDB int
+
+	// Background jobs reading a consistent view of the store, and the writes made
+	// while the log is being rewritten.
+	views      []*view
+	rewriting  bool
+	rewriteBuf []string
+	rewriteDB  int
+
+	// The last snapshot, and when to take the next one. A background save closes
+	// saveDone when it's finished.
+	snapshotID  uint64
+	saving      bool
+	saveDone    chan struct{}
+	lastSave    time.Time
+	dirtyAtSave uint64
+	saveRules   []saveRule
+
+	// Writes to replay on the backup, and a counter of changes made by commands. Keys
+	// that expire while a command looks at them count as changes too, but they're
+	// replicated as DELs of their own, which the expired counter keeps apart.
+	diffs     []string
+	rewritten bool
+	dirty     uint64
+	expired   uint64
+
+	// Writes made by the transaction being executed, and the database they were made in.
+	batch    []string
+	batching bool
+	batchDB  int
+
+	// Counts changes to keys, to give each change a new version for WATCH.
+	version uint64
+
+	// Clients waiting on blocking pops, in the order they started waiting, and the lists
+	// pushed to since they were last checked.
+	waiters []*waiter
+	waiting *waiter
+	ready   map[dbKey]bool
+
+	// The estimated memory used by every key, the keys changed since it was last brought
+	// up to date, and the limit past which keys are evicted.
+	used            int64
+	touched         map[dbKey]bool
+	maxMemory       int64
+	maxMemoryPolicy string
+	evicted         uint64
+
+	// Keyspace events to publish, and which classes of them are turned on.
+	notifications []Notification
+	notifyFlags   int
+
+	// Only a primary expires keys; a backup waits for the primary's deletes.
+	primary bool
+
+	// The directory the dump and the log are kept in, and a channel that's closed to stop
+	// the background jobs.
+	dir  string
+	stop chan struct{}
 }
 
-type Record struct {
-	request   string
-	timestamp time.Time
+// Returns a store that keeps its dump and log in the working directory.
+func NewStore() *Store {
+	return NewStoreIn("")
 }
 
-func NewStore() *Store {
-	store := &Store{listStore: make(map[string]*list.List),
-		hashStore:   make(map[string]map[string]string),
-		stringStore: make(map[string]string),
-		logs:        make([]Record, 0, INITIAL_LOG_CAPACITY),
-		lock:        sync.Mutex{}}
-	// Try to read a database dump if one exists.
-	store.readFromFile("dump")
+// Returns a store that keeps its dump and log in dir, or in the working directory if dir
+// is empty.
+func NewStoreIn(dir string) *Store {
+	store := &Store{dbs: newDatabases(),
+		dir:             dir,
+		stop:            make(chan struct{}),
+		ready:           make(map[dbKey]bool),
+		touched:         make(map[dbKey]bool),
+		maxMemoryPolicy: MAXMEMORY_NOEVICTION,
+		fsync:           FSYNC_EVERYSEC,
+		lastSave:        time.Now(),
+		lock:            sync.Mutex{}}
+	store.selectDB(0)
+	store.SetSaveRules(DEFAULT_SAVE_RULES)
+
+	// Try to read a database dump if one exists, then replay the writes made since.
+	store.readFromFile(store.path(DUMP_FILENAME))
+	store.openLog(store.path(AOF_FILENAME))
+	store.recount()
+
+	// Actively reclaim expired keys that are never accessed again.
+	go store.sweepExpired()
+	go store.saveOnRules()
 	return store
 }
 
-func NewRecord(r string) *Record {
-	return &Record{request: r, timestamp: time.Now()}
+// Returns the path of one of the store's files.
+func (store *Store) path(name string) string {
+	return filepath.Join(store.dir, name)
+}
+
+// Stops the background jobs and closes the log. The store can't be used afterwards.
+func (store *Store) Close() {
+	close(store.stop)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.aof != nil {
+		store.aof.Close()
+		store.aof = nil
+	}
+}
+
+// Drops every key in every database.
+func (store *Store) reset() {
+	store.dbs = newDatabases()
+	store.selectDB(0)
 }
 
 func (store *Store) Flush() {
 	// Flush all data to disk.
-	store.writeLogs()
-	store.writeDump()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.waitForSave()
+	if err := store.save(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func (store *Store) readFromFile(filename string) {
-	file, err := os.Open(filename)
-	if err == nil {
-		// Use a Scanner to get each line of the dump.
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			// The log follows the format: "key:val"
-			index := strings.IndexByte(line, ':')
-			if index == -1 {
-				fmt.Println("Invalid database record")
-				continue
-			}
-
-			// Parse and store the key-value pair.
-			key := line[:index]
-			val := line[index+1:]
-			store.stringStore[key] = val
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	if isSnapshot(data) {
+		if err := store.readSnapshot(data); err != nil {
+			// Better to refuse to start than to overwrite the dump with partial data.
+			log.Fatal("Unable to read ", filename, ": ", err)
 		}
+		return
+	}
+
+	// Otherwise this is a legacy text dump, which only holds strings.
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// The log follows the format: "key:val"
+		index := strings.IndexByte(line, ':')
+		if index == -1 {
+			fmt.Println("Invalid database record")
+			continue
+		}
+
+		// Parse and store the key-value pair.
+		key := line[:index]
+		val := line[index+1:]
+		store.stringStore[key] = val
 	}
+
+	// Sets, sorted sets and expirations were kept in files of their own.
+	store.readSets(store.path("sets"))
+	store.readSortedSets(store.path("zsets"))
+	store.readExpires(store.path("expires"))
 }
 
-func (store *Store) Execute(request string) string {
+// Executes a request in the selected database, which SELECT requests change, as when
+// replaying the log or the primary's writes.
+func (store *Store) Execute(request string) reply.Reply {
 	if request == "" {
-		return request
+		return reply.Null()
 	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	result, _ := store.executeFor("", request)
+	return result
+}
 
+// Executes a request in the given database on behalf of a client. If the request is a
+// blocking pop that can't be served yet, the client is left waiting and false is returned;
+// its reply comes from Unblocked later on. Without a client, blocking pops return right away.
+func (store *Store) ExecuteFor(client string, index int, request string) (reply.Reply, bool) {
+	if request == "" {
+		return reply.Null(), true
+	}
+	if index < 0 || index >= DATABASES {
+		return reply.Error(DB_OUT_OF_RANGE), true
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.selectDB(index)
+	return store.executeFor(client, request)
+}
+
+// Must be called with the store locked.
+func (store *Store) executeFor(client string, request string) (reply.Reply, bool) {
+	if isBatch(request) {
+		watched, requests, err := splitBatch(request)
+		if err != nil {
+			return reply.Error(err.Error()), true
+		}
+		return store.executeBatch(watched, requests), true
+	}
+	if client == "" {
+		return store.execute(request), true
+	}
+
+	w := &waiter{client: client, request: request, db: store.db}
+	store.waiting = w
+	result := store.execute(request)
+	if w.blocked {
+		store.waiters = append(store.waiters, w)
+	}
+	store.waiting = nil
+	return result, !w.blocked
+}
+
+// Runs a single request. Must be called with the store locked.
+func (store *Store) execute(request string) reply.Reply {
 	// Commands are case insensitive, but arguments are not.
-	args := strings.Split(request, " ")
+	args, err := utils.SplitArgs(request)
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	if len(args) == 0 {
+		return reply.Error("no such function")
+	}
 	function := strings.ToLower(args[0])
 
 	// Get function from map and run it with args.
 	exec, ok := funcmap[function]
 	if !ok {
-		return "ERR no such function"
+		return reply.Error("no such function")
+	}
+
+	// Make room for whatever the command adds, as long as it's up to us.
+	if growingCommands[function] && store.primary && !store.loading && !store.freeMemory() {
+		return reply.CodedError("OOM", OOM_ERROR)
 	}
-	return exec(args[1:], store)
+
+	// Lazily expire the keys before the command gets to see them.
+	keys := commandKeys(function, args[1:])
+	for _, key := range keys {
+		store.expireIfNeeded(key)
+	}
+	if !store.checkTypes(function, args[1:]) {
+		return reply.CodedError("WRONGTYPE", WRONGTYPE)
+	}
+	dirty, expired := store.dirty, store.expired
+	store.rewritten = false
+	result := exec(args[1:], store)
+	if store.dirty-dirty != store.expired-expired && !store.rewritten {
+		// The command changed the store, so the backup has to apply it as well.
+		store.propagate(request)
+	}
+	store.account()
+	store.accessed(keys)
+	return result
 }
 
-func (store *Store) logRecord(r string) {
-	request := Record{request: r, timestamp: time.Now()}
-	store.logs = append(store.logs, request)
+// Marks this store as belonging to a primary, which expires keys and records diffs.
+func (store *Store) SetPrimary(primary bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.primary = primary
 }
 
-func (store *Store) writeLogs() {
-	// Logs are append-only, and keep a complete record of all transactions in history.
-	file, err := os.OpenFile("log", os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0660)
-	if err != nil {
-		log.Fatal(err)
+// Returns and clears the writes that the backup needs to replay, in the order they were applied.
+func (store *Store) Diffs() []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	diffs := store.diffs
+	store.diffs = nil
+	return diffs
+}
+
+func (store *Store) propagate(request string) {
+	if store.batching {
+		// The writes of a transaction are logged and replicated together at the end.
+		if store.batchDB != store.db {
+			store.batch = append(store.batch, selectRequest(store.db))
+			store.batchDB = store.db
+		}
+		store.batch = append(store.batch, request)
+		return
+	}
+	if store.loggedDB != store.db {
+		store.appendLog(selectRequest(store.db))
+		store.loggedDB = store.db
+	}
+	store.appendLog(request)
+
+	// Backups never need to forward their writes.
+	if store.primary {
+		if store.replicatedDB != store.db {
+			store.diffs = append(store.diffs, selectRequest(store.db))
+			store.replicatedDB = store.db
+		}
+		store.diffs = append(store.diffs, request)
 	}
-	defer file.Close()
-	for i := 0; i < len(store.logs); i++ {
-		// Write each record to the file.
-		record := store.logs[i]
-		entry := "\"" + record.request + "\", " + record.timestamp.String() + "\n"
-		file.WriteString(entry)
+}
+
+// Replaces the verbatim request with the given requests when replicating a command.
+func (store *Store) rewrite(requests ...string) {
+	for _, request := range requests {
+		store.propagate(request)
 	}
+	store.rewritten = true
 }
 
-func (store *Store) writeDump() {
-	// Dumps are overwritten each time the server is closed.
-	file, err := os.Create("dump")
-	if err != nil {
-		log.Fatal(err)
+func (store *Store) exists(key string) bool {
+	if _, present := store.stringStore[key]; present {
+		return true
 	}
-	defer file.Close()
-	for key, val := range store.stringStore {
-		// Write each key-value pair, separated by colons, to the file.
-		entry := key + ":" + val + "\n"
-		file.WriteString(entry)
+	if _, present := store.listStore[key]; present {
+		return true
 	}
-	err = file.Sync()
-	if err != nil {
-		log.Fatal(err)
+	if _, present := store.hashStore[key]; present {
+		return true
 	}
+	if _, present := store.setStore[key]; present {
+		return true
+	}
+	_, present := store.zsetStore[key]
+	return present
+}
+
+// Removes a key of any type, along with its expiration.
+func (store *Store) removeKey(key string) bool {
+	store.touch(key)
+	present := store.exists(key)
+	delete(store.stringStore, key)
+	delete(store.listStore, key)
+	delete(store.hashStore, key)
+	delete(store.setStore, key)
+	delete(store.zsetStore, key)
+	delete(store.expires, key)
+	return present
 }
 
-func getValue(args []string, store *Store) string {
+func getValue(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"GET\", expected 1"
+		return reply.Error("wrong number of arguments for \"GET\", expected 1")
 	}
-	// Trim surrounding quotes.
-	key := strings.Trim(args[0], "\"")
+	key := args[0]
 	val, present := store.stringStore[key]
 	if !present {
-		return "<nil>"
+		return reply.Null()
 	}
-	return "\"" + val + "\""
+	return reply.Bulk(val)
 }
 
-func setValue(args []string, store *Store) string {
-	if len(args) != 2 {
-		return "wrong number of arguments for \"SET\", expected 2"
+func setValue(args []string, store *Store) reply.Reply {
+	if len(args) != 2 && len(args) != 4 {
+		return reply.Error("wrong number of arguments for \"SET\", expected 2 or 4")
+	}
+
+	key := args[0]
+	val := args[1]
+
+	// Parse an optional "EX seconds" or "PX milliseconds" timeout.
+	var deadline time.Time
+	if len(args) == 4 {
+		timeout, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || timeout <= 0 {
+			return reply.Error("invalid expire time in \"SET\"")
+		}
+		switch strings.ToLower(args[2]) {
+		case "ex":
+			deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+		case "px":
+			deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		default:
+			return reply.Error("syntax error, expected EX or PX")
+		}
 	}
 
-	// Trim surrounding quotes.
-	key := strings.Trim(args[0], "\"")
-	val := strings.Trim(args[1], "\"")
+	// Setting a value discards any previous value of another type, and any timeout.
+	store.removeKey(key)
 	store.stringStore[key] = val
-	return "OK"
+	if !deadline.IsZero() {
+		store.expires[key] = deadline
+		store.rewrite(utils.JoinArgs("SET", key, val), utils.JoinArgs("PEXPIREAT", key, formatMillis(deadline)))
+	}
+	store.notify(NOTIFY_STRING, "set", key)
+	if !deadline.IsZero() {
+		store.notify(NOTIFY_GENERIC, "expire", key)
+	}
+	store.dirty++
+	return reply.OK
 }
 
-func incr(args []string, store *Store) string {
+func incr(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"INCR\", expected 1"
+		return reply.Error("wrong number of arguments for \"INCR\", expected 1")
 	}
-	// Trim surrounding quotes.
-	key := strings.Trim(args[0], "\"")
+	key := args[0]
 
 	// Get string and try to parse it as an integer.
 	val, present := store.stringStore[key]
 	if !present {
-		return "no such value in store"
+		return reply.Error("no such value in store")
 	}
 	intVal, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
-		return "cannot increment non-integer string"
+		return reply.Error("cannot increment non-integer string")
 	}
 
 	// Check for integer overflow, increment, and convert back into a string.
 	if intVal == MAXINT {
-		return "unable to \"INCR\", integer overflow"
+		return reply.Error("unable to \"INCR\", integer overflow")
 	}
 	result := strconv.FormatInt(intVal+1, 10)
+	store.touch(key)
 	store.stringStore[key] = result
-	return "(int) " + result
+	store.notify(NOTIFY_STRING, "incrby", key)
+	store.dirty++
+	return reply.Integer(intVal + 1)
 }
 
-func incrby(args []string, store *Store) string {
+func incrby(args []string, store *Store) reply.Reply {
 	if len(args) != 2 {
-		return "wrong number of arguments for \"INCRBY\", expected 2"
+		return reply.Error("wrong number of arguments for \"INCRBY\", expected 2")
 	}
-	// Trim surrounding quotes.
-	key := strings.Trim(args[0], "\"")
+	key := args[0]
 
 	// Try to parse incrby argument as an integer.
 	plus, err := strconv.ParseInt(args[1], 10, 64)
 	if err != nil {
-		return "invalid integer argument"
+		return reply.Error("invalid integer argument")
 	}
 
 	// Get string and try to parse it as an integer.
 	val, present := store.stringStore[key]
 	if !present {
-		return "no such value in store"
+		return reply.Error("no such value in store")
 	}
 	intVal, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
-		return "cannot increment non-integer value"
+		return reply.Error("cannot increment non-integer value")
 	}
 
 	// Check for integer underflow, decrement, and convert back into a string.
 	if intVal > MAXINT-plus {
-		return "unable to \"INCRBY\", integer overflow"
+		return reply.Error("unable to \"INCRBY\", integer overflow")
 	}
 	result := strconv.FormatInt(intVal+plus, 10)
+	store.touch(key)
 	store.stringStore[key] = result
-	return "(int) " + result
+	store.notify(NOTIFY_STRING, "incrby", key)
+	store.dirty++
+	return reply.Integer(intVal + plus)
 }
 
-func decr(args []string, store *Store) string {
+func decr(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"DECR\", expected 1"
+		return reply.Error("wrong number of arguments for \"DECR\", expected 1")
 	}
-	// Trim surrounding quotes.
-	key := strings.Trim(args[0], "\"")
+	key := args[0]
 
 	// Get string and try to parse it as an integer.
 	val, present := store.stringStore[key]
 	if !present {
-		return "no such value in store"
+		return reply.Error("no such value in store")
 	}
 	intVal, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
-		return "cannot decrement non-integer value"
+		return reply.Error("cannot decrement non-integer value")
 	}
 
 	// Check for integer underflow, decrement, and convert back into a string.
 	if intVal == MININT {
-		return "unable to \"DECR\", integer underflow"
+		return reply.Error("unable to \"DECR\", integer underflow")
 	}
 	result := strconv.FormatInt(intVal-1, 10)
+	store.touch(key)
 	store.stringStore[key] = result
-	return "(int) " + result
+	store.notify(NOTIFY_STRING, "decrby", key)
+	store.dirty++
+	return reply.Integer(intVal - 1)
 }
 
-func del(args []string, store *Store) string {
-	if len(args) != 1 {
-		return "wrong number of arguments for \"DEL\", expected 1"
+func lpush(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"LPUSH\", expected 2")
 	}
-	// Trim surrounding quotes.
-	key := strings.Trim(args[0], "\"")
-	delete(store.stringStore, key)
-	return "OK"
+	name, item := args[0], args[1]
+
+	// Append to list, creating it if needed, and return length of list.
+	store.pushList(name, item, true)
+	store.dirty++
+	return reply.Integer(int64(store.listStore[name].Len()))
 }
 
-func lpush(args []string, store *Store) string {
-	if len(args) != 2 {
-		return "wrong number of arguments for \"LPUSH\", expected 2"
+func lpop(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"LPOP\", expected 1")
 	}
-	// Trim surrounding quotes.
-	name, item := strings.Trim(args[0], "\""), strings.Trim(args[1], "\"")
 
-	// Check if list is present, and create a new one if not.
-	l, present := store.listStore[name]
+	name := args[0]
+
+	// Pop from list and return item, if the list is present in store.
+	item, present := store.popList(name, true)
 	if !present {
-		l = list.New()
+		return reply.Null()
 	}
-	// Append to list and return length of list.
-	l.PushFront(item)
-	store.listStore[name] = l
-	return "(int) " + strconv.FormatInt(int64(l.Len()), 10)
+	store.dirty++
+	return reply.Bulk(item)
+}
+
+func rpush(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"RPUSH\", expected 2")
+	}
+	name, item := args[0], args[1]
+
+	// Append to list, creating it if needed, and return length of list.
+	store.pushList(name, item, false)
+	store.dirty++
+	return reply.Integer(int64(store.listStore[name].Len()))
 }
 
-func lpop(args []string, store *Store) string {
+func rpop(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"LPOP\", expected 1"
+		return reply.Error("wrong number of arguments for \"RPOP\", expected 1")
 	}
 
-	// Trim surrounding quotes.
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 
-	// Check if list is present in store.
-	l, present := store.listStore[name]
+	// Pop from list and return item, if the list is present in store.
+	item, present := store.popList(name, false)
 	if !present {
-		return "<nil>"
+		return reply.Null()
 	}
-	// Pop from list and return item.
-	item := l.Remove(l.Front()).(string)
-	return "\"" + item + "\""
+	store.dirty++
+	return reply.Bulk(item)
 }
 
-func rpush(args []string, store *Store) string {
-	if len(args) != 2 {
-		return "wrong number of arguments for \"RPUSH\", expected 2"
+// Pops an item from either end of a list, deleting the list once it's empty.
+func (store *Store) popList(name string, left bool) (string, bool) {
+	l, present := store.listStore[name]
+	if !present {
+		return "", false
+	}
+	store.touch(name)
+	end := l.Back()
+	if left {
+		end = l.Front()
 	}
-	// Trim surrounding quotes.
-	name, item := strings.Trim(args[0], "\""), strings.Trim(args[1], "\"")
+	item := l.Remove(end).(string)
+	store.notify(NOTIFY_LIST, listEvent(left, "pop"), name)
+	if l.Len() == 0 {
+		store.removeKey(name)
+		store.notify(NOTIFY_GENERIC, "del", name)
+	}
+	return item, true
+}
 
-	// Check if list is present, and create a new one if not.
+// Pushes an item onto either end of a list, creating the list if it doesn't exist.
+func (store *Store) pushList(name string, item string, left bool) {
+	store.touch(name)
 	l, present := store.listStore[name]
 	if !present {
 		l = list.New()
+		store.listStore[name] = l
+	}
+	if left {
+		l.PushFront(item)
+	} else {
+		l.PushBack(item)
 	}
-	// Append to list and return length of list.
-	l.PushBack(item)
-	store.listStore[name] = l
-	return "(int) " + strconv.FormatInt(int64(l.Len()), 10)
+	store.notify(NOTIFY_LIST, listEvent(left, "push"), name)
+	store.signalReady(name)
 }
 
-func rpop(args []string, store *Store) string {
-	if len(args) != 1 {
-		return "wrong number of arguments for \"RPOP\", expected 1"
+// Parses the LEFT or RIGHT arguments of LMOVE and BLMOVE.
+func parseEnd(arg string) (bool, bool) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
 	}
+	return false, false
+}
 
-	// Trim surrounding quotes.
-	name := strings.Trim(args[0], "\"")
+// Pops an item from one end of the source list and pushes it onto one end of the
+// destination, returning the item.
+func (store *Store) moveList(args []string) (string, bool) {
+	source, destination := args[0], args[1]
+	from, _ := parseEnd(args[2])
+	to, _ := parseEnd(args[3])
+	store.expireIfNeeded(destination)
+	item, present := store.popList(source, from)
+	if !present {
+		return "", false
+	}
+	store.pushList(destination, item, to)
+	store.dirty++
+	return item, true
+}
 
-	// Check if list is present in store.
-	l, present := store.listStore[name]
+func lmove(args []string, store *Store) reply.Reply {
+	if len(args) != 4 {
+		return reply.Error("wrong number of arguments for \"LMOVE\", expected 4")
+	}
+	_, fromOk := parseEnd(args[2])
+	_, toOk := parseEnd(args[3])
+	if !fromOk || !toOk {
+		return reply.Error("ends must be LEFT or RIGHT")
+	}
+	item, present := store.moveList(args)
 	if !present {
-		return "<nil>"
+		return reply.Null()
 	}
-	// Pop from list and return item.
-	item := l.Remove(l.Back()).(string)
-	return "\"" + item + "\""
+	return reply.Bulk(item)
 }
 
-func llen(args []string, store *Store) string {
+func llen(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"LLEN\", expected 1"
+		return reply.Error("wrong number of arguments for \"LLEN\", expected 1")
 	}
 
-	// Trim surrounding quotes.
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 
 	// Check if list is present in store.
 	l, present := store.listStore[name]
 	if !present {
-		return "(int) 0"
+		return reply.Integer(0)
 	}
-	return "(int) " + strconv.FormatInt(int64(l.Len()), 10)
+	return reply.Integer(int64(l.Len()))
 }
 
-func lrange(args []string, store *Store) string {
+func lrange(args []string, store *Store) reply.Reply {
 	if len(args) != 3 {
-		return "wrong number of arguments for \"LRANGE\", expected 3"
+		return reply.Error("wrong number of arguments for \"LRANGE\", expected 3")
 	}
 
-	// Trim surrounding quotes
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 
 	// Check if list is present in store
 	l, present := store.listStore[name]
 	if !present {
-		return "empty list"
+		return reply.Array()
 	}
 
 	// Try to parse start and stop as integers.
 	start, err := strconv.ParseInt(args[1], 10, 64)
 	if err != nil {
-		return "invalid integer given as start index"
+		return reply.Error("invalid integer given as start index")
 	}
 	stop, err := strconv.ParseInt(args[2], 10, 64)
 	if err != nil {
-		return "invalid integer given as stop index"
+		return reply.Error("invalid integer given as stop index")
 	}
 
 	// Read until end of the list if stop is negative.
@@ -397,124 +811,124 @@ func lrange(args []string, store *Store) string {
 
 	// Start should be a positive integer.
 	if start < 0 {
-		return "start index must be positive"
+		return reply.Error("start index must be positive")
 	}
 	if int(start) > l.Len() {
-		return "empty list"
+		return reply.Array()
 	}
 
-	// Print out each item of the list until stop, or the end of the list.
-	ret := ""
+	// Collect each item of the list until stop, or the end of the list.
+	items := make([]string, 0)
 	for e, i := l.Front(), start; i < stop && e != nil; i, e = i+1, e.Next() {
-		ret = ret + "\"" + e.Value.(string) + "\", "
+		items = append(items, e.Value.(string))
 	}
-	ret = ret[:len(ret)-2]
-	return ret
+	return reply.Bulks(items)
 }
 
-func hset(args []string, store *Store) string {
+func hset(args []string, store *Store) reply.Reply {
 	if len(args) != 3 {
-		return "wrong number of arguments for \"HSET\", expected 3"
+		return reply.Error("wrong number of arguments for \"HSET\", expected 3")
 	}
 
-	ret, name := 1, strings.Trim(args[0], "\"")
+	ret, name := 1, args[0]
 	hash, present := store.hashStore[name]
 	if !present {
 		hash = make(map[string]string)
 	}
 
-	key, val := strings.Trim(args[1], "\""), strings.Trim(args[2], "\"")
+	key, val := args[1], args[2]
 	_, present = hash[key]
 	if present {
 		ret = 0
 	}
+	store.touch(name)
 	hash[key] = val
 	store.hashStore[name] = hash
-	return "(int) " + strconv.FormatInt(int64(ret), 10)
+	store.notify(NOTIFY_HASH, "hset", name)
+	store.dirty++
+	return reply.Integer(int64(ret))
 }
 
-func hget(args []string, store *Store) string {
+func hget(args []string, store *Store) reply.Reply {
 	if len(args) != 2 {
-		return "wrong number of arguments for \"HGET\", expected 3"
+		return reply.Error("wrong number of arguments for \"HGET\", expected 3")
 	}
 
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 	hash, present := store.hashStore[name]
 	if !present {
-		return "<nil>"
+		return reply.Null()
 	}
 
-	key := strings.Trim(args[1], "\"")
+	key := args[1]
 	val, present := hash[key]
 	if !present {
-		return "<nil>"
+		return reply.Null()
 	}
-	return "\"" + val + "\""
+	return reply.Bulk(val)
 }
 
-func hlen(args []string, store *Store) string {
+func hlen(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"HLEN\", expected 3"
+		return reply.Error("wrong number of arguments for \"HLEN\", expected 3")
 	}
 
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 	hash, present := store.hashStore[name]
 	if !present {
-		return "(int) 0"
+		return reply.Integer(0)
 	}
-	return strconv.FormatInt(int64(len(hash)), 10)
+	return reply.Integer(int64(len(hash)))
 }
 
-func hkeys(args []string, store *Store) string {
+func hkeys(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"HKEYS\", expected 1"
+		return reply.Error("wrong number of arguments for \"HKEYS\", expected 1")
 	}
 
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 	hash, present := store.hashStore[name]
 	if !present {
-		return "empty hash"
+		return reply.Array()
 	}
-	ret := ""
-	for key, _ := range hash {
-		ret = ret + "\"" + key + "\", "
+	keys := make([]string, 0, len(hash))
+	for key := range hash {
+		keys = append(keys, key)
 	}
-	ret = ret[:len(ret)-2]
-	return ""
+	return reply.Bulks(keys)
 }
 
-func hvals(args []string, store *Store) string {
+func hvals(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"HVALS\", expected 1"
+		return reply.Error("wrong number of arguments for \"HVALS\", expected 1")
 	}
 
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 	hash, present := store.hashStore[name]
 	if !present {
-		return "empty hash"
+		return reply.Array()
 	}
-	ret := ""
+	vals := make([]string, 0, len(hash))
 	for _, val := range hash {
-		ret = ret + "\"" + val + "\", "
+		vals = append(vals, val)
 	}
-	ret = ret[:len(ret)-2]
-	return ""
+	return reply.Bulks(vals)
 }
 
-func hgetall(args []string, store *Store) string {
+func hgetall(args []string, store *Store) reply.Reply {
 	if len(args) != 1 {
-		return "wrong number of arguments for \"HGETALL\", expected 1"
+		return reply.Error("wrong number of arguments for \"HGETALL\", expected 1")
 	}
 
-	name := strings.Trim(args[0], "\"")
+	name := args[0]
 	hash, present := store.hashStore[name]
 	if !present {
-		return "empty hash"
+		return reply.Array()
 	}
-	ret := ""
+	// Each field is followed by its value.
+	pairs := make([]reply.Reply, 0, 2*len(hash))
 	for key, val := range hash {
-		ret = ret + "\"" + key + "->" + val + "\", "
+		pairs = append(pairs, reply.Bulk(key), reply.Bulk(val))
 	}
-	ret = ret[:len(ret)-2]
-	return ret
+	return reply.Map(pairs...)
 }
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Expiration constants.
+const (
+	SWEEP_PERIOD    = 100 * time.Millisecond
+	SWEEP_SAMPLES   = 20
+	SWEEP_THRESHOLD = SWEEP_SAMPLES / 4
+)
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func formatMillis(t time.Time) string {
+	return strconv.FormatInt(unixMillis(t), 10)
+}
+
+func parseMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Deletes the key if its timeout has passed, and tells the backup to do the same.
+func (store *Store) expireIfNeeded(key string) bool {
+	if !store.primary {
+		return false
+	}
+	deadline, present := store.expires[key]
+	if !present || time.Now().Before(deadline) {
+		return false
+	}
+	store.removeKey(key)
+	store.propagate(utils.JoinArgs("DEL", key))
+	store.notify(NOTIFY_EXPIRED, "expired", key)
+	store.dirty++
+	store.expired++
+	return true
+}
+
+// Runs in the background, periodically sampling keys with a timeout and deleting the
+// expired ones. If many of the sampled keys were expired, samples again right away.
+func (store *Store) sweepExpired() {
+	ticker := time.NewTicker(SWEEP_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.stop:
+			return
+		}
+		expired := store.sweepOnce()
+		for expired > SWEEP_THRESHOLD {
+			expired = store.sweepOnce()
+		}
+	}
+}
+
+func (store *Store) sweepOnce() int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// Map iteration order is random, which gives us a cheap sample of each database.
+	// Returns the most keys that expired in any one of them.
+	most := 0
+	for index := range store.dbs {
+		store.inDB(index, func() {
+			sampled, expired := 0, 0
+			for key := range store.expires {
+				if sampled == SWEEP_SAMPLES {
+					break
+				}
+				if store.expireIfNeeded(key) {
+					expired++
+				}
+				sampled++
+			}
+			if expired > most {
+				most = expired
+			}
+		})
+	}
+	store.account()
+	return most
+}
+
+// Sets an absolute timeout on a key, deleting it right away if the timeout has passed.
+func (store *Store) setDeadline(key string, deadline time.Time) reply.Reply {
+	if !store.exists(key) {
+		return reply.Integer(0)
+	}
+	store.touch(key)
+	if !deadline.After(time.Now()) {
+		store.removeKey(key)
+		store.rewrite(utils.JoinArgs("DEL", key))
+		store.notify(NOTIFY_GENERIC, "del", key)
+	} else {
+		store.expires[key] = deadline
+		store.rewrite(utils.JoinArgs("PEXPIREAT", key, formatMillis(deadline)))
+		store.notify(NOTIFY_GENERIC, "expire", key)
+	}
+	store.dirty++
+	return reply.Integer(1)
+}
+
+func expire(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"EXPIRE\", expected 2")
+	}
+	key := args[0]
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return reply.Error("invalid integer argument")
+	}
+	return store.setDeadline(key, time.Now().Add(time.Duration(seconds)*time.Second))
+}
+
+func pexpire(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"PEXPIRE\", expected 2")
+	}
+	key := args[0]
+	millis, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return reply.Error("invalid integer argument")
+	}
+	return store.setDeadline(key, time.Now().Add(time.Duration(millis)*time.Millisecond))
+}
+
+func expireat(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"EXPIREAT\", expected 2")
+	}
+	key := args[0]
+	timestamp, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return reply.Error("invalid integer argument")
+	}
+	return store.setDeadline(key, time.Unix(timestamp, 0))
+}
+
+func pexpireat(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"PEXPIREAT\", expected 2")
+	}
+	key := args[0]
+	timestamp, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return reply.Error("invalid integer argument")
+	}
+	return store.setDeadline(key, parseMillis(timestamp))
+}
+
+// Returns the remaining time to live of a key in the given unit, -1 if the key has no
+// timeout, or -2 if the key doesn't exist.
+func (store *Store) timeToLive(key string, unit time.Duration) reply.Reply {
+	if !store.exists(key) {
+		return reply.Integer(-2)
+	}
+	deadline, present := store.expires[key]
+	if !present {
+		return reply.Integer(-1)
+	}
+	// Round up, so that a key with time left never reports 0.
+	remaining := time.Until(deadline)
+	return reply.Integer(int64((remaining + unit - 1) / unit))
+}
+
+func ttl(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"TTL\", expected 1")
+	}
+	return store.timeToLive(args[0], time.Second)
+}
+
+func pttl(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"PTTL\", expected 1")
+	}
+	return store.timeToLive(args[0], time.Millisecond)
+}
+
+func persist(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"PERSIST\", expected 1")
+	}
+	key := args[0]
+	if _, present := store.expires[key]; !present {
+		return reply.Integer(0)
+	}
+	store.touch(key)
+	delete(store.expires, key)
+	store.notify(NOTIFY_GENERIC, "persist", key)
+	store.dirty++
+	return reply.Integer(1)
+}
+
+// Reads the expirations that went alongside a legacy text dump.
+func (store *Store) readExpires(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// The file follows the format: "milliseconds:key"
+		index := strings.IndexByte(line, ':')
+		if index == -1 {
+			fmt.Println("Invalid expiration record")
+			continue
+		}
+		millis, err := strconv.ParseInt(line[:index], 10, 64)
+		if err != nil {
+			fmt.Println("Invalid expiration record")
+			continue
+		}
+		key, deadline := line[index+1:], parseMillis(millis)
+		if !store.exists(key) {
+			continue
+		}
+		if deadline.Before(time.Now()) {
+			// Expired while we were down.
+			store.removeKey(key)
+			continue
+		}
+		store.expires[key] = deadline
+	}
+}
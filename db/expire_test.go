@@ -0,0 +1,78 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// Returns a primary store that keeps its files in a directory of the test's own.
+func newTestStore(t *testing.T) *Store {
+	store := NewStoreIn(t.TempDir())
+	t.Cleanup(store.Close)
+	store.SetPrimary(true)
+	return store
+}
+
+func TestLazyExpiryReplicatesOnlyTheDelete(t *testing.T) {
+	tests := []struct {
+		request string
+		diffs   []string
+	}{
+		{"GET a", []string{"DEL a"}},
+		{"EXISTS a", []string{"DEL a"}},
+		{"KEYS *", []string{"DEL a"}},
+		{"SCAN 0", []string{"DEL a"}},
+		{"RANDOMKEY", []string{"DEL a"}},
+		{"TTL a", []string{"DEL a"}},
+		{"SET a 2", []string{"DEL a", "SET a 2"}},
+		{"INCR a", []string{"DEL a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.request, func(t *testing.T) {
+			store := newTestStore(t)
+			store.Execute("SET a 1")
+			store.Execute("PEXPIRE a 1")
+			store.Diffs()
+			time.Sleep(5 * time.Millisecond)
+
+			store.Execute(test.request)
+			if diffs := store.Diffs(); !reflect.DeepEqual(diffs, test.diffs) {
+				t.Errorf("diffs = %q, want %q", diffs, test.diffs)
+			}
+		})
+	}
+}
+
+func TestLazyExpiryCoversEveryKey(t *testing.T) {
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"DEL a b", "(int) 1"},
+		{"UNLINK b a", "(int) 1"},
+		{"EXISTS a b", "(int) 1"},
+		{"SMOVE s b x", "(int) 1"},
+		{"SINTERSTORE d s b", "(int) 0"},
+		{"SUNION s b", "\"x\""},
+	}
+	for _, test := range tests {
+		t.Run(test.request, func(t *testing.T) {
+			store := newTestStore(t)
+			store.Execute("SET a 1")
+			store.Execute("SADD s x")
+			store.Execute("SET b 1")
+			store.Execute("PEXPIRE b 1")
+			time.Sleep(5 * time.Millisecond)
+
+			if result := reply.EncodeText(store.Execute(test.request)); result != test.want {
+				t.Errorf("%s = %q, want %q", test.request, result, test.want)
+			}
+			if store.exists("b") && test.request != "SMOVE s b x" {
+				t.Errorf("b was not expired")
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package db
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+const WRONGTYPE = "Operation against a key holding the wrong kind of value"
+
+// Every key holds one type of value. A command that works on one type names its keys in
+// its arguments from first to last, where -1 is the last argument and -2 the one before.
+type commandSpec struct {
+	keyType string
+	first   int
+	last    int
+}
+
+// Commands that replace whatever was there, like SET, aren't listed, and neither are the
+// other commands that only work on their first argument. Commands that work on several
+// keys of any type are listed without a type.
+var commandSpecs = map[string]commandSpec{
+	// Keyspace operations.
+	"del":      {"", 0, -1},
+	"unlink":   {"", 0, -1},
+	"exists":   {"", 0, -1},
+	"rename":   {"", 0, 1},
+	"renamenx": {"", 0, 1},
+	"copy":     {"", 0, 1},
+
+	// String operations.
+	"get":    {"string", 0, 0},
+	"incr":   {"string", 0, 0},
+	"incrby": {"string", 0, 0},
+	"decr":   {"string", 0, 0},
+
+	// List operations.
+	"lpush":  {"list", 0, 0},
+	"lpop":   {"list", 0, 0},
+	"rpush":  {"list", 0, 0},
+	"rpop":   {"list", 0, 0},
+	"llen":   {"list", 0, 0},
+	"lrange": {"list", 0, 0},
+	"lmove":  {"list", 0, 1},
+	"blpop":  {"list", 0, -2},
+	"brpop":  {"list", 0, -2},
+	"blmove": {"list", 0, 1},
+
+	// Hash operations.
+	"hset":    {"hash", 0, 0},
+	"hget":    {"hash", 0, 0},
+	"hlen":    {"hash", 0, 0},
+	"hkeys":   {"hash", 0, 0},
+	"hvals":   {"hash", 0, 0},
+	"hgetall": {"hash", 0, 0},
+	"hscan":   {"hash", 0, 0},
+
+	// Set operations. The destination of the *STORE commands is replaced.
+	"sadd":        {"set", 0, 0},
+	"srem":        {"set", 0, 0},
+	"sismember":   {"set", 0, 0},
+	"scard":       {"set", 0, 0},
+	"smembers":    {"set", 0, 0},
+	"spop":        {"set", 0, 0},
+	"srandmember": {"set", 0, 0},
+	"smove":       {"set", 0, 1},
+	"sinter":      {"set", 0, -1},
+	"sunion":      {"set", 0, -1},
+	"sdiff":       {"set", 0, -1},
+	"sinterstore": {"set", 1, -1},
+	"sunionstore": {"set", 1, -1},
+	"sdiffstore":  {"set", 1, -1},
+	"sscan":       {"set", 0, 0},
+
+	// Sorted set operations.
+	"zadd":             {"zset", 0, 0},
+	"zrem":             {"zset", 0, 0},
+	"zcard":            {"zset", 0, 0},
+	"zscore":           {"zset", 0, 0},
+	"zincrby":          {"zset", 0, 0},
+	"zrank":            {"zset", 0, 0},
+	"zrevrank":         {"zset", 0, 0},
+	"zrange":           {"zset", 0, 0},
+	"zrevrange":        {"zset", 0, 0},
+	"zrangebyscore":    {"zset", 0, 0},
+	"zrangebylex":      {"zset", 0, 0},
+	"zcount":           {"zset", 0, 0},
+	"zremrangebyscore": {"zset", 0, 0},
+	"zremrangebylex":   {"zset", 0, 0},
+	"zremrangebyrank":  {"zset", 0, 0},
+	"zscan":            {"zset", 0, 0},
+}
+
+// Returns the keys named in a command's arguments.
+func (spec commandSpec) keys(args []string) []string {
+	first, last := spec.first, spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	keys := make([]string, 0, 1)
+	for i := first; i <= last && i < len(args); i++ {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// Returns the keys a command works on: the ones in its spec, or else its first argument.
+func commandKeys(function string, args []string) []string {
+	if spec, ok := commandSpecs[function]; ok {
+		return spec.keys(args)
+	}
+	if len(args) > 0 {
+		return []string{args[0]}
+	}
+	return nil
+}
+
+// Returns false if any of the keys a command works on holds another type of value.
+func (store *Store) checkTypes(function string, args []string) bool {
+	spec, ok := commandSpecs[function]
+	if !ok || spec.keyType == "" {
+		return true
+	}
+	for _, key := range spec.keys(args) {
+		keyType := store.typeOf(key)
+		if keyType != "none" && keyType != spec.keyType {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the type of the value stored at a key, or "none" if there isn't one.
+func (store *Store) typeOf(key string) string {
+	if _, present := store.stringStore[key]; present {
+		return "string"
+	}
+	if _, present := store.listStore[key]; present {
+		return "list"
+	}
+	if _, present := store.hashStore[key]; present {
+		return "hash"
+	}
+	if _, present := store.setStore[key]; present {
+		return "set"
+	}
+	if _, present := store.zsetStore[key]; present {
+		return "zset"
+	}
+	return "none"
+}
+
+// Returns the keys that haven't expired, expiring the ones that have.
+func (store *Store) liveKeys() []string {
+	keys := store.keys()
+	live := keys[:0]
+	for _, key := range keys {
+		if !store.expireIfNeeded(key) {
+			live = append(live, key)
+		}
+	}
+	return live
+}
+
+// Deletes the given keys, of any type, and returns how many of them there were.
+func (store *Store) deleteKeys(args []string) reply.Reply {
+	deleted := 0
+	for _, key := range args {
+		if store.removeKey(key) {
+			store.notify(NOTIFY_GENERIC, "del", key)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		store.dirty++
+	}
+	return reply.Integer(int64(deleted))
+}
+
+func del(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"DEL\", expected at least 1")
+	}
+	return store.deleteKeys(args)
+}
+
+// There's nothing to free in the background, so UNLINK is the same as DEL.
+func unlink(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"UNLINK\", expected at least 1")
+	}
+	return store.deleteKeys(args)
+}
+
+func keys(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"KEYS\", expected 1")
+	}
+	matched := make([]string, 0)
+	for _, key := range store.liveKeys() {
+		if utils.MatchGlob(args[0], key) {
+			matched = append(matched, key)
+		}
+	}
+	return reply.Bulks(matched)
+}
+
+func exists(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"EXISTS\", expected at least 1")
+	}
+	// A key given more than once is counted each time.
+	count := 0
+	for _, key := range args {
+		if !store.expireIfNeeded(key) && store.exists(key) {
+			count++
+		}
+	}
+	return reply.Integer(int64(count))
+}
+
+func keyType(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"TYPE\", expected 1")
+	}
+	return reply.Status(store.typeOf(args[0]))
+}
+
+// Moves the value at a key, along with its timeout, to another key, replacing whatever
+// was there.
+func (store *Store) renameKey(source string, destination string) {
+	if source == destination {
+		return
+	}
+	store.removeKey(destination)
+	moveValue(store.database, destination, store.database, source)
+	store.removeKey(source)
+	store.notify(NOTIFY_GENERIC, "rename_from", source)
+	store.notify(NOTIFY_GENERIC, "rename_to", destination)
+	if _, present := store.listStore[destination]; present {
+		store.signalReady(destination)
+	}
+	store.dirty++
+}
+
+// Points the destination at the source's value and timeout, which may be in another
+// database. The source has to be removed right after, since they share the value.
+func moveValue(dst *database, dstKey string, src *database, key string) {
+	if val, present := src.stringStore[key]; present {
+		dst.stringStore[dstKey] = val
+	}
+	if l, present := src.listStore[key]; present {
+		dst.listStore[dstKey] = l
+	}
+	if hash, present := src.hashStore[key]; present {
+		dst.hashStore[dstKey] = hash
+	}
+	if set, present := src.setStore[key]; present {
+		dst.setStore[dstKey] = set
+	}
+	if zset, present := src.zsetStore[key]; present {
+		dst.zsetStore[dstKey] = zset
+	}
+	if deadline, present := src.expires[key]; present {
+		dst.expires[dstKey] = deadline
+	}
+}
+
+func rename(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"RENAME\", expected 2")
+	}
+	source, destination := args[0], args[1]
+	if !store.exists(source) {
+		return reply.Error("no such key")
+	}
+	store.renameKey(source, destination)
+	return reply.OK
+}
+
+func renamenx(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"RENAMENX\", expected 2")
+	}
+	source, destination := args[0], args[1]
+	if !store.exists(source) {
+		return reply.Error("no such key")
+	}
+	store.expireIfNeeded(destination)
+	if store.exists(destination) {
+		return reply.Integer(0)
+	}
+	store.renameKey(source, destination)
+	return reply.Integer(1)
+}
+
+func copyCommand(args []string, store *Store) reply.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"COPY\", expected 2 or 3")
+	}
+	replace := len(args) == 3
+	if replace && strings.ToUpper(args[2]) != "REPLACE" {
+		return reply.Error("syntax error, expected REPLACE")
+	}
+	source, destination := args[0], args[1]
+	store.expireIfNeeded(destination)
+	if source == destination || !store.exists(source) {
+		return reply.Integer(0)
+	}
+	if store.exists(destination) && !replace {
+		return reply.Integer(0)
+	}
+	store.removeKey(destination)
+	copyKeyAs(store.database, destination, store.database, source)
+	store.notify(NOTIFY_GENERIC, "copy_to", destination)
+	if _, present := store.listStore[destination]; present {
+		store.signalReady(destination)
+	}
+	store.dirty++
+	return reply.Integer(1)
+}
+
+func dbsize(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"DBSIZE\", expected 0")
+	}
+	return reply.Integer(int64(len(store.keys())))
+}
+
+func randomkey(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"RANDOMKEY\", expected 0")
+	}
+	keys := store.liveKeys()
+	if len(keys) == 0 {
+		return reply.Null()
+	}
+	return reply.Bulk(keys[rand.Intn(len(keys))])
+}
+
+func flushdb(args []string, store *Store) reply.Reply {
+	if len(args) > 1 || len(args) == 1 && strings.ToUpper(args[0]) != "ASYNC" &&
+		strings.ToUpper(args[0]) != "SYNC" {
+		return reply.Error("wrong number of arguments for \"FLUSHDB\", expected 0 or ASYNC")
+	}
+	for _, key := range store.keys() {
+		store.removeKey(key)
+	}
+	store.dirty++
+	return reply.OK
+}
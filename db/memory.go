@@ -0,0 +1,350 @@
+package db
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Memory constants. Sizes are estimates of what the maps hold for each key, not what the
+// Go runtime has allocated.
+const (
+	KEY_OVERHEAD    = 48
+	ENTRY_OVERHEAD  = 32
+	EXPIRE_OVERHEAD = 32
+
+	// Number of elements a collection's size is estimated from, and number of keys in
+	// each database that eviction picks from.
+	MEMORY_SAMPLES   = 5
+	EVICTION_SAMPLES = 5
+
+	// Access frequencies for LFU grow logarithmically from a new key's, and go down by one
+	// for each minute a key isn't accessed.
+	LFU_INIT_VAL   = 5
+	LFU_LOG_FACTOR = 10
+	LFU_DECAY_TIME = time.Minute
+
+	// Policies for which keys to evict once the store uses more than maxmemory.
+	MAXMEMORY_NOEVICTION     = "noeviction"
+	MAXMEMORY_ALLKEYS_LRU    = "allkeys-lru"
+	MAXMEMORY_ALLKEYS_LFU    = "allkeys-lfu"
+	MAXMEMORY_ALLKEYS_RANDOM = "allkeys-random"
+	MAXMEMORY_VOLATILE_LRU   = "volatile-lru"
+	MAXMEMORY_VOLATILE_TTL   = "volatile-ttl"
+
+	OOM_ERROR = "command not allowed when used memory > 'maxmemory'"
+)
+
+// Commands that may need more memory, which evict keys first, or fail under noeviction.
+var growingCommands = map[string]bool{
+	"set":         true,
+	"incr":        true,
+	"incrby":      true,
+	"decr":        true,
+	"copy":        true,
+	"lpush":       true,
+	"rpush":       true,
+	"lmove":       true,
+	"blmove":      true,
+	"hset":        true,
+	"sadd":        true,
+	"smove":       true,
+	"sinterstore": true,
+	"sunionstore": true,
+	"sdiffstore":  true,
+	"zadd":        true,
+	"zincrby":     true,
+}
+
+// When a key was last accessed, and roughly how often.
+type keyAccess struct {
+	last      time.Time
+	frequency uint8
+}
+
+// Sets the most memory the store may use, in bytes, or with a unit like "100mb" or "1gb".
+// 0 means no limit.
+func (store *Store) SetMaxMemory(config string) error {
+	bytes, err := parseMemory(config)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.maxMemory = bytes
+	return nil
+}
+
+// Sets which keys are evicted once the store uses more than maxmemory.
+func (store *Store) SetMaxMemoryPolicy(policy string) error {
+	switch policy {
+	case MAXMEMORY_NOEVICTION, MAXMEMORY_ALLKEYS_LRU, MAXMEMORY_ALLKEYS_LFU,
+		MAXMEMORY_ALLKEYS_RANDOM, MAXMEMORY_VOLATILE_LRU, MAXMEMORY_VOLATILE_TTL:
+	default:
+		return errors.New("unknown maxmemory policy: " + policy)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.maxMemoryPolicy = policy
+	return nil
+}
+
+// Parses a number of bytes, where k, m and g are powers of 1000, and kb, mb and gb are
+// powers of 1024.
+func parseMemory(config string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1e3}, {"m", 1e6}, {"g", 1e9},
+		{"b", 1}}
+	number, scale := strings.ToLower(config), int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, scale = strings.TrimSuffix(number, unit.suffix), unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid memory size: " + config)
+	}
+	return n * scale, nil
+}
+
+// Returns the average size of up to MEMORY_SAMPLES of a collection's elements, given
+// a function that calls fn with each element until it returns false.
+func sampleSize(each func(fn func(size int) bool)) int64 {
+	total, sampled := 0, 0
+	each(func(size int) bool {
+		total += ENTRY_OVERHEAD + size
+		sampled++
+		return sampled < MEMORY_SAMPLES
+	})
+	if sampled == 0 {
+		return 0
+	}
+	return int64(total / sampled)
+}
+
+// Estimates the memory used by a key, or returns 0 if it isn't there. Big collections
+// are estimated from a few of their elements.
+func (d *database) sizeOf(key string) int64 {
+	var size int64
+	if val, present := d.stringStore[key]; present {
+		size = int64(len(val))
+	} else if l, present := d.listStore[key]; present {
+		size = int64(l.Len()) * sampleSize(func(fn func(size int) bool) {
+			for e := l.Front(); e != nil && fn(len(e.Value.(string))); e = e.Next() {
+			}
+		})
+	} else if hash, present := d.hashStore[key]; present {
+		size = int64(len(hash)) * sampleSize(func(fn func(size int) bool) {
+			for field, val := range hash {
+				if !fn(len(field) + len(val)) {
+					return
+				}
+			}
+		})
+	} else if set, present := d.setStore[key]; present {
+		size = int64(len(set)) * sampleSize(func(fn func(size int) bool) {
+			for member := range set {
+				if !fn(len(member)) {
+					return
+				}
+			}
+		})
+	} else if zset, present := d.zsetStore[key]; present {
+		// Each member is in both the dict and the skiplist.
+		size = int64(len(zset.dict)) * sampleSize(func(fn func(size int) bool) {
+			for member := range zset.dict {
+				if !fn(ENTRY_OVERHEAD + 2*len(member) + 8) {
+					return
+				}
+			}
+		})
+	} else {
+		return 0
+	}
+	size += KEY_OVERHEAD + int64(len(key))
+	if _, present := d.expires[key]; present {
+		size += EXPIRE_OVERHEAD
+	}
+	return size
+}
+
+// Brings the memory used up to date with the keys touched since the last call, and
+// forgets about the ones that are gone.
+func (store *Store) account() {
+	for key := range store.touched {
+		d := store.dbs[key.db]
+		size := d.sizeOf(key.key)
+		store.used += size - d.sizes[key.key]
+		if size == 0 {
+			delete(d.sizes, key.key)
+			delete(d.access, key.key)
+		} else {
+			d.sizes[key.key] = size
+		}
+		delete(store.touched, key)
+	}
+}
+
+// Estimates the memory used by every key from scratch, as after loading a snapshot.
+func (store *Store) recount() {
+	store.used = 0
+	store.touched = make(map[dbKey]bool)
+	for _, d := range store.dbs {
+		d.sizes = make(map[string]int64)
+		for _, key := range d.keys() {
+			d.sizes[key] = d.sizeOf(key)
+			store.used += d.sizes[key]
+		}
+	}
+}
+
+// Records an access to each of the keys in the selected database, for LRU and LFU.
+func (store *Store) accessed(keys []string) {
+	now := time.Now()
+	for _, key := range keys {
+		if _, present := store.sizes[key]; !present {
+			continue
+		}
+		access, seen := store.access[key]
+		if !seen {
+			access.frequency = LFU_INIT_VAL
+		}
+		access.frequency = lfuIncrement(lfuDecay(access, now))
+		access.last = now
+		store.access[key] = access
+	}
+}
+
+// Returns the access frequency of a key, less one for each minute since it was accessed.
+func lfuDecay(access keyAccess, now time.Time) uint8 {
+	if access.last.IsZero() {
+		return access.frequency
+	}
+	periods := int64(now.Sub(access.last) / LFU_DECAY_TIME)
+	if periods >= int64(access.frequency) {
+		return 0
+	}
+	return access.frequency - uint8(periods)
+}
+
+// Increments an access frequency with a probability that goes down as it grows, so the
+// counter can stand for millions of accesses.
+func lfuIncrement(frequency uint8) uint8 {
+	if frequency == 255 {
+		return frequency
+	}
+	base := float64(frequency) - LFU_INIT_VAL
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*LFU_LOG_FACTOR+1) {
+		frequency++
+	}
+	return frequency
+}
+
+// Picks a key to evict under the current policy, out of a sample from each database,
+// and returns its database and name. Returns false if there's nothing to evict.
+func (store *Store) evictionCandidate() (int, string, bool) {
+	now := time.Now()
+	volatile := strings.HasPrefix(store.maxMemoryPolicy, "volatile-")
+	bestDB, bestKey, bestScore, found := 0, "", int64(0), false
+	for index, d := range store.dbs {
+		consider := func(key string) {
+			var score int64
+			switch store.maxMemoryPolicy {
+			case MAXMEMORY_ALLKEYS_LRU, MAXMEMORY_VOLATILE_LRU:
+				score = d.access[key].last.UnixNano()
+			case MAXMEMORY_ALLKEYS_LFU:
+				score = int64(lfuDecay(d.access[key], now))
+			case MAXMEMORY_VOLATILE_TTL:
+				score = d.expires[key].UnixNano()
+			default:
+				score = rand.Int63()
+			}
+			// The lowest score goes first.
+			if !found || score < bestScore {
+				bestDB, bestKey, bestScore, found = index, key, score, true
+			}
+		}
+
+		// Map iteration order is random, which gives us a cheap sample.
+		sampled := 0
+		if volatile {
+			for key := range d.expires {
+				if sampled == EVICTION_SAMPLES {
+					break
+				}
+				consider(key)
+				sampled++
+			}
+		} else {
+			for key := range d.sizes {
+				if sampled == EVICTION_SAMPLES {
+					break
+				}
+				consider(key)
+				sampled++
+			}
+		}
+	}
+	return bestDB, bestKey, found
+}
+
+// Evicts keys until the store fits in maxmemory, telling the backup to do the same.
+// Returns false if the store doesn't fit, and nothing more can be evicted.
+func (store *Store) freeMemory() bool {
+	store.account()
+	for store.maxMemory > 0 && store.used > store.maxMemory {
+		if store.maxMemoryPolicy == MAXMEMORY_NOEVICTION {
+			return false
+		}
+		index, key, found := store.evictionCandidate()
+		if !found {
+			return false
+		}
+		store.inDB(index, func() {
+			store.removeKey(key)
+			store.propagate(utils.JoinArgs("DEL", key))
+			store.notify(NOTIFY_EVICTED, "evicted", key)
+		})
+		store.account()
+		store.evicted++
+		store.dirty++
+	}
+	return true
+}
+
+// Returns "used_memory:N, maxmemory:N, maxmemory_policy:policy, evicted_keys:N".
+func info(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"INFO\", expected 0")
+	}
+	store.account()
+	return reply.Bulk("used_memory:" + strconv.FormatInt(store.used, 10) +
+		", maxmemory:" + strconv.FormatInt(store.maxMemory, 10) +
+		", maxmemory_policy:" + store.maxMemoryPolicy +
+		", evicted_keys:" + strconv.FormatUint(store.evicted, 10))
+}
+
+// Handles MEMORY USAGE key, which returns the estimated size of a key in bytes.
+func memory(args []string, store *Store) reply.Reply {
+	if len(args) != 2 || strings.ToUpper(args[0]) != "USAGE" {
+		return reply.Error("wrong number of arguments for \"MEMORY\", expected USAGE key")
+	}
+	key := args[1]
+	if store.expireIfNeeded(key) || !store.exists(key) {
+		return reply.Null()
+	}
+	store.account()
+	return reply.Integer(store.sizes[key])
+}
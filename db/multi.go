@@ -0,0 +1,98 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// A transaction is sent as a single request: EXEC, followed by each of the requests in
+// the transaction, separated by BATCH_SEPARATOR.
+const BATCH_SEPARATOR = "\x1e"
+
+// Returns the request that executes all of the given requests as one transaction.
+func Batch(requests []string) string {
+	return strings.Join(append([]string{"EXEC"}, requests...), BATCH_SEPARATOR)
+}
+
+// A key that a session watches, in one of the databases, and its version when it was
+// watched.
+type WatchedKey struct {
+	DB      int
+	Key     string
+	Version uint64
+}
+
+// Returns the request that executes the given requests as one transaction, but only if
+// none of the watched keys has changed from the version it had when it was watched.
+func WatchedBatch(requests []string, watched []WatchedKey) string {
+	header := "EXEC"
+	for _, w := range watched {
+		header += " " + strconv.Itoa(w.DB) + " " + utils.QuoteArg(w.Key) + " " +
+			strconv.FormatUint(w.Version, 10)
+	}
+	return strings.Join(append([]string{header}, requests...), BATCH_SEPARATOR)
+}
+
+func isBatch(request string) bool {
+	header := strings.SplitN(request, BATCH_SEPARATOR, 2)[0]
+	return header == "EXEC" || strings.HasPrefix(header, "EXEC ")
+}
+
+// Splits a transaction into the watched databases, keys and versions, and the requests to
+// execute.
+func splitBatch(request string) ([]string, []string, error) {
+	arr := strings.Split(request, BATCH_SEPARATOR)
+	header, err := utils.SplitArgs(arr[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return header[1:], arr[1:], nil
+}
+
+// Runs every request in a transaction without letting any other request in between, and
+// returns their replies. The writes are logged and replicated as a single transaction,
+// so that the backup and the log never see only part of one. Must be called with the
+// store locked.
+func (store *Store) executeBatch(watched []string, requests []string) reply.Reply {
+	if !store.checkVersions(watched) {
+		// One of the watched keys changed, so the transaction doesn't run at all.
+		return reply.NullArray()
+	}
+	if len(requests) == 0 {
+		return reply.Array()
+	}
+
+	// Refuse the whole transaction if any request can never succeed.
+	for _, request := range requests {
+		args, err := utils.SplitArgs(request)
+		if err != nil || len(args) == 0 || funcmap[strings.ToLower(args[0])] == nil {
+			return reply.CodedError("EXECABORT", "Transaction discarded because of previous errors")
+		}
+	}
+
+	store.batching = true
+	store.batch = nil
+	store.batchDB = store.db
+	replies := make([]reply.Reply, len(requests))
+	for i, request := range requests {
+		replies[i] = store.execute(request)
+	}
+	store.batching = false
+
+	// A write to another database, like the expiration of MOVE's target, is selected
+	// in the transaction, so select the transaction's own database again at the end.
+	if store.batchDB != store.db {
+		store.batch = append(store.batch, selectRequest(store.db))
+	}
+
+	if len(store.batch) == 1 {
+		store.propagate(store.batch[0])
+	} else if len(store.batch) > 1 {
+		store.propagate(Batch(store.batch))
+	}
+	store.batch = nil
+	return reply.Array(replies...)
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Classes of keyspace events, which are turned on by the letters in the config passed to
+// SetNotifyKeyspaceEvents.
+const (
+	NOTIFY_KEYSPACE = 1 << iota // K: publish to __keyspace@<db>__:<key>
+	NOTIFY_KEYEVENT             // E: publish to __keyevent@<db>__:<event>
+	NOTIFY_GENERIC              // g: del, expire, persist
+	NOTIFY_STRING               // $: string commands
+	NOTIFY_LIST                 // l: list commands
+	NOTIFY_SET                  // s: set commands
+	NOTIFY_HASH                 // h: hash commands
+	NOTIFY_ZSET                 // z: sorted set commands
+	NOTIFY_EXPIRED              // x: keys deleted when their timeout passed
+	NOTIFY_EVICTED              // e: keys evicted to stay under maxmemory
+
+	// A: every class of event.
+	NOTIFY_ALL = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED
+)
+
+var notifyClasses = map[rune]int{
+	'K': NOTIFY_KEYSPACE,
+	'E': NOTIFY_KEYEVENT,
+	'g': NOTIFY_GENERIC,
+	'$': NOTIFY_STRING,
+	'l': NOTIFY_LIST,
+	's': NOTIFY_SET,
+	'h': NOTIFY_HASH,
+	'z': NOTIFY_ZSET,
+	'x': NOTIFY_EXPIRED,
+	'e': NOTIFY_EVICTED,
+	'A': NOTIFY_ALL,
+}
+
+// A message to publish about a change to a key.
+type Notification struct {
+	Channel string
+	Message string
+}
+
+// Sets which keyspace events get published, e.g. "Kx" for expirations on the key's own
+// channel, or "KEA" for everything. At least one of K or E is needed, along with the
+// classes of events. An empty string turns notifications off.
+func (store *Store) SetNotifyKeyspaceEvents(config string) error {
+	flags := 0
+	for _, c := range config {
+		class, ok := notifyClasses[c]
+		if !ok {
+			return errors.New("unknown keyspace event class: " + string(c))
+		}
+		flags |= class
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.notifyFlags = flags
+	return nil
+}
+
+// Records an event on a key, if its class is turned on. Only the primary publishes events,
+// and not for writes replayed from the log.
+func (store *Store) notify(class int, event string, key string) {
+	if store.notifyFlags&class == 0 || !store.primary || store.loading {
+		return
+	}
+	index := strconv.Itoa(store.db)
+	if store.notifyFlags&NOTIFY_KEYSPACE != 0 {
+		store.notifications = append(store.notifications,
+			Notification{Channel: "__keyspace@" + index + "__:" + key, Message: event})
+	}
+	if store.notifyFlags&NOTIFY_KEYEVENT != 0 {
+		store.notifications = append(store.notifications,
+			Notification{Channel: "__keyevent@" + index + "__:" + event, Message: key})
+	}
+}
+
+// Returns and clears the events recorded since the last call, in the order they happened.
+func (store *Store) Notifications() []Notification {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	notifications := store.notifications
+	store.notifications = nil
+	return notifications
+}
+
+// Returns the event for an end of a list, like "lpush" or "rpop".
+func listEvent(left bool, op string) string {
+	if left {
+		return "l" + op
+	}
+	return "r" + op
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// Snapshot constants.
+const (
+	DUMP_FILENAME      = "dump"
+	DUMP_TEMP_FILENAME = "dump.tmp"
+	SAVE_CHECK_PERIOD  = time.Second
+
+	// Save after 1 change in an hour, 100 changes in 5 minutes, or 10000 in a minute.
+	DEFAULT_SAVE_RULES = "3600 1 300 100 60 10000"
+)
+
+// Save the store in the background once it has seen at least changes writes, and at
+// least seconds have passed since the last save.
+type saveRule struct {
+	seconds time.Duration
+	changes uint64
+}
+
+// Sets when the store saves itself in the background, as pairs of "seconds changes",
+// e.g. "900 1 60 100". An empty string turns automatic saves off.
+func (store *Store) SetSaveRules(config string) error {
+	fields := strings.Fields(config)
+	if len(fields)%2 != 0 {
+		return errors.New("save rules must be pairs of seconds and changes")
+	}
+	rules := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseUint(fields[i], 10, 32)
+		if err != nil {
+			return errors.New("invalid number of seconds in save rule: " + fields[i])
+		}
+		changes, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return errors.New("invalid number of changes in save rule: " + fields[i+1])
+		}
+		rules = append(rules, saveRule{seconds: time.Duration(seconds) * time.Second, changes: changes})
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.saveRules = rules
+	return nil
+}
+
+// Checks the save rules every so often, and starts a background save if one matches.
+func (store *Store) saveOnRules() {
+	ticker := time.NewTicker(SAVE_CHECK_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.stop:
+			return
+		}
+		store.lock.Lock()
+		if !store.saving {
+			changes, elapsed := store.dirty-store.dirtyAtSave, time.Since(store.lastSave)
+			for _, rule := range store.saveRules {
+				if changes >= rule.changes && elapsed >= rule.seconds {
+					fmt.Println(changes, "changes in", elapsed, "- saving")
+					store.startBackgroundSave()
+					break
+				}
+			}
+		}
+		store.lock.Unlock()
+	}
+}
+
+// Marks the point in the log that a new snapshot will cover up to, and returns the
+// snapshot's id. The marker is synced before the snapshot can replace the old one, so
+// that the writes after it can always be told apart on replay.
+func (store *Store) markSnapshot() uint64 {
+	id := uint64(time.Now().UnixNano())
+	store.appendLog(AOF_SNAPSHOT_MARKER + strconv.FormatUint(id, 10))
+	store.loggedDB = 0
+	if store.aof != nil {
+		if err := store.aof.Sync(); err != nil {
+			log.Fatal("Unable to sync log: ", err)
+		}
+	}
+	return id
+}
+
+// Records a finished snapshot, which was taken when the store had seen dirty changes.
+func (store *Store) finishSave(id uint64, dirty uint64) {
+	store.snapshotID = id
+	store.lastSave = time.Now()
+	store.dirtyAtSave = dirty
+}
+
+// Saves the store in the foreground. Must be called with the store locked.
+func (store *Store) save() error {
+	id := store.markSnapshot()
+	if err := store.writeDump(id, store.each); err != nil {
+		return err
+	}
+	store.finishSave(id, store.dirty)
+
+	// Everything in the log is in the dump now.
+	store.truncateLog()
+	return nil
+}
+
+// Saves a view of the store in the background. Must be called with the store locked.
+func (store *Store) startBackgroundSave() {
+	store.saving = true
+	store.saveDone = make(chan struct{})
+	id := store.markSnapshot()
+	v := store.openView()
+	dirty := store.dirty
+	go func() {
+		err := store.writeDump(id, func(fn func(index int, key string, src *database), done func()) {
+			v.each(store, fn, done)
+		})
+
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		store.closeView(v)
+		store.saving = false
+		close(store.saveDone)
+		if err != nil {
+			fmt.Println("Background save failed:", err)
+			os.Remove(store.path(DUMP_TEMP_FILENAME))
+			return
+		}
+		store.finishSave(id, dirty)
+		fmt.Println("Background save finished")
+	}()
+}
+
+// Waits for a background save to finish. It writes to the same temporary file as a save
+// in the foreground, and would rename its older snapshot over the new one afterwards.
+// Must be called with the store locked, which it lets go of while it waits.
+func (store *Store) waitForSave() {
+	for store.saving {
+		done := store.saveDone
+		store.lock.Unlock()
+		<-done
+		store.lock.Lock()
+	}
+}
+
+// Writes a snapshot to a temporary file, and renames it over the dump once it's on disk,
+// so that a crash never leaves a partially written dump behind.
+func (store *Store) writeDump(id uint64, each keyIterator) error {
+	file, err := os.Create(store.path(DUMP_TEMP_FILENAME))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := writeSnapshot(file, id, each); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(store.path(DUMP_TEMP_FILENAME), store.path(DUMP_FILENAME))
+}
+
+func save(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"SAVE\", expected 0")
+	}
+	if store.saving {
+		return reply.Error("Background save already in progress")
+	}
+	if err := store.save(); err != nil {
+		return reply.Error("unable to save: " + err.Error())
+	}
+	return reply.OK
+}
+
+func bgsave(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"BGSAVE\", expected 0")
+	}
+	if store.saving {
+		return reply.Error("Background save already in progress")
+	}
+	store.startBackgroundSave()
+	return reply.Status("Background saving started")
+}
+
+func lastsave(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"LASTSAVE\", expected 0")
+	}
+	return reply.Integer(store.lastSave.Unix())
+}
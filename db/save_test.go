@@ -0,0 +1,34 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFlushDuringBackgroundSave(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStoreIn(dir)
+	store.SetPrimary(true)
+
+	// Enough data that the background save is still going when Flush starts.
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 100000; i++ {
+		store.Execute("SET k" + strconv.Itoa(i) + " " + value)
+	}
+	if result := store.Execute("BGSAVE"); result.IsError() {
+		t.Fatal(result)
+	}
+	store.Execute("SET last " + value)
+	store.Flush()
+	store.Close()
+
+	// The dump holds every write, and the log is empty, since it's all in the dump.
+	store = NewStoreIn(dir)
+	defer store.Close()
+	for _, key := range []string{"k0", "k99999", "last"} {
+		if result := store.Execute("GET " + key).Str; result != value {
+			t.Errorf("GET %s = %s after a restart", key, result)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Number of names SCAN looks at when no COUNT is given.
+const SCAN_DEFAULT_COUNT = 10
+
+// Cursors are positions in the order of each name's hash, which stays the same however a
+// map grows or shrinks. A name present for the whole iteration can't be skipped over.
+func scanHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// Most indexes a database keeps for the iterations going on in it. Past that, one is
+// dropped, and built again if its iteration goes on.
+const SCAN_INDEXES = 16
+
+// The names of a map sorted by their hashes, as of when an iteration started. Each call
+// finds its place with a binary search instead of walking the whole map, so a full
+// iteration takes O(N log N) rather than O(N) per call. Names added after the index was
+// built may not be returned, which is allowed, and names deleted since are skipped by the
+// caller.
+type scanIndex struct {
+	hashes []uint64
+	names  []string
+}
+
+// What an index is of: the keyspace, which has an empty command, or the hash, set or
+// sorted set at a key.
+type scanTarget struct {
+	command string
+	key     string
+}
+
+func (index *scanIndex) Len() int { return len(index.hashes) }
+func (index *scanIndex) Less(i, j int) bool {
+	if index.hashes[i] != index.hashes[j] {
+		return index.hashes[i] < index.hashes[j]
+	}
+	return index.names[i] < index.names[j]
+}
+func (index *scanIndex) Swap(i, j int) {
+	index.hashes[i], index.hashes[j] = index.hashes[j], index.hashes[i]
+	index.names[i], index.names[j] = index.names[j], index.names[i]
+}
+
+// Sorts the names that each calls fn with by their hashes. A name passed more than once is
+// only kept once.
+func newScanIndex(each func(fn func(name string))) *scanIndex {
+	index := &scanIndex{}
+	each(func(name string) {
+		index.hashes = append(index.hashes, scanHash(name))
+		index.names = append(index.names, name)
+	})
+	sort.Sort(index)
+	kept := 0
+	for i := range index.names {
+		if i > 0 && index.names[i] == index.names[kept-1] {
+			continue
+		}
+		index.hashes[kept], index.names[kept] = index.hashes[i], index.names[i]
+		kept++
+	}
+	index.hashes, index.names = index.hashes[:kept], index.names[:kept]
+	return index
+}
+
+// Returns the index to continue an iteration from. An iteration starts with a new one, so
+// that every name there from then on is in it, and later calls use the newest one there
+// is, which was built after their iteration started.
+func (store *Store) scanIndex(target scanTarget, cursor uint64, each func(fn func(name string))) *scanIndex {
+	if index, present := store.scans[target]; present && cursor != 0 {
+		return index
+	}
+	if _, present := store.scans[target]; !present && len(store.scans) >= SCAN_INDEXES {
+		for other := range store.scans {
+			delete(store.scans, other)
+			break
+		}
+	}
+	index := newScanIndex(each)
+	store.scans[target] = index
+	return index
+}
+
+// Returns the count names with the smallest hashes at or after the cursor, along with any
+// other names that share the last of those hashes, and the cursor to continue from, which
+// is 0 once there are no names left.
+func (index *scanIndex) scan(cursor uint64, count int) ([]string, uint64) {
+	start := sort.Search(len(index.hashes), func(i int) bool { return index.hashes[i] >= cursor })
+	end := start + count
+	if end >= len(index.hashes) {
+		return index.names[start:], 0
+	}
+	last := index.hashes[end-1]
+	for end < len(index.hashes) && index.hashes[end] == last {
+		end++
+	}
+	if end == len(index.hashes) || last == math.MaxUint64 {
+		return index.names[start:end], 0
+	}
+	return index.names[start:end], last + 1
+}
+
+// Options of the SCAN family of commands.
+type scanOptions struct {
+	cursor   uint64
+	match    string
+	count    int
+	keyType  string
+	hasMatch bool
+}
+
+// Parses "cursor [MATCH pattern] [COUNT count] [TYPE type]". TYPE is only allowed for SCAN.
+func parseScanOptions(args []string, allowType bool) (scanOptions, string) {
+	options := scanOptions{count: SCAN_DEFAULT_COUNT}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return options, "invalid cursor"
+	}
+	options.cursor = cursor
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return options, "syntax error"
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			options.match, options.hasMatch = args[i+1], true
+		case "COUNT":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return options, "count must be a positive integer"
+			}
+			options.count = count
+		case "TYPE":
+			if !allowType {
+				return options, "syntax error"
+			}
+			options.keyType = strings.ToLower(args[i+1])
+		default:
+			return options, "syntax error"
+		}
+	}
+	return options, ""
+}
+
+func (options scanOptions) matches(name string) bool {
+	return !options.hasMatch || utils.MatchGlob(options.match, name)
+}
+
+// Returns the cursor to continue from, followed by the names or pairs that were found.
+func formatScan(cursor uint64, items []string) reply.Reply {
+	return reply.Array(reply.Bulk(strconv.FormatUint(cursor, 10)), reply.Bulks(items))
+}
+
+// Calls fn with the name of every key in the store. A name in more than one of the maps
+// is passed more than once.
+func (store *Store) eachName(fn func(name string)) {
+	for key := range store.stringStore {
+		fn(key)
+	}
+	for key := range store.listStore {
+		fn(key)
+	}
+	for key := range store.hashStore {
+		fn(key)
+	}
+	for key := range store.setStore {
+		fn(key)
+	}
+	for key := range store.zsetStore {
+		fn(key)
+	}
+}
+
+func scan(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"SCAN\", expected at least 1")
+	}
+	options, errMessage := parseScanOptions(args, true)
+	if errMessage != "" {
+		return reply.Error(errMessage)
+	}
+	index := store.scanIndex(scanTarget{}, options.cursor, store.eachName)
+	names, cursor := index.scan(options.cursor, options.count)
+
+	// Filters only apply to the names that were found, so a batch may come back empty
+	// before the iteration is over.
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		if store.expireIfNeeded(name) || !store.exists(name) || !options.matches(name) {
+			continue
+		}
+		if options.keyType != "" && store.typeOf(name) != options.keyType {
+			continue
+		}
+		keys = append(keys, name)
+	}
+	return formatScan(cursor, keys)
+}
+
+func hscan(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"HSCAN\", expected at least 2")
+	}
+	options, errMessage := parseScanOptions(args[1:], false)
+	if errMessage != "" {
+		return reply.Error(errMessage)
+	}
+	hash := store.hashStore[args[0]]
+	index := store.scanIndex(scanTarget{"hscan", args[0]}, options.cursor, func(fn func(name string)) {
+		for field := range hash {
+			fn(field)
+		}
+	})
+	fields, cursor := index.scan(options.cursor, options.count)
+
+	pairs := make([]string, 0, 2*len(fields))
+	for _, field := range fields {
+		if value, present := hash[field]; present && options.matches(field) {
+			pairs = append(pairs, field, value)
+		}
+	}
+	return formatScan(cursor, pairs)
+}
+
+func sscan(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"SSCAN\", expected at least 2")
+	}
+	options, errMessage := parseScanOptions(args[1:], false)
+	if errMessage != "" {
+		return reply.Error(errMessage)
+	}
+	set := store.setStore[args[0]]
+	index := store.scanIndex(scanTarget{"sscan", args[0]}, options.cursor, func(fn func(name string)) {
+		for member := range set {
+			fn(member)
+		}
+	})
+	members, cursor := index.scan(options.cursor, options.count)
+
+	matched := make([]string, 0, len(members))
+	for _, member := range members {
+		if set[member] && options.matches(member) {
+			matched = append(matched, member)
+		}
+	}
+	return formatScan(cursor, matched)
+}
+
+func zscan(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"ZSCAN\", expected at least 2")
+	}
+	options, errMessage := parseScanOptions(args[1:], false)
+	if errMessage != "" {
+		return reply.Error(errMessage)
+	}
+	var dict map[string]float64
+	if zset, present := store.zsetStore[args[0]]; present {
+		dict = zset.dict
+	}
+	index := store.scanIndex(scanTarget{"zscan", args[0]}, options.cursor, func(fn func(name string)) {
+		for member := range dict {
+			fn(member)
+		}
+	})
+	members, cursor := index.scan(options.cursor, options.count)
+
+	pairs := make([]string, 0, 2*len(members))
+	for _, member := range members {
+		if score, present := dict[member]; present && options.matches(member) {
+			pairs = append(pairs, member, formatScore(score))
+		}
+	}
+	return formatScan(cursor, pairs)
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestScanCoverage(t *testing.T) {
+	tests := []struct {
+		count   int
+		inserts int
+		deletes bool
+	}{
+		{1, 0, false},
+		{3, 0, false},
+		{3, 5, false},
+		{10, 5, true},
+		{10, 50, true},
+		{1000, 5, false},
+	}
+	for _, test := range tests {
+		store := newTestStore(t)
+		for i := 0; i < 50; i++ {
+			store.Execute("SET k" + strconv.Itoa(i) + " v")
+		}
+		for i := 0; i < 10; i++ {
+			store.Execute("SET gone" + strconv.Itoa(i) + " v")
+		}
+
+		// Keys that are there for the whole iteration are returned, whatever is added or
+		// deleted along the way.
+		seen := make(map[string]bool)
+		cursor, calls := "0", 0
+		for {
+			result := store.Execute("SCAN " + cursor + " COUNT " + strconv.Itoa(test.count))
+			if result.IsError() || len(result.Elements) != 2 {
+				t.Fatalf("SCAN %s = %v", cursor, result)
+			}
+			for _, key := range result.Elements[1].Elements {
+				seen[key.Str] = true
+			}
+			cursor = result.Elements[0].Str
+			if calls++; cursor == "0" {
+				break
+			}
+			if calls > 1000 {
+				t.Fatalf("count %d: SCAN never finished", test.count)
+			}
+			for i := 0; i < test.inserts; i++ {
+				store.Execute("SET new" + strconv.Itoa(calls) + "-" + strconv.Itoa(i) + " v")
+			}
+			if test.deletes && calls <= 10 {
+				store.Execute("DEL gone" + strconv.Itoa(calls-1))
+			}
+		}
+		for i := 0; i < 50; i++ {
+			if key := "k" + strconv.Itoa(i); !seen[key] {
+				t.Errorf("count %d, %d inserts: %s was never returned", test.count, test.inserts, key)
+			}
+		}
+		if test.count >= 60 && calls != 1 {
+			t.Errorf("count %d: took %d calls to scan 60 keys", test.count, calls)
+		}
+	}
+}
+
+func TestScanMembers(t *testing.T) {
+	tests := []struct {
+		command string
+		add     string
+		remove  string
+	}{
+		{"HSCAN", "HSET h %s v", "HDEL h %s"},
+		{"SSCAN", "SADD h %s", "SREM h %s"},
+		{"ZSCAN", "ZADD h 1 %s", "ZREM h %s"},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			store := newTestStore(t)
+			for i := 0; i < 50; i++ {
+				store.Execute(strings.Replace(test.add, "%s", "m"+strconv.Itoa(i), 1))
+			}
+
+			// Every member that's there throughout is returned, and none after it's gone.
+			seen := make(map[string]bool)
+			cursor, calls := "0", 0
+			for {
+				result := store.Execute(test.command + " h " + cursor + " COUNT 3")
+				if result.IsError() || len(result.Elements) != 2 {
+					t.Fatalf("%s %s = %v", test.command, cursor, result)
+				}
+				items := result.Elements[1].Elements
+				for i := 0; i < len(items); i++ {
+					if gone, _ := strconv.Atoi(items[i].Str[1:]); gone < calls && gone < 10 {
+						t.Errorf("%s was returned after it was removed", items[i].Str)
+					}
+					seen[items[i].Str] = true
+					if test.command != "SSCAN" {
+						i++
+					}
+				}
+				cursor = result.Elements[0].Str
+				if calls++; cursor == "0" {
+					break
+				}
+				if calls > 100 {
+					t.Fatalf("%s never finished", test.command)
+				}
+				if calls <= 10 {
+					store.Execute(strings.Replace(test.remove, "%s", "m"+strconv.Itoa(calls-1), 1))
+				}
+			}
+			for i := 10; i < 50; i++ {
+				if member := "m" + strconv.Itoa(i); !seen[member] {
+					t.Errorf("%s was never returned", member)
+				}
+			}
+		})
+	}
+}
+
+// Measures a whole iteration over a keyspace, which should grow with the number of keys
+// rather than with its square.
+//
+//	go test -run '^$' -bench Scan ./db/
+func BenchmarkScan(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run("N="+strconv.Itoa(size), func(b *testing.B) {
+			store := NewStoreIn(b.TempDir())
+			b.Cleanup(store.Close)
+			for i := 0; i < size; i++ {
+				store.Execute("SET k" + strconv.Itoa(i) + " v")
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cursor := "0"
+				for {
+					cursor = store.Execute("SCAN " + cursor).Elements[0].Str
+					if cursor == "0" {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Looks up a set, expiring it first if its timeout has passed.
+func (store *Store) getSet(name string) (map[string]bool, bool) {
+	store.expireIfNeeded(name)
+	set, present := store.setStore[name]
+	return set, present
+}
+
+func setMembers(set map[string]bool) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	return members
+}
+
+func sadd(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"SADD\", expected at least 2")
+	}
+	name := args[0]
+	set, present := store.setStore[name]
+	if !present {
+		set = make(map[string]bool)
+	}
+
+	// Count the members that weren't already in the set.
+	store.touch(name)
+	added := 0
+	for _, member := range args[1:] {
+		if !set[member] {
+			set[member] = true
+			added++
+		}
+	}
+	store.setStore[name] = set
+	if added > 0 {
+		store.notify(NOTIFY_SET, "sadd", name)
+		store.dirty++
+	}
+	return reply.Integer(int64(added))
+}
+
+func srem(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"SREM\", expected at least 2")
+	}
+	name := args[0]
+	set, present := store.setStore[name]
+	if !present {
+		return reply.Integer(0)
+	}
+
+	store.touch(name)
+	removed := 0
+	for _, member := range args[1:] {
+		if set[member] {
+			delete(set, member)
+			removed++
+		}
+	}
+	if removed > 0 {
+		store.notify(NOTIFY_SET, "srem", name)
+		store.dirty++
+	}
+	if len(set) == 0 {
+		// Empty sets don't take up a key.
+		store.removeKey(name)
+		store.notify(NOTIFY_GENERIC, "del", name)
+	}
+	return reply.Integer(int64(removed))
+}
+
+func sismember(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"SISMEMBER\", expected 2")
+	}
+	set := store.setStore[args[0]]
+	if set[args[1]] {
+		return reply.Integer(1)
+	}
+	return reply.Integer(0)
+}
+
+func scard(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"SCARD\", expected 1")
+	}
+	set := store.setStore[args[0]]
+	return reply.Integer(int64(len(set)))
+}
+
+func smembers(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"SMEMBERS\", expected 1")
+	}
+	set := store.setStore[args[0]]
+	return reply.Bulks(setMembers(set))
+}
+
+// Parses the optional count argument of SPOP and SRANDMEMBER.
+func parseCount(args []string) (int64, bool, error) {
+	if len(args) < 2 {
+		return 1, false, nil
+	}
+	count, err := strconv.ParseInt(args[1], 10, 64)
+	return count, true, err
+}
+
+func spop(args []string, store *Store) reply.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"SPOP\", expected 1 or 2")
+	}
+	name := args[0]
+	count, hasCount, err := parseCount(args)
+	if err != nil || count < 0 {
+		return reply.Error("count must not be negative")
+	}
+	set, present := store.setStore[name]
+	if !present {
+		if hasCount {
+			return reply.Array()
+		}
+		return reply.Null()
+	}
+
+	// Map iteration order is random, so the first members we see make a random pick.
+	popped := make([]string, 0, count)
+	for member := range set {
+		if int64(len(popped)) == count {
+			break
+		}
+		popped = append(popped, member)
+	}
+	store.touch(name)
+	for _, member := range popped {
+		delete(set, member)
+	}
+	if len(popped) > 0 {
+		store.notify(NOTIFY_SET, "spop", name)
+	}
+	if len(set) == 0 {
+		store.removeKey(name)
+		store.notify(NOTIFY_GENERIC, "del", name)
+	}
+
+	// The backup has to remove the same members we picked.
+	if len(popped) > 0 {
+		store.rewrite(utils.JoinArgs(append([]string{"SREM", args[0]}, popped...)...))
+		store.dirty++
+	}
+	if !hasCount {
+		return reply.Bulk(popped[0])
+	}
+	return reply.Bulks(popped)
+}
+
+func srandmember(args []string, store *Store) reply.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"SRANDMEMBER\", expected 1 or 2")
+	}
+	count, hasCount, err := parseCount(args)
+	if err != nil {
+		return reply.Error("invalid integer argument")
+	}
+	set, present := store.setStore[args[0]]
+	if !present {
+		if hasCount {
+			return reply.Array()
+		}
+		return reply.Null()
+	}
+	members := setMembers(set)
+
+	// A negative count may return the same member several times.
+	picked := make([]string, 0)
+	if count < 0 {
+		for i := int64(0); i < -count; i++ {
+			picked = append(picked, members[rand.Intn(len(members))])
+		}
+	} else {
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+		if count > int64(len(members)) {
+			count = int64(len(members))
+		}
+		picked = members[:count]
+	}
+	if !hasCount {
+		return reply.Bulk(picked[0])
+	}
+	return reply.Bulks(picked)
+}
+
+func smove(args []string, store *Store) reply.Reply {
+	if len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"SMOVE\", expected 3")
+	}
+	source := args[0]
+	destination := args[1]
+	member := args[2]
+
+	src, present := store.getSet(source)
+	if !present || !src[member] {
+		return reply.Integer(0)
+	}
+	store.touch(source)
+	store.touch(destination)
+	dst, present := store.getSet(destination)
+	if !present {
+		dst = make(map[string]bool)
+		store.setStore[destination] = dst
+	}
+	delete(src, member)
+	dst[member] = true
+	store.notify(NOTIFY_SET, "srem", source)
+	store.notify(NOTIFY_SET, "sadd", destination)
+	if len(src) == 0 {
+		store.removeKey(source)
+		store.notify(NOTIFY_GENERIC, "del", source)
+	}
+	store.dirty++
+	return reply.Integer(1)
+}
+
+// Computes the intersection, union or difference of the sets stored at the given keys.
+func (store *Store) combineSets(op string, args []string) map[string]bool {
+	result := make(map[string]bool)
+	for i, arg := range args {
+		set, _ := store.getSet(arg)
+		switch {
+		case i == 0 || op == "union":
+			for member := range set {
+				result[member] = true
+			}
+		case op == "inter":
+			for member := range result {
+				if !set[member] {
+					delete(result, member)
+				}
+			}
+		case op == "diff":
+			for member := range set {
+				delete(result, member)
+			}
+		}
+	}
+	return result
+}
+
+// Stores a computed set at the destination, replacing whatever was there.
+func (store *Store) storeSet(op string, destination string, set map[string]bool) reply.Reply {
+	existed := store.removeKey(destination)
+	if len(set) > 0 {
+		store.setStore[destination] = set
+		store.notify(NOTIFY_SET, "s"+op+"store", destination)
+	} else if existed {
+		store.notify(NOTIFY_GENERIC, "del", destination)
+	}
+	store.dirty++
+	return reply.Integer(int64(len(set)))
+}
+
+func sinter(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"SINTER\", expected at least 1")
+	}
+	return reply.Bulks(setMembers(store.combineSets("inter", args)))
+}
+
+func sunion(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"SUNION\", expected at least 1")
+	}
+	return reply.Bulks(setMembers(store.combineSets("union", args)))
+}
+
+func sdiff(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"SDIFF\", expected at least 1")
+	}
+	return reply.Bulks(setMembers(store.combineSets("diff", args)))
+}
+
+func sinterstore(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"SINTERSTORE\", expected at least 2")
+	}
+	return store.storeSet("inter", args[0], store.combineSets("inter", args[1:]))
+}
+
+func sunionstore(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"SUNIONSTORE\", expected at least 2")
+	}
+	return store.storeSet("union", args[0], store.combineSets("union", args[1:]))
+}
+
+func sdiffstore(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"SDIFFSTORE\", expected at least 2")
+	}
+	return store.storeSet("diff", args[0], store.combineSets("diff", args[1:]))
+}
+
+// Reads the sets that went alongside a legacy text dump.
+func (store *Store) readSets(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Each member is on its own line: "key:member"
+		index := strings.IndexByte(line, ':')
+		if index == -1 {
+			fmt.Println("Invalid set record")
+			continue
+		}
+		key, member := line[:index], line[index+1:]
+		set, present := store.setStore[key]
+		if !present {
+			set = make(map[string]bool)
+			store.setStore[key] = set
+		}
+		set[member] = true
+	}
+}
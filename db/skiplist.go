@@ -0,0 +1,206 @@
+package db
+
+import "math/rand"
+
+// Skip list constants.
+const (
+	SKIPLIST_MAXLEVEL    = 32
+	SKIPLIST_PROBABILITY = 0.25
+)
+
+// A skip list ordered by score, then by member. Each link records how many nodes it
+// skips over, so that ranks can be computed in O(log n) as well.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	levels   []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+func newSkiplist() *skiplist {
+	header := &skiplistNode{levels: make([]skiplistLevel, SKIPLIST_MAXLEVEL)}
+	return &skiplist{header: header, level: 1}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < SKIPLIST_MAXLEVEL && rand.Float64() < SKIPLIST_PROBABILITY {
+		level++
+	}
+	return level
+}
+
+// Returns true if the node sorts before the given score and member.
+func (node *skiplistNode) before(score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// Returns true if the node sorts after the given score and member.
+func (node *skiplistNode) after(score float64, member string) bool {
+	return node.score > score || (node.score == score && node.member > member)
+}
+
+// Inserts a member, which must not already be in the list.
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [SKIPLIST_MAXLEVEL]*skiplistNode
+	var rank [SKIPLIST_MAXLEVEL]int
+
+	// Find the rightmost node at each level that comes before the new one.
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].levels[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	// Link the node in, and fix up the spans on either side of it.
+	x = &skiplistNode{member: member, score: score, levels: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = x
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = (rank[0] - rank[i]) + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// Unlinks a node, given the rightmost node before it at each level.
+func (zsl *skiplist) deleteNode(x *skiplistNode, update []*skiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.levels[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// Removes a member with the given score, returning false if it wasn't found.
+func (zsl *skiplist) delete(score float64, member string) bool {
+	update := make([]*skiplistNode, SKIPLIST_MAXLEVEL)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+	x = x.levels[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.deleteNode(x, update)
+	return true
+}
+
+// Returns the 0-based rank of a member with the given score, or -1 if it isn't found.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !x.levels[i].forward.after(score, member) {
+			rank += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if x != zsl.header && x.score == score && x.member == member {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// Returns the node at the given 0-based rank, or nil if the rank is out of range.
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	if rank < 0 || rank >= zsl.length {
+		return nil
+	}
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank+1 {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// Returns the first node that isn't below the range, or nil if there is none. The
+// predicate reports whether a node is still below the start of the range.
+func (zsl *skiplist) first(below func(*skiplistNode) bool) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && below(x.levels[i].forward) {
+			x = x.levels[i].forward
+		}
+	}
+	return x.levels[0].forward
+}
+
+// Returns the last node that isn't above the range, or nil if there is none. The
+// predicate reports whether a node is still within the end of the range.
+func (zsl *skiplist) last(within func(*skiplistNode) bool) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && within(x.levels[i].forward) {
+			x = x.levels[i].forward
+		}
+	}
+	if x == zsl.header {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns a sorted set holding members a to g, where b and c tie on their score.
+func testSortedSet() *sortedSet {
+	zset := newSortedSet()
+	for _, member := range []struct {
+		score  float64
+		member string
+	}{{5, "e"}, {1, "a"}, {2, "c"}, {2, "b"}, {7, "g"}, {4, "d"}, {6, "f"}} {
+		zset.add(member.score, member.member)
+	}
+	return zset
+}
+
+func members(nodes []*skiplistNode) []string {
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.member)
+	}
+	return names
+}
+
+func TestSkiplistRank(t *testing.T) {
+	zset := testSortedSet()
+	tests := []struct {
+		score  float64
+		member string
+		rank   int
+	}{
+		{1, "a", 0},
+		{2, "b", 1},
+		{2, "c", 2},
+		{4, "d", 3},
+		{7, "g", 6},
+		{3, "d", -1},
+		{2, "bb", -1},
+		{8, "h", -1},
+	}
+	for _, test := range tests {
+		if rank := zset.zsl.rank(test.score, test.member); rank != test.rank {
+			t.Errorf("rank(%v, %q) = %d, want %d", test.score, test.member, rank, test.rank)
+		}
+		if test.rank == -1 {
+			continue
+		}
+		if node := zset.zsl.byRank(test.rank); node == nil || node.member != test.member {
+			t.Errorf("byRank(%d) = %v, want %q", test.rank, node, test.member)
+		}
+	}
+	for _, rank := range []int{-1, 7} {
+		if node := zset.zsl.byRank(rank); node != nil {
+			t.Errorf("byRank(%d) = %q, want nil", rank, node.member)
+		}
+	}
+
+	// Ranks after a removed member move up, and a new score moves a member.
+	zset.remove("b")
+	zset.add(4.5, "a")
+	for rank, member := range []string{"c", "d", "a", "e", "f", "g"} {
+		if got := zset.zsl.rank(zset.dict[member], member); got != rank {
+			t.Errorf("rank of %q = %d, want %d", member, got, rank)
+		}
+	}
+	if zset.zsl.length != 6 {
+		t.Errorf("length = %d, want 6", zset.zsl.length)
+	}
+}
+
+func TestSortedSetRangeByRank(t *testing.T) {
+	zset := testSortedSet()
+	tests := []struct {
+		start, stop int
+		reverse     bool
+		members     []string
+	}{
+		{0, -1, false, []string{"a", "b", "c", "d", "e", "f", "g"}},
+		{1, 2, false, []string{"b", "c"}},
+		{-2, -1, false, []string{"f", "g"}},
+		{-100, 0, false, []string{"a"}},
+		{5, 100, false, []string{"f", "g"}},
+		{0, 1, true, []string{"g", "f"}},
+		{-1, -1, true, []string{"a"}},
+		{3, 2, false, []string{}},
+		{7, 10, false, []string{}},
+		{-100, -50, false, []string{}},
+	}
+	for _, test := range tests {
+		nodes := zset.rangeByRank(test.start, test.stop, test.reverse)
+		if got := members(nodes); !reflect.DeepEqual(got, test.members) {
+			t.Errorf("rangeByRank(%d, %d, %v) = %q, want %q", test.start, test.stop, test.reverse, got,
+				test.members)
+		}
+	}
+}
+
+func TestSortedSetRangeByScore(t *testing.T) {
+	zset := testSortedSet()
+	tests := []struct {
+		min, max      string
+		offset, count int
+		members       []string
+	}{
+		{"-inf", "+inf", 0, -1, []string{"a", "b", "c", "d", "e", "f", "g"}},
+		{"2", "4", 0, -1, []string{"b", "c", "d"}},
+		{"(2", "4", 0, -1, []string{"d"}},
+		{"2", "(4", 0, -1, []string{"b", "c"}},
+		{"(1", "(2", 0, -1, []string{}},
+		{"2.5", "3.5", 0, -1, []string{}},
+		{"5", "1", 0, -1, []string{}},
+		{"-inf", "+inf", 2, 3, []string{"c", "d", "e"}},
+		{"-inf", "+inf", 6, -1, []string{"g"}},
+		{"-inf", "+inf", 10, -1, []string{}},
+		{"-inf", "+inf", 0, 0, []string{}},
+	}
+	for _, test := range tests {
+		r, err := parseScoreRange(test.min, test.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := members(zset.rangeBy(r, test.offset, test.count)); !reflect.DeepEqual(got, test.members) {
+			t.Errorf("range [%s, %s] at %d, %d = %q, want %q", test.min, test.max, test.offset, test.count,
+				got, test.members)
+		}
+	}
+	for _, bound := range []string{"x", "(", "nan", ""} {
+		if _, err := parseScoreRange(bound, "1"); err == nil {
+			t.Errorf("parseScoreRange(%q, 1) succeeded", bound)
+		}
+	}
+}
+
+func TestSortedSetRangeByLex(t *testing.T) {
+	zset := newSortedSet()
+	for _, member := range []string{"b", "a", "d", "c", "e"} {
+		zset.add(0, member)
+	}
+	tests := []struct {
+		min, max string
+		members  []string
+	}{
+		{"-", "+", []string{"a", "b", "c", "d", "e"}},
+		{"[b", "[d", []string{"b", "c", "d"}},
+		{"(b", "(d", []string{"c"}},
+		{"[bb", "+", []string{"c", "d", "e"}},
+		{"-", "(a", []string{}},
+		{"+", "-", []string{}},
+		{"[d", "[b", []string{}},
+	}
+	for _, test := range tests {
+		r, err := parseLexRange(test.min, test.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := members(zset.rangeBy(r, 0, -1)); !reflect.DeepEqual(got, test.members) {
+			t.Errorf("range %s %s = %q, want %q", test.min, test.max, got, test.members)
+		}
+	}
+	for _, bound := range []string{"a", "", "*"} {
+		if _, err := parseLexRange(bound, "+"); err == nil {
+			t.Errorf("parseLexRange(%q, +) succeeded", bound)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// Snapshots start with a magic string, a version and an id, followed by one record per
+// key, an end-of-file marker, and a CRC32 of everything before the CRC. The id matches a
+// marker in the append-only log, after which the writes that aren't in the snapshot begin.
+// Version 1 snapshots don't have an id.
+//
+// Each record is a type (1 byte) and the length of the rest of the record, followed by
+// the key, its expiration in unix milliseconds (0 for none), and a body that depends on
+// the type. Strings are a uvarint length followed by the
+// raw bytes, so keys and values may contain any bytes at all.
+//
+// Keys belong to the first database, until a SELECTDB record, which holds nothing but the
+// index of the database that the keys after it belong to. Version 2 snapshots don't have
+// SELECTDB records.
+const (
+	SNAPSHOT_MAGIC         = "LETTUCE"
+	SNAPSHOT_VERSION       = 3
+	SNAPSHOT_HEADER_LENGTH = len(SNAPSHOT_MAGIC) + 2 + 8
+
+	// Record types.
+	TYPE_STRING   = 1
+	TYPE_LIST     = 2
+	TYPE_HASH     = 3
+	TYPE_SET      = 4
+	TYPE_ZSET     = 5
+	TYPE_SELECTDB = 0xFE
+	TYPE_EOF      = 0xFF
+)
+
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+// Builds a single record.
+type recordEncoder struct {
+	recordType byte
+	buf        bytes.Buffer
+}
+
+func (enc *recordEncoder) putUvarint(n uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	enc.buf.Write(tmp[:binary.PutUvarint(tmp[:], n)])
+}
+
+func (enc *recordEncoder) putVarint(n int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	enc.buf.Write(tmp[:binary.PutVarint(tmp[:], n)])
+}
+
+func (enc *recordEncoder) putString(s string) {
+	enc.putUvarint(uint64(len(s)))
+	enc.buf.WriteString(s)
+}
+
+func (enc *recordEncoder) putFloat(f float64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], math.Float64bits(f))
+	enc.buf.Write(tmp[:])
+}
+
+// Reads back the fields of a single record, remembering the first error it runs into.
+type recordDecoder struct {
+	data []byte
+	err  error
+}
+
+func (dec *recordDecoder) uvarint() uint64 {
+	n, size := binary.Uvarint(dec.data)
+	if size <= 0 {
+		dec.err = errCorruptSnapshot
+		return 0
+	}
+	dec.data = dec.data[size:]
+	return n
+}
+
+func (dec *recordDecoder) varint() int64 {
+	n, size := binary.Varint(dec.data)
+	if size <= 0 {
+		dec.err = errCorruptSnapshot
+		return 0
+	}
+	dec.data = dec.data[size:]
+	return n
+}
+
+func (dec *recordDecoder) string() string {
+	n := dec.uvarint()
+	if dec.err != nil || n > uint64(len(dec.data)) {
+		dec.err = errCorruptSnapshot
+		return ""
+	}
+	s := string(dec.data[:n])
+	dec.data = dec.data[n:]
+	return s
+}
+
+func (dec *recordDecoder) float() float64 {
+	if len(dec.data) < 8 {
+		dec.err = errCorruptSnapshot
+		return 0
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(dec.data))
+	dec.data = dec.data[8:]
+	return f
+}
+
+// Returns the number of items in a collection, which can't be more than the bytes left.
+func (dec *recordDecoder) count() int {
+	n := dec.uvarint()
+	if n > uint64(len(dec.data)) {
+		dec.err = errCorruptSnapshot
+		return 0
+	}
+	return int(n)
+}
+
+// Calls fn with each key to write, along with the index of its database and the database
+// to read it from, and done after each batch of keys. The keys of each database come
+// together, in order of their index.
+type keyIterator func(fn func(index int, key string, src *database), done func())
+
+// Writes every key given by each to w in the snapshot format.
+func writeSnapshot(w io.Writer, id uint64, each keyIterator) error {
+	crc := crc32.NewIEEE()
+	out := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var header [SNAPSHOT_HEADER_LENGTH]byte
+	copy(header[:], SNAPSHOT_MAGIC)
+	binary.BigEndian.PutUint16(header[len(SNAPSHOT_MAGIC):], SNAPSHOT_VERSION)
+	binary.BigEndian.PutUint64(header[len(SNAPSHOT_MAGIC)+2:], id)
+	out.Write(header[:])
+
+	// Records are encoded while the keys are being read, and written out after.
+	var pending bytes.Buffer
+	writeRecord := func(enc *recordEncoder) {
+		// Each record is prefixed with its length, so a reader can tell where it ends.
+		var tmp [binary.MaxVarintLen64]byte
+		pending.WriteByte(enc.recordType)
+		pending.Write(tmp[:binary.PutUvarint(tmp[:], uint64(enc.buf.Len()))])
+		pending.Write(enc.buf.Bytes())
+	}
+	selected := 0
+	each(func(index int, key string, src *database) {
+		if index != selected {
+			enc := &recordEncoder{recordType: TYPE_SELECTDB}
+			enc.putUvarint(uint64(index))
+			writeRecord(enc)
+			selected = index
+		}
+		for _, enc := range encodeKey(src, key) {
+			writeRecord(enc)
+		}
+	}, func() {
+		out.Write(pending.Bytes())
+		pending.Reset()
+	})
+	out.WriteByte(TYPE_EOF)
+
+	// The CRC covers everything written so far, so flush before reading it.
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+// Returns a record for each type the key holds in the given database.
+func encodeKey(src *database, key string) []*recordEncoder {
+	records := make([]*recordEncoder, 0, 1)
+	newRecord := func(recordType byte) *recordEncoder {
+		enc := &recordEncoder{recordType: recordType}
+		enc.putString(key)
+		if deadline, present := src.expires[key]; present {
+			enc.putVarint(unixMillis(deadline))
+		} else {
+			enc.putVarint(0)
+		}
+		records = append(records, enc)
+		return enc
+	}
+
+	if val, present := src.stringStore[key]; present {
+		enc := newRecord(TYPE_STRING)
+		enc.putString(val)
+	}
+	if l, present := src.listStore[key]; present {
+		enc := newRecord(TYPE_LIST)
+		enc.putUvarint(uint64(l.Len()))
+		for e := l.Front(); e != nil; e = e.Next() {
+			enc.putString(e.Value.(string))
+		}
+	}
+	if hash, present := src.hashStore[key]; present {
+		enc := newRecord(TYPE_HASH)
+		enc.putUvarint(uint64(len(hash)))
+		for field, val := range hash {
+			enc.putString(field)
+			enc.putString(val)
+		}
+	}
+	if set, present := src.setStore[key]; present {
+		enc := newRecord(TYPE_SET)
+		enc.putUvarint(uint64(len(set)))
+		for member := range set {
+			enc.putString(member)
+		}
+	}
+	if zset, present := src.zsetStore[key]; present {
+		enc := newRecord(TYPE_ZSET)
+		enc.putUvarint(uint64(zset.zsl.length))
+		for x := zset.zsl.header.levels[0].forward; x != nil; x = x.levels[0].forward {
+			enc.putString(x.member)
+			enc.putFloat(x.score)
+		}
+	}
+	return records
+}
+
+// Returns true if the data starts with a snapshot header rather than a legacy text dump.
+func isSnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(SNAPSHOT_MAGIC))
+}
+
+// Loads every record of a snapshot into the store, after checking its version and CRC.
+func (store *Store) readSnapshot(data []byte) error {
+	headerLen := len(SNAPSHOT_MAGIC) + 2
+	if len(data) < headerLen+1+4 {
+		return errCorruptSnapshot
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return errors.New("snapshot checksum mismatch")
+	}
+	version := binary.BigEndian.Uint16(body[len(SNAPSHOT_MAGIC):])
+	if version > SNAPSHOT_VERSION {
+		return errors.New("unsupported snapshot version")
+	}
+	if version >= 2 {
+		if len(body) < SNAPSHOT_HEADER_LENGTH+1 {
+			return errCorruptSnapshot
+		}
+		store.snapshotID = binary.BigEndian.Uint64(body[headerLen:])
+		headerLen = SNAPSHOT_HEADER_LENGTH
+	}
+
+	// Records go into the first database until one is selected.
+	defer store.selectDB(store.db)
+	store.selectDB(0)
+	now := time.Now()
+	rest := body[headerLen:]
+	for {
+		if len(rest) == 0 {
+			return errCorruptSnapshot
+		}
+		recordType := rest[0]
+		if recordType == TYPE_EOF {
+			return nil
+		}
+		length, size := binary.Uvarint(rest[1:])
+		if size <= 0 || length > uint64(len(rest)-1-size) {
+			return errCorruptSnapshot
+		}
+		record := rest[1+size : 1+size+int(length)]
+		rest = rest[1+size+int(length):]
+		if recordType == TYPE_SELECTDB {
+			dec := &recordDecoder{data: record}
+			index := dec.uvarint()
+			if dec.err != nil || index >= DATABASES {
+				return errCorruptSnapshot
+			}
+			store.selectDB(int(index))
+			continue
+		}
+		if err := store.readRecord(recordType, record, now); err != nil {
+			return err
+		}
+	}
+}
+
+func (store *Store) readRecord(recordType byte, record []byte, now time.Time) error {
+	dec := &recordDecoder{data: record}
+	key := dec.string()
+	millis := dec.varint()
+
+	switch recordType {
+	case TYPE_STRING:
+		val := dec.string()
+		if dec.err == nil {
+			store.stringStore[key] = val
+		}
+	case TYPE_LIST:
+		l := list.New()
+		for i, n := 0, dec.count(); i < n && dec.err == nil; i++ {
+			l.PushBack(dec.string())
+		}
+		store.listStore[key] = l
+	case TYPE_HASH:
+		hash := make(map[string]string)
+		for i, n := 0, dec.count(); i < n && dec.err == nil; i++ {
+			field := dec.string()
+			hash[field] = dec.string()
+		}
+		store.hashStore[key] = hash
+	case TYPE_SET:
+		set := make(map[string]bool)
+		for i, n := 0, dec.count(); i < n && dec.err == nil; i++ {
+			set[dec.string()] = true
+		}
+		store.setStore[key] = set
+	case TYPE_ZSET:
+		zset := newSortedSet()
+		for i, n := 0, dec.count(); i < n && dec.err == nil; i++ {
+			member := dec.string()
+			zset.add(dec.float(), member)
+		}
+		store.zsetStore[key] = zset
+	default:
+		return errors.New("unknown record type in snapshot")
+	}
+	if dec.err != nil {
+		return dec.err
+	}
+
+	if millis != 0 {
+		deadline := parseMillis(millis)
+		if deadline.Before(now) {
+			// Expired while we were down.
+			store.removeKey(key)
+		} else {
+			store.expires[key] = deadline
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Returns a snapshot of a store with a key of every type, in more than one database.
+func testSnapshot(t *testing.T) []byte {
+	store := newTestStore(t)
+	for _, request := range []string{
+		"SET s value",
+		`SET "bin\x00key" "\xff\r\n"`,
+		"PEXPIRE s 100000",
+		"RPUSH l a",
+		"RPUSH l b",
+		"RPUSH l c",
+		"HSET h f1 v1",
+		"HSET h f2 v2",
+		"SADD set x y",
+		"ZADD z 1.5 a -2 b 1e300 c",
+		"SELECT 3",
+		"SET other db",
+	} {
+		if result := store.Execute(request); result.IsError() {
+			t.Fatalf("%s: %v", request, result)
+		}
+	}
+	var snapshot bytes.Buffer
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := writeSnapshot(&snapshot, 42, store.each); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	snapshot := testSnapshot(t)
+	store := newTestStore(t)
+	store.lock.Lock()
+	err := store.readSnapshot(snapshot)
+	store.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.snapshotID != 42 {
+		t.Errorf("snapshot id = %d, want 42", store.snapshotID)
+	}
+
+	tests := []struct {
+		request string
+		result  string
+	}{
+		{"GET s", `"value"`},
+		{`GET "bin\x00key"`, "\"\xff\\r\\n\""},
+		{"LRANGE l 0 -1", `"a", "b", "c"`},
+		{"HGET h f1", `"v1"`},
+		{"HGET h f2", `"v2"`},
+		{"SCARD set", "(int) 2"},
+		{"SISMEMBER set y", "(int) 1"},
+		{"ZRANGE z 0 -1 WITHSCORES", `"b", "-2", "a", "1.5", "c", "1e+300"`},
+		{"TTL l", "(int) -1"},
+		{"GET other", "<nil>"},
+		{"SELECT 3", "OK"},
+		{"GET other", `"db"`},
+		{"GET s", "<nil>"},
+	}
+	for _, test := range tests {
+		if result := store.Execute(test.request).String(); result != test.result {
+			t.Errorf("%s = %s, want %s", test.request, result, test.result)
+		}
+	}
+	store.Execute("SELECT 0")
+	if ttl := store.Execute("PTTL s").Integer; ttl <= 0 || ttl > 100000 {
+		t.Errorf("PTTL s = %d, want the timeout to survive", ttl)
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	snapshot := testSnapshot(t)
+	store := newTestStore(t)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// Any change to a single byte, or a snapshot cut short, is caught.
+	for i := range snapshot {
+		corrupt := append([]byte(nil), snapshot...)
+		corrupt[i] ^= 0x20
+		if err := store.readSnapshot(corrupt); err == nil {
+			t.Errorf("flipping a bit of byte %d went unnoticed", i)
+		}
+	}
+	for length := 0; length < len(snapshot); length++ {
+		if err := store.readSnapshot(snapshot[:length]); err == nil {
+			t.Errorf("a snapshot cut to %d bytes went unnoticed", length)
+		}
+	}
+	if err := store.readSnapshot(snapshot); err != nil {
+		t.Errorf("the whole snapshot didn't load: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package db
+
+import "container/list"
+
+// Number of keys a background job reads from a view each time it takes the lock.
+const VIEW_CHUNK_SIZE = 128
+
+// A view of the store as of the moment it was taken, for background jobs that need a
+// consistent picture without holding up writers. Only the names of the keys are copied
+// up front. Afterwards, the first write to each key copies its old value into a shadow
+// database, so the view can keep reading it from there (copy on write).
+type view struct {
+	keys   [][]string
+	shadow []*database
+	copied []map[string]bool
+}
+
+// Calls fn with every key in every database, and done once at the end. Must be called
+// with the store locked.
+func (store *Store) each(fn func(index int, key string, src *database), done func()) {
+	for index, d := range store.dbs {
+		for _, key := range d.keys() {
+			fn(index, key, d)
+		}
+	}
+	done()
+}
+
+// Takes a new view of the store. Must be called with the store locked, and released with
+// closeView once the job is done.
+func (store *Store) openView() *view {
+	v := &view{keys: make([][]string, DATABASES), shadow: newDatabases(),
+		copied: make([]map[string]bool, DATABASES)}
+	for index, d := range store.dbs {
+		v.keys[index] = d.keys()
+		v.copied[index] = make(map[string]bool)
+	}
+	store.views = append(store.views, v)
+	return v
+}
+
+func (store *Store) closeView(v *view) {
+	for i, other := range store.views {
+		if other == v {
+			store.views = append(store.views[:i], store.views[i+1:]...)
+			break
+		}
+	}
+}
+
+// Must be called before a key in the selected database is changed in any way, including
+// its expiration.
+func (store *Store) touch(key string) {
+	store.version++
+	store.versions[key] = store.version
+	store.touched[dbKey{store.db, key}] = true
+	for _, v := range store.views {
+		if !v.copied[store.db][key] {
+			copyKey(v.shadow[store.db], store.database, key)
+			v.copied[store.db][key] = true
+		}
+	}
+}
+
+// Returns the database to read a key from, as of when the view was taken. Must be called
+// with the store locked.
+func (v *view) source(store *Store, index int, key string) *database {
+	if v.copied[index][key] {
+		return v.shadow[index]
+	}
+	return store.dbs[index]
+}
+
+// Calls fn with each key in the view and the database to read it from, a chunk of keys at
+// a time, holding the lock only while fn runs. Calls done without the lock after each chunk.
+func (v *view) each(store *Store, fn func(index int, key string, src *database), done func()) {
+	for index, keys := range v.keys {
+		for start := 0; start < len(keys); start += VIEW_CHUNK_SIZE {
+			end := start + VIEW_CHUNK_SIZE
+			if end > len(keys) {
+				end = len(keys)
+			}
+			store.lock.Lock()
+			for _, key := range keys[start:end] {
+				fn(index, key, v.source(store, index, key))
+			}
+			store.lock.Unlock()
+			done()
+		}
+	}
+}
+
+// Copies a key of any type, along with its expiration, from one database to another.
+func copyKey(dst *database, src *database, key string) {
+	copyKeyAs(dst, key, src, key)
+}
+
+// Copies a key of any type, along with its expiration, to a key of another name.
+func copyKeyAs(dst *database, dstKey string, src *database, key string) {
+	if val, present := src.stringStore[key]; present {
+		dst.stringStore[dstKey] = val
+	}
+	if l, present := src.listStore[key]; present {
+		copied := list.New()
+		copied.PushBackList(l)
+		dst.listStore[dstKey] = copied
+	}
+	if hash, present := src.hashStore[key]; present {
+		copied := make(map[string]string, len(hash))
+		for field, val := range hash {
+			copied[field] = val
+		}
+		dst.hashStore[dstKey] = copied
+	}
+	if set, present := src.setStore[key]; present {
+		copied := make(map[string]bool, len(set))
+		for member := range set {
+			copied[member] = true
+		}
+		dst.setStore[dstKey] = copied
+	}
+	if zset, present := src.zsetStore[key]; present {
+		copied := newSortedSet()
+		for member, score := range zset.dict {
+			copied.add(score, member)
+		}
+		dst.zsetStore[dstKey] = copied
+	}
+	if deadline, present := src.expires[key]; present {
+		dst.expires[dstKey] = deadline
+	}
+}
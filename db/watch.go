@@ -0,0 +1,54 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// Returns whether each key still has the version it was watched at. Watched is a list
+// of databases, each followed by a key and its version.
+func (store *Store) checkVersions(watched []string) bool {
+	if len(watched)%3 != 0 {
+		return false
+	}
+	unchanged := true
+	for i := 0; i+2 < len(watched) && unchanged; i += 3 {
+		index, ok := parseDB(watched[i])
+		key := watched[i+1]
+		version, err := strconv.ParseUint(watched[i+2], 10, 64)
+		if !ok || err != nil {
+			return false
+		}
+
+		// A key that expired since it was watched has changed too.
+		store.inDB(index, func() {
+			store.expireIfNeeded(key)
+			unchanged = store.versions[key] == version
+		})
+	}
+	return unchanged
+}
+
+// Returns the current version of each key, which the master keeps for the session that
+// watches them, and sends back with EXEC.
+func watch(args []string, store *Store) reply.Reply {
+	if len(args) < 1 {
+		return reply.Error("wrong number of arguments for \"WATCH\", expected at least 1")
+	}
+	versions := make([]reply.Reply, len(args))
+	for i, key := range args {
+		store.expireIfNeeded(key)
+		versions[i] = reply.Integer(int64(store.versions[key]))
+	}
+	return reply.Array(versions...)
+}
+
+// The master forgets a session's watched keys itself. This only runs as part of a
+// transaction, whose watched keys have already been checked by then.
+func unwatch(args []string, store *Store) reply.Reply {
+	if len(args) != 0 {
+		return reply.Error("wrong number of arguments for \"UNWATCH\", expected 0")
+	}
+	return reply.OK
+}
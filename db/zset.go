@@ -0,0 +1,674 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+// A sorted set keeps a map from member to score for O(1) lookups, and a skip list for
+// ordered access by score or rank.
+type sortedSet struct {
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{dict: make(map[string]float64), zsl: newSkiplist()}
+}
+
+// Adds a member or updates its score.
+func (zset *sortedSet) add(score float64, member string) {
+	if current, present := zset.dict[member]; present {
+		if current == score {
+			return
+		}
+		zset.zsl.delete(current, member)
+	}
+	zset.dict[member] = score
+	zset.zsl.insert(score, member)
+}
+
+func (zset *sortedSet) remove(member string) bool {
+	score, present := zset.dict[member]
+	if !present {
+		return false
+	}
+	delete(zset.dict, member)
+	zset.zsl.delete(score, member)
+	return true
+}
+
+// Clamps start and stop ranks the way ZRANGE does, with negative ranks counting back
+// from the end. Returns false if the range is empty.
+func (zset *sortedSet) normalizeRanks(start, stop int) (int, int, bool) {
+	length := zset.zsl.length
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, start <= stop && start < length
+}
+
+// Returns the nodes between two ranks, inclusive, counting from the highest score if reverse is set.
+func (zset *sortedSet) rangeByRank(start, stop int, reverse bool) []*skiplistNode {
+	start, stop, ok := zset.normalizeRanks(start, stop)
+	if !ok {
+		return nil
+	}
+	nodes := make([]*skiplistNode, 0, stop-start+1)
+	if reverse {
+		x := zset.zsl.byRank(zset.zsl.length - 1 - start)
+		for i := start; i <= stop; i, x = i+1, x.backward {
+			nodes = append(nodes, x)
+		}
+	} else {
+		x := zset.zsl.byRank(start)
+		for i := start; i <= stop; i, x = i+1, x.levels[0].forward {
+			nodes = append(nodes, x)
+		}
+	}
+	return nodes
+}
+
+// Returns the nodes within a range, skipping offset nodes and returning at most count
+// nodes if count isn't negative.
+func (zset *sortedSet) rangeBy(r scoreOrLexRange, offset, count int) []*skiplistNode {
+	nodes := make([]*skiplistNode, 0)
+	x := zset.zsl.first(r.belowMin)
+	for ; x != nil && offset > 0 && !r.aboveMax(x); offset-- {
+		x = x.levels[0].forward
+	}
+	for ; x != nil && count != 0 && !r.aboveMax(x); count-- {
+		nodes = append(nodes, x)
+		x = x.levels[0].forward
+	}
+	return nodes
+}
+
+// Either a score range or a lexicographical range over the members of a sorted set.
+type scoreOrLexRange interface {
+	belowMin(x *skiplistNode) bool
+	aboveMax(x *skiplistNode) bool
+}
+
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r scoreRange) belowMin(x *skiplistNode) bool {
+	return x.score < r.min || (r.minex && x.score == r.min)
+}
+
+func (r scoreRange) aboveMax(x *skiplistNode) bool {
+	return x.score > r.max || (r.maxex && x.score == r.max)
+}
+
+// Parses a bound like "1.5", "(1.5", "-inf" or "+inf".
+func parseScoreBound(bound string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(bound, "(")
+	if exclusive {
+		bound = bound[1:]
+	}
+	score, err := parseScore(bound)
+	return score, exclusive, err
+}
+
+func parseScoreRange(min, max string) (scoreRange, error) {
+	var r scoreRange
+	var err error
+	if r.min, r.minex, err = parseScoreBound(min); err != nil {
+		return r, errors.New("min or max is not a float")
+	}
+	if r.max, r.maxex, err = parseScoreBound(max); err != nil {
+		return r, errors.New("min or max is not a float")
+	}
+	return r, nil
+}
+
+// Lexicographical ranges only make sense when all members have the same score. The
+// infinite bounds "-" and "+" are stored as -1 and 1 respectively.
+type lexRange struct {
+	min, max       string
+	minex, maxex   bool
+	minInf, maxInf int
+}
+
+func (r lexRange) belowMin(x *skiplistNode) bool {
+	if r.minInf != 0 {
+		return r.minInf > 0
+	}
+	return x.member < r.min || (r.minex && x.member == r.min)
+}
+
+func (r lexRange) aboveMax(x *skiplistNode) bool {
+	if r.maxInf != 0 {
+		return r.maxInf < 0
+	}
+	return x.member > r.max || (r.maxex && x.member == r.max)
+}
+
+// Parses a bound like "[a", "(a", "-" or "+". Returns the member, whether it's exclusive,
+// and which infinity it is, if any.
+func parseLexBound(bound string) (string, bool, int, error) {
+	if bound == "-" {
+		return "", false, -1, nil
+	} else if bound == "+" {
+		return "", false, 1, nil
+	}
+	if len(bound) == 0 || (bound[0] != '[' && bound[0] != '(') {
+		return "", false, 0, errors.New("min or max not valid string range item")
+	}
+	return bound[1:], bound[0] == '(', 0, nil
+}
+
+func parseLexRange(min, max string) (lexRange, error) {
+	var r lexRange
+	var err error
+	if r.min, r.minex, r.minInf, err = parseLexBound(min); err != nil {
+		return r, err
+	}
+	if r.max, r.maxex, r.maxInf, err = parseLexBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("value is not a valid float")
+	}
+	return score, nil
+}
+
+func formatScore(score float64) string {
+	if math.IsInf(score, 1) {
+		return "inf"
+	} else if math.IsInf(score, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// Returns sorted set members, each followed by its score if asked for.
+func formatNodes(nodes []*skiplistNode, withScores bool) reply.Reply {
+	members := make([]reply.Reply, 0, len(nodes))
+	for _, x := range nodes {
+		members = append(members, reply.Bulk(x.member))
+		if withScores {
+			members = append(members, reply.Bulk(formatScore(x.score)))
+		}
+	}
+	return reply.Array(members...)
+}
+
+// Removes the given nodes, deleting the sorted set if it ends up empty.
+func (store *Store) removeNodes(name string, zset *sortedSet, nodes []*skiplistNode, event string) reply.Reply {
+	store.touch(name)
+	for _, x := range nodes {
+		zset.remove(x.member)
+	}
+	if len(nodes) > 0 {
+		store.notify(NOTIFY_ZSET, event, name)
+		store.dirty++
+	}
+	if zset.zsl.length == 0 {
+		store.removeKey(name)
+		store.notify(NOTIFY_GENERIC, "del", name)
+	}
+	return reply.Integer(int64(len(nodes)))
+}
+
+func zadd(args []string, store *Store) reply.Reply {
+	if len(args) < 3 {
+		return reply.Error("wrong number of arguments for \"ZADD\", expected at least 3")
+	}
+	name := args[0]
+
+	// Flags come before the score and member pairs.
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		case "ch":
+			ch = true
+		case "incr":
+			incr = true
+		default:
+			break flags
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return reply.Error("syntax error, expected score and member pairs")
+	}
+	if nx && (xx || gt || lt) || gt && lt {
+		return reply.Error("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) != 2 {
+		return reply.Error("INCR option supports a single increment-element pair")
+	}
+
+	// Parse every score before changing anything.
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseScore(pairs[2*j])
+		if err != nil {
+			return reply.Error(err.Error())
+		}
+		scores[j] = score
+	}
+
+	zset, present := store.zsetStore[name]
+	if !present {
+		if xx {
+			if incr {
+				return reply.Null()
+			}
+			return reply.Integer(0)
+		}
+		zset = newSortedSet()
+	}
+
+	store.touch(name)
+	added, changed := 0, 0
+	result, aborted := 0.0, false
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		current, exists := zset.dict[member]
+		if exists {
+			if incr {
+				score += current
+				if math.IsNaN(score) {
+					return reply.Error("resulting score is not a number (NaN)")
+				}
+			}
+			if nx || (gt && score <= current) || (lt && score >= current) {
+				aborted = true
+				continue
+			}
+			if score != current {
+				zset.add(score, member)
+				changed++
+			}
+		} else {
+			if xx {
+				aborted = true
+				continue
+			}
+			zset.add(score, member)
+			added++
+		}
+		result = score
+	}
+	if zset.zsl.length > 0 {
+		store.zsetStore[name] = zset
+	}
+	if added+changed > 0 {
+		if incr {
+			store.notify(NOTIFY_ZSET, "zincr", name)
+		} else {
+			store.notify(NOTIFY_ZSET, "zadd", name)
+		}
+		store.dirty++
+	}
+
+	if incr {
+		if aborted {
+			return reply.Null()
+		}
+		return reply.Bulk(formatScore(result))
+	}
+	if ch {
+		return reply.Integer(int64(added + changed))
+	}
+	return reply.Integer(int64(added))
+}
+
+func zrem(args []string, store *Store) reply.Reply {
+	if len(args) < 2 {
+		return reply.Error("wrong number of arguments for \"ZREM\", expected at least 2")
+	}
+	name := args[0]
+	zset, present := store.zsetStore[name]
+	if !present {
+		return reply.Integer(0)
+	}
+	store.touch(name)
+	removed := 0
+	for _, arg := range args[1:] {
+		if zset.remove(arg) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		store.notify(NOTIFY_ZSET, "zrem", name)
+		store.dirty++
+	}
+	if zset.zsl.length == 0 {
+		store.removeKey(name)
+		store.notify(NOTIFY_GENERIC, "del", name)
+	}
+	return reply.Integer(int64(removed))
+}
+
+func zcard(args []string, store *Store) reply.Reply {
+	if len(args) != 1 {
+		return reply.Error("wrong number of arguments for \"ZCARD\", expected 1")
+	}
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Integer(0)
+	}
+	return reply.Integer(int64(zset.zsl.length))
+}
+
+func zscore(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"ZSCORE\", expected 2")
+	}
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Null()
+	}
+	score, present := zset.dict[args[1]]
+	if !present {
+		return reply.Null()
+	}
+	return reply.Bulk(formatScore(score))
+}
+
+func zincrby(args []string, store *Store) reply.Reply {
+	if len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"ZINCRBY\", expected 3")
+	}
+	name, member := args[0], args[2]
+	increment, err := parseScore(args[1])
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	store.touch(name)
+	zset, present := store.zsetStore[name]
+	if !present {
+		zset = newSortedSet()
+		store.zsetStore[name] = zset
+	}
+	score := zset.dict[member] + increment
+	if math.IsNaN(score) {
+		return reply.Error("resulting score is not a number (NaN)")
+	}
+	zset.add(score, member)
+	store.notify(NOTIFY_ZSET, "zincr", name)
+	store.dirty++
+	return reply.Bulk(formatScore(score))
+}
+
+func (store *Store) zrank(args []string, reverse bool) reply.Reply {
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Null()
+	}
+	member := args[1]
+	score, present := zset.dict[member]
+	if !present {
+		return reply.Null()
+	}
+	rank := zset.zsl.rank(score, member)
+	if reverse {
+		rank = zset.zsl.length - 1 - rank
+	}
+	return reply.Integer(int64(rank))
+}
+
+func zrank(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"ZRANK\", expected 2")
+	}
+	return store.zrank(args, false)
+}
+
+func zrevrank(args []string, store *Store) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"ZREVRANK\", expected 2")
+	}
+	return store.zrank(args, true)
+}
+
+func (store *Store) zrange(args []string, reverse bool) reply.Reply {
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToLower(args[3]) != "withscores" {
+			return reply.Error("syntax error, expected WITHSCORES")
+		}
+		withScores = true
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		return reply.Error("invalid integer given as start index")
+	}
+	stop, err := strconv.Atoi(args[2])
+	if err != nil {
+		return reply.Error("invalid integer given as stop index")
+	}
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Array()
+	}
+	return formatNodes(zset.rangeByRank(start, stop, reverse), withScores)
+}
+
+func zrange(args []string, store *Store) reply.Reply {
+	if len(args) != 3 && len(args) != 4 {
+		return reply.Error("wrong number of arguments for \"ZRANGE\", expected 3 or 4")
+	}
+	return store.zrange(args, false)
+}
+
+func zrevrange(args []string, store *Store) reply.Reply {
+	if len(args) != 3 && len(args) != 4 {
+		return reply.Error("wrong number of arguments for \"ZREVRANGE\", expected 3 or 4")
+	}
+	return store.zrange(args, true)
+}
+
+// Parses the optional WITHSCORES and "LIMIT offset count" arguments of range queries.
+func parseRangeOptions(args []string, allowScores bool) (bool, int, int, error) {
+	withScores, offset, count := false, 0, -1
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "withscores":
+			if !allowScores {
+				return false, 0, 0, errors.New("syntax error, unexpected WITHSCORES")
+			}
+			withScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				return false, 0, 0, errors.New("syntax error, expected LIMIT offset count")
+			}
+			var err error
+			if offset, err = strconv.Atoi(args[i+1]); err != nil {
+				return false, 0, 0, errors.New("invalid integer given as offset")
+			}
+			if count, err = strconv.Atoi(args[i+2]); err != nil {
+				return false, 0, 0, errors.New("invalid integer given as count")
+			}
+			i += 2
+		default:
+			return false, 0, 0, errors.New("syntax error, unexpected " + args[i])
+		}
+	}
+	if offset < 0 {
+		// A negative offset returns nothing, like Redis does.
+		count = 0
+	}
+	return withScores, offset, count, nil
+}
+
+func zrangebyscore(args []string, store *Store) reply.Reply {
+	if len(args) < 3 {
+		return reply.Error("wrong number of arguments for \"ZRANGEBYSCORE\", expected at least 3")
+	}
+	r, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	withScores, offset, count, err := parseRangeOptions(args[3:], true)
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Array()
+	}
+	return formatNodes(zset.rangeBy(r, offset, count), withScores)
+}
+
+func zrangebylex(args []string, store *Store) reply.Reply {
+	if len(args) < 3 {
+		return reply.Error("wrong number of arguments for \"ZRANGEBYLEX\", expected at least 3")
+	}
+	r, err := parseLexRange(args[1], args[2])
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	_, offset, count, err := parseRangeOptions(args[3:], false)
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Array()
+	}
+	return formatNodes(zset.rangeBy(r, offset, count), false)
+}
+
+func zcount(args []string, store *Store) reply.Reply {
+	if len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"ZCOUNT\", expected 3")
+	}
+	r, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	zset, present := store.zsetStore[args[0]]
+	if !present {
+		return reply.Integer(0)
+	}
+
+	// Count using ranks, so we don't have to walk the whole range.
+	first := zset.zsl.first(r.belowMin)
+	if first == nil || r.aboveMax(first) {
+		return reply.Integer(0)
+	}
+	last := zset.zsl.last(func(x *skiplistNode) bool { return !r.aboveMax(x) })
+	count := zset.zsl.rank(last.score, last.member) - zset.zsl.rank(first.score, first.member) + 1
+	return reply.Integer(int64(count))
+}
+
+func zremrangebyscore(args []string, store *Store) reply.Reply {
+	if len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"ZREMRANGEBYSCORE\", expected 3")
+	}
+	r, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	name := args[0]
+	zset, present := store.zsetStore[name]
+	if !present {
+		return reply.Integer(0)
+	}
+	return store.removeNodes(name, zset, zset.rangeBy(r, 0, -1), "zremrangebyscore")
+}
+
+func zremrangebylex(args []string, store *Store) reply.Reply {
+	if len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"ZREMRANGEBYLEX\", expected 3")
+	}
+	r, err := parseLexRange(args[1], args[2])
+	if err != nil {
+		return reply.Error(err.Error())
+	}
+	name := args[0]
+	zset, present := store.zsetStore[name]
+	if !present {
+		return reply.Integer(0)
+	}
+	return store.removeNodes(name, zset, zset.rangeBy(r, 0, -1), "zremrangebylex")
+}
+
+func zremrangebyrank(args []string, store *Store) reply.Reply {
+	if len(args) != 3 {
+		return reply.Error("wrong number of arguments for \"ZREMRANGEBYRANK\", expected 3")
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		return reply.Error("invalid integer given as start index")
+	}
+	stop, err := strconv.Atoi(args[2])
+	if err != nil {
+		return reply.Error("invalid integer given as stop index")
+	}
+	name := args[0]
+	zset, present := store.zsetStore[name]
+	if !present {
+		return reply.Integer(0)
+	}
+	return store.removeNodes(name, zset, zset.rangeByRank(start, stop, false), "zremrangebyrank")
+}
+
+// Reads the sorted sets that went alongside a legacy text dump.
+func (store *Store) readSortedSets(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Each member is on its own line: "key:score:member"
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			fmt.Println("Invalid sorted set record")
+			continue
+		}
+		score, err := parseScore(fields[1])
+		if err != nil {
+			fmt.Println("Invalid sorted set record")
+			continue
+		}
+		zset, present := store.zsetStore[fields[0]]
+		if !present {
+			zset = newSortedSet()
+			store.zsetStore[fields[0]] = zset
+		}
+		zset.add(score, fields[2])
+	}
+}
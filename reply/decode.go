@@ -0,0 +1,91 @@
+package reply
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on what a reply may claim to hold, so a bad peer can't make us allocate
+// whatever it likes.
+const (
+	MAX_ELEMENTS = 1024 * 1024
+	MAX_BULK     = 512 * 1024 * 1024
+)
+
+// Reads a reply encoded in RESP2 or RESP3, the way EncodeRESP2 and EncodeRESP3 write them.
+// RESP2 null bulk strings are read as nulls, and null arrays as null arrays.
+func ReadRESP(reader *bufio.Reader) (Reply, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" {
+		return Reply{}, errMalformed
+	}
+
+	header, rest := line[0], line[1:]
+	switch header {
+	case '+':
+		return Status(rest), nil
+	case '-':
+		// The code is the first word, if that's in upper case.
+		if fields := strings.SplitN(rest, " ", 2); len(fields) == 2 && isCode(fields[0]) {
+			return CodedError(fields[0], fields[1]), nil
+		}
+		return Error(rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return Reply{}, errMalformed
+		}
+		return Integer(n), nil
+	case '_':
+		return Null(), nil
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size > MAX_BULK {
+			return Reply{}, errMalformed
+		}
+		if size < 0 {
+			return Null(), nil
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return Reply{}, err
+		}
+		if string(bulk[size:]) != "\r\n" {
+			return Reply{}, errMalformed
+		}
+		return Bulk(string(bulk[:size])), nil
+	case '*', '%', '>':
+		count, err := strconv.Atoi(rest)
+		if err != nil || count > MAX_ELEMENTS {
+			return Reply{}, errMalformed
+		}
+		if count < 0 && header == '*' {
+			return NullArray(), nil
+		} else if count < 0 {
+			return Null(), nil
+		}
+		if header == '%' {
+			// A key and a value for each entry.
+			count *= 2
+		}
+		elements := make([]Reply, count)
+		for i := range elements {
+			if elements[i], err = ReadRESP(reader); err != nil {
+				return Reply{}, err
+			}
+		}
+		if header == '%' {
+			return Map(elements...), nil
+		} else if header == '>' {
+			return Push(elements...), nil
+		}
+		return Array(elements...), nil
+	}
+	return Reply{}, errMalformed
+}
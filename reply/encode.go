@@ -0,0 +1,159 @@
+package reply
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Turns a reply into what's sent to a client.
+type Encoder func(reply Reply) string
+
+// Encoders by the name clients pick them with.
+var Encoders = map[string]Encoder{
+	"text":  EncodeText,
+	"json":  EncodeJSON,
+	"resp2": EncodeRESP2,
+	"resp3": EncodeRESP3,
+}
+
+// Encodes a reply on a single line, as the CLI shows it: statuses and errors as they are,
+// integers as "(int) 5", strings quoted, nulls as "<nil>", and the elements of arrays
+// separated by commas. Arrays with arrays in them have their elements numbered instead,
+// like "1) OK, 2) (int) 5".
+func EncodeText(reply Reply) string {
+	switch reply.Type {
+	case STATUS:
+		return reply.Str
+	case ERROR:
+		return reply.Message()
+	case INTEGER:
+		return "(int) " + strconv.FormatInt(reply.Integer, 10)
+	case BULK:
+		return utils.Quote(reply.Str)
+	case NULL, NULL_ARRAY:
+		return "<nil>"
+	case PUSH:
+		// Clients tell pushes apart from replies by their header.
+		return utils.PUSH + utils.DELIMITER + EncodeText(Array(reply.Elements...))
+	case MAP:
+		pairs := make([]string, 0, len(reply.Elements)/2)
+		for i := 0; i+1 < len(reply.Elements); i += 2 {
+			pairs = append(pairs, EncodeText(reply.Elements[i])+": "+EncodeText(reply.Elements[i+1]))
+		}
+		if len(pairs) == 0 {
+			return "empty list"
+		}
+		return strings.Join(pairs, ", ")
+	}
+
+	if len(reply.Elements) == 0 {
+		return "empty list"
+	}
+	numbered := false
+	for _, element := range reply.Elements {
+		numbered = numbered || element.Type == ARRAY || element.Type == MAP
+	}
+	elements := make([]string, len(reply.Elements))
+	for i, element := range reply.Elements {
+		elements[i] = EncodeText(element)
+		if numbered {
+			elements[i] = strconv.Itoa(i+1) + ") " + elements[i]
+		}
+	}
+	return strings.Join(elements, ", ")
+}
+
+func EncodeRESP2(reply Reply) string {
+	return encodeRESP(reply, 2)
+}
+
+func EncodeRESP3(reply Reply) string {
+	return encodeRESP(reply, 3)
+}
+
+// Encodes a reply in RESP2 or RESP3. RESP2 has no nulls, maps or pushes of its own, so
+// they're sent as a null bulk string, or a null array where an array was expected, and as
+// arrays.
+func encodeRESP(reply Reply, protocol int) string {
+	switch reply.Type {
+	case STATUS:
+		return "+" + singleLine(reply.Str) + "\r\n"
+	case ERROR:
+		return "-" + singleLine(reply.Message()) + "\r\n"
+	case INTEGER:
+		return ":" + strconv.FormatInt(reply.Integer, 10) + "\r\n"
+	case BULK:
+		return "$" + strconv.Itoa(len(reply.Str)) + "\r\n" + reply.Str + "\r\n"
+	case NULL:
+		if protocol < 3 {
+			return "$-1\r\n"
+		}
+		return "_\r\n"
+	case NULL_ARRAY:
+		if protocol < 3 {
+			return "*-1\r\n"
+		}
+		return "_\r\n"
+	}
+
+	header, count := "*", len(reply.Elements)
+	if protocol >= 3 && reply.Type == MAP {
+		header, count = "%", count/2
+	} else if protocol >= 3 && reply.Type == PUSH {
+		header = ">"
+	}
+	var encoded strings.Builder
+	encoded.WriteString(header + strconv.Itoa(count) + "\r\n")
+	for _, element := range reply.Elements {
+		encoded.WriteString(encodeRESP(element, protocol))
+	}
+	return encoded.String()
+}
+
+// Simple strings can't have a line break in them.
+func singleLine(str string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(str)
+}
+
+// Encodes a reply as JSON: statuses and bulk strings as strings, integers as numbers,
+// nulls as null, and arrays as arrays. Errors are {"error": "ERR message"}, maps are
+// objects, and pushes are {"push": [...]}. Strings that aren't valid UTF-8 have the bad
+// bytes replaced.
+func EncodeJSON(reply Reply) string {
+	encoded, _ := json.Marshal(jsonValue(reply))
+	return string(encoded)
+}
+
+func jsonValue(reply Reply) interface{} {
+	switch reply.Type {
+	case STATUS, BULK:
+		return reply.Str
+	case ERROR:
+		return map[string]string{"error": reply.Message()}
+	case INTEGER:
+		return reply.Integer
+	case NULL, NULL_ARRAY:
+		return nil
+	case MAP:
+		object := make(map[string]interface{}, len(reply.Elements)/2)
+		for i := 0; i+1 < len(reply.Elements); i += 2 {
+			key := reply.Elements[i].Str
+			if reply.Elements[i].Type == INTEGER {
+				key = strconv.FormatInt(reply.Elements[i].Integer, 10)
+			}
+			object[key] = jsonValue(reply.Elements[i+1])
+		}
+		return object
+	}
+	elements := make([]interface{}, len(reply.Elements))
+	for i, element := range reply.Elements {
+		elements[i] = jsonValue(element)
+	}
+	if reply.Type == PUSH {
+		return map[string]interface{}{"push": elements}
+	}
+	return elements
+}
@@ -0,0 +1,73 @@
+package reply
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncoders(t *testing.T) {
+	tests := []struct {
+		reply Reply
+		text  string
+		json  string
+		resp2 string
+		resp3 string
+	}{
+		{OK, "OK", `"OK"`, "+OK\r\n", "+OK\r\n"},
+		{Status("two\r\nlines"), "two\r\nlines", `"two\r\nlines"`, "+two  lines\r\n", "+two  lines\r\n"},
+		{Error("bad"), "ERR bad", `{"error":"ERR bad"}`, "-ERR bad\r\n", "-ERR bad\r\n"},
+		{CodedError("WRONGTYPE", "kind"), "WRONGTYPE kind", `{"error":"WRONGTYPE kind"}`,
+			"-WRONGTYPE kind\r\n", "-WRONGTYPE kind\r\n"},
+		{Integer(-5), "(int) -5", "-5", ":-5\r\n", ":-5\r\n"},
+		{Bulk("a b"), `"a b"`, `"a b"`, "$3\r\na b\r\n", "$3\r\na b\r\n"},
+		{Bulk(""), `""`, `""`, "$0\r\n\r\n", "$0\r\n\r\n"},
+		{Null(), "<nil>", "null", "$-1\r\n", "_\r\n"},
+		{NullArray(), "<nil>", "null", "*-1\r\n", "_\r\n"},
+		{Array(), "empty list", "[]", "*0\r\n", "*0\r\n"},
+		{Bulks([]string{"k", "v"}), `"k", "v"`, `["k","v"]`, "*2\r\n$1\r\nk\r\n$1\r\nv\r\n",
+			"*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{Array(Integer(1), Array(Null())), "1) (int) 1, 2) <nil>", "[1,[null]]",
+			"*2\r\n:1\r\n*1\r\n$-1\r\n", "*2\r\n:1\r\n*1\r\n_\r\n"},
+		{Map(Bulk("f"), Integer(1)), `"f": (int) 1`, `{"f":1}`, "*2\r\n$1\r\nf\r\n:1\r\n",
+			"%1\r\n$1\r\nf\r\n:1\r\n"},
+		{Push(Bulk("message"), Bulk("c")), `PUSH:"message", "c"`, `{"push":["message","c"]}`,
+			"*2\r\n$7\r\nmessage\r\n$1\r\nc\r\n", ">2\r\n$7\r\nmessage\r\n$1\r\nc\r\n"},
+	}
+	for _, test := range tests {
+		for name, want := range map[string]string{"text": test.text, "json": test.json,
+			"resp2": test.resp2, "resp3": test.resp3} {
+			if encoded := Encoders[name](test.reply); encoded != want {
+				t.Errorf("%s(%#v) = %q, want %q", name, test.reply, encoded, want)
+			}
+		}
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		encoded string
+		reply   Reply
+	}{
+		{"+OK\r\n", OK},
+		{"-ERR bad thing\r\n", CodedError("ERR", "bad thing")},
+		{"-WRONGTYPE kind\r\n", CodedError("WRONGTYPE", "kind")},
+		{"-lower case\r\n", Error("lower case")},
+		{":12\r\n", Integer(12)},
+		{"$5\r\na\r\nbc\r\n", Bulk("a\r\nbc")},
+		{"$-1\r\n", Null()},
+		{"_\r\n", Null()},
+		{"*-1\r\n", NullArray()},
+		{"*0\r\n", Array()},
+		{"*2\r\n*-1\r\n$-1\r\n", Array(NullArray(), Null())},
+		{"%1\r\n$1\r\nf\r\n:1\r\n", Map(Bulk("f"), Integer(1))},
+		{">1\r\n$1\r\nx\r\n", Push(Bulk("x"))},
+	}
+	for _, test := range tests {
+		reply, err := ReadRESP(bufio.NewReader(strings.NewReader(test.encoded)))
+		if err != nil || !reflect.DeepEqual(reply, test.reply) {
+			t.Errorf("ReadRESP(%q) = %#v, %v, want %#v", test.encoded, reply, err, test.reply)
+		}
+	}
+}
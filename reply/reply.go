@@ -0,0 +1,257 @@
+package reply
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/lettuce/utils"
+)
+
+// The kinds of reply a request can have.
+type Type int
+
+const (
+	STATUS Type = iota
+	ERROR
+	INTEGER
+	BULK
+	NULL
+	ARRAY
+
+	// An array of keys each followed by its value, which RESP3 has a type of its own for.
+	MAP
+
+	// Pushed to a client without a request, like a published message.
+	PUSH
+
+	// No array at all, like the reply to an EXEC that was aborted, which RESP2 tells apart
+	// from a null bulk string.
+	NULL_ARRAY
+)
+
+// The reply to a request. Statuses hold their text in Str, errors their message in Str and
+// their code in Code, which is empty for generic errors, and bulk strings the string
+// itself, which may be any bytes at all. Arrays, maps and pushes hold their elements.
+type Reply struct {
+	Type     Type
+	Str      string
+	Code     string
+	Integer  int64
+	Elements []Reply
+}
+
+// Replies that come up all the time.
+var (
+	OK     = Status(utils.OK)
+	QUEUED = Status(utils.QUEUED)
+)
+
+func Status(status string) Reply {
+	return Reply{Type: STATUS, Str: status}
+}
+
+// Code of errors that don't have one of their own.
+const GENERIC_ERROR = "ERR"
+
+// Returns a generic error. Clients see it with the code GENERIC_ERROR in front, which the
+// message leaves out.
+func Error(message string) Reply {
+	return Reply{Type: ERROR, Str: message}
+}
+
+// Returns an error with a code of its own, like "WRONGTYPE".
+func CodedError(code string, message string) Reply {
+	return Reply{Type: ERROR, Code: code, Str: message}
+}
+
+func isCode(word string) bool {
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'A' || word[i] > 'Z' {
+			return false
+		}
+	}
+	return word != ""
+}
+
+func Integer(n int64) Reply {
+	return Reply{Type: INTEGER, Integer: n}
+}
+
+func Bulk(str string) Reply {
+	return Reply{Type: BULK, Str: str}
+}
+
+func Null() Reply {
+	return Reply{Type: NULL}
+}
+
+func NullArray() Reply {
+	return Reply{Type: NULL_ARRAY}
+}
+
+func Array(elements ...Reply) Reply {
+	if elements == nil {
+		elements = []Reply{}
+	}
+	return Reply{Type: ARRAY, Elements: elements}
+}
+
+// Returns an array of bulk strings.
+func Bulks(strs []string) Reply {
+	elements := make([]Reply, len(strs))
+	for i, str := range strs {
+		elements[i] = Bulk(str)
+	}
+	return Array(elements...)
+}
+
+func Map(elements ...Reply) Reply {
+	if elements == nil {
+		elements = []Reply{}
+	}
+	return Reply{Type: MAP, Elements: elements}
+}
+
+func Push(elements ...Reply) Reply {
+	return Reply{Type: PUSH, Elements: elements}
+}
+
+func (reply Reply) IsError() bool {
+	return reply.Type == ERROR
+}
+
+// Returns the code of an error, which is GENERIC_ERROR unless it has one of its own.
+func (reply Reply) ErrorCode() string {
+	if reply.Code == "" {
+		return GENERIC_ERROR
+	}
+	return reply.Code
+}
+
+// Returns the whole error message, code and all, as the encoders write it.
+func (reply Reply) Message() string {
+	return reply.ErrorCode() + " " + reply.Str
+}
+
+// Returns the reply as the CLI shows it.
+func (reply Reply) String() string {
+	return EncodeText(reply)
+}
+
+// Returns a reply on a single line, in a form that Unmarshal reads back as the same reply,
+// for sending between the master and the servers. Each value is a type byte like in RESP,
+// followed by its contents, and values are separated by spaces:
+//
+//	+"OK" -"WRONGTYPE" "message" -"" "generic" :5 $"bulk string" _ *2 :1 :2 *-1 %2 $"key" :1 >1 $"pushed"
+func Marshal(reply Reply) string {
+	switch reply.Type {
+	case STATUS:
+		return "+" + utils.Quote(reply.Str)
+	case ERROR:
+		return "-" + utils.Quote(reply.Code) + " " + utils.Quote(reply.Str)
+	case INTEGER:
+		return ":" + strconv.FormatInt(reply.Integer, 10)
+	case BULK:
+		return "$" + utils.Quote(reply.Str)
+	case NULL:
+		return "_"
+	case NULL_ARRAY:
+		return "*-1"
+	}
+	header := "*"
+	if reply.Type == MAP {
+		header = "%"
+	} else if reply.Type == PUSH {
+		header = ">"
+	}
+	marshaled := header + strconv.Itoa(len(reply.Elements))
+	for _, element := range reply.Elements {
+		marshaled = marshaled + " " + Marshal(element)
+	}
+	return marshaled
+}
+
+var errMalformed = errors.New("malformed reply")
+
+// Reads a reply written by Marshal.
+func Unmarshal(marshaled string) (Reply, error) {
+	reply, rest, err := unmarshal(marshaled)
+	if err == nil && rest != "" {
+		err = errMalformed
+	}
+	return reply, err
+}
+
+// Reads the value at the start of the string, and returns what's left after it.
+func unmarshal(marshaled string) (Reply, string, error) {
+	if marshaled == "" {
+		return Reply{}, "", errMalformed
+	}
+	header, rest := marshaled[0], marshaled[1:]
+
+	// Each value ends at a space, or at the end of the string.
+	next := func(rest string) string {
+		return strings.TrimPrefix(rest, " ")
+	}
+	quoted := func(rest string) (string, string, error) {
+		str, n, err := utils.Unquote(rest)
+		if err != nil {
+			return "", "", errMalformed
+		}
+		return str, next(rest[n:]), nil
+	}
+	number := func(rest string) (int64, string, error) {
+		end := strings.IndexByte(rest, ' ')
+		if end == -1 {
+			end = len(rest)
+		}
+		n, err := strconv.ParseInt(rest[:end], 10, 64)
+		if err != nil {
+			return 0, "", errMalformed
+		}
+		return n, next(rest[end:]), nil
+	}
+
+	switch header {
+	case '+':
+		str, rest, err := quoted(rest)
+		return Status(str), rest, err
+	case '-':
+		code, rest, err := quoted(rest)
+		if err != nil {
+			return Reply{}, "", err
+		}
+		str, rest, err := quoted(rest)
+		return Reply{Type: ERROR, Code: code, Str: str}, rest, err
+	case ':':
+		n, rest, err := number(rest)
+		return Integer(n), rest, err
+	case '$':
+		str, rest, err := quoted(rest)
+		return Bulk(str), rest, err
+	case '_':
+		return Null(), next(rest), nil
+	case '*', '%', '>':
+		count, rest, err := number(rest)
+		if err == nil && header == '*' && count == -1 {
+			return NullArray(), rest, nil
+		}
+		if err != nil || count < 0 || count > int64(len(rest)) {
+			return Reply{}, "", errMalformed
+		}
+		elements := make([]Reply, count)
+		for i := range elements {
+			if elements[i], rest, err = unmarshal(rest); err != nil {
+				return Reply{}, "", err
+			}
+		}
+		if header == '%' {
+			return Map(elements...), rest, nil
+		} else if header == '>' {
+			return Push(elements...), rest, nil
+		}
+		return Array(elements...), rest, nil
+	}
+	return Reply{}, "", errMalformed
+}
@@ -0,0 +1,64 @@
+package reply
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	tests := []struct {
+		reply     Reply
+		marshaled string
+	}{
+		{OK, `+"OK"`},
+		{Status("a \"quoted\" status"), `+"a \"quoted\" status"`},
+		{Error("no such function"), `-"" "no such function"`},
+		{CodedError("WRONGTYPE", "wrong kind"), `-"WRONGTYPE" "wrong kind"`},
+		{Integer(0), ":0"},
+		{Integer(-42), ":-42"},
+		{Bulk(""), `$""`},
+		{Bulk("line\nbreak \x00\xff"), "$\"line\\nbreak \\x00\xff\""},
+		{Null(), "_"},
+		{Array(), "*0"},
+		{NullArray(), "*-1"},
+		{Bulks([]string{"a", "b c"}), `*2 $"a" $"b c"`},
+		{Array(Integer(1), Null(), Array(Bulk("x"), Array())), `*3 :1 _ *2 $"x" *0`},
+		{Array(NullArray(), Null()), `*2 *-1 _`},
+		{Map(Bulk("key"), Integer(1)), `%2 $"key" :1`},
+		{Push(Bulk("message"), Bulk("news"), Bulk("x")), `>3 $"message" $"news" $"x"`},
+	}
+	for _, test := range tests {
+		marshaled := Marshal(test.reply)
+		if marshaled != test.marshaled {
+			t.Errorf("Marshal(%v) = %s, want %s", test.reply, marshaled, test.marshaled)
+		}
+		reply, err := Unmarshal(marshaled)
+		if err != nil || !reflect.DeepEqual(reply, test.reply) {
+			t.Errorf("Unmarshal(%s) = %#v, %v, want %#v", marshaled, reply, err, test.reply)
+		}
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"?",
+		"+OK",
+		`+"OK`,
+		`+"OK" extra`,
+		`-"ERR"`,
+		":",
+		":x",
+		"*",
+		"*-2",
+		"%-1",
+		"*2 :1",
+		"*99999999999 :1",
+		`%1 $"key" :1 :2`,
+	}
+	for _, marshaled := range tests {
+		if reply, err := Unmarshal(marshaled); err == nil {
+			t.Errorf("Unmarshal(%q) = %v, want an error", marshaled, reply)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package server
 
 import (
-	"errors"
+	"bufio"
 	"fmt"
 	"log"
 	"net"
@@ -9,142 +9,348 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
 
+	"github.com/eshyong/lettuce/db"
+	"github.com/eshyong/lettuce/reply"
 	"github.com/eshyong/lettuce/utils"
 )
 
+const (
+	// Most client requests or primary messages the master handles each time around its
+	// loop, which lets it forward a pipeline's requests together without starving
+	// everything else.
+	MAX_BATCH = 1024
+
+	// Replies that can wait on a session for its client to read them. The master gives up
+	// on a client that falls further behind, rather than wait on it.
+	SESSION_QUEUE = 1024
+
+	// Time the primary has to reply to the oldest request a session is waiting on, other
+	// than a blocking pop, before the request fails.
+	REQUEST_TIMEOUT = 10 * time.Second
+)
+
 type Master struct {
 	primary  net.Conn
 	backup   net.Conn
-	sessions map[string]chan<- string
+	sessions map[string]chan<- reply.Reply
+
+	// Requests queued by sessions that are in the middle of a MULTI.
+	transactions map[string][]string
+
+	// The database each session has selected. Sessions start out in the first one.
+	databases map[string]int
+
+	// Keys watched by each session, and the keys whose versions are still on their way
+	// back from the primary.
+	watches        map[string]*watchState
+	pendingWatches map[string][]string
+
+	// Replies owed to each session, in the order its requests came in, and the requests
+	// a session sent while its WATCH was on its way to the primary, which are handled once
+	// the versions are back.
+	replies map[string][]*pendingReply
+	held    map[string][]string
 
-	primaryIn  <-chan string
-	primaryOut chan<- string
+	// Requests on their way to the primary, by ID, and the ID of the last one sent.
+	inflight  map[uint64]*pendingReply
+	requestID uint64
 
-	backupIn  <-chan string
-	backupOut chan<- string
+	// Channels and patterns that sessions are subscribed to.
+	pubsub *pubsub
+
+	// Changes every time a backup is promoted, since versions only mean something to the
+	// primary that handed them out.
+	epoch uint64
+
+	primaryIn  <-chan utils.Frame
+	primaryOut chan<- utils.Frame
+
+	// Frames from the primary that were read while waiting to send to it.
+	inbox []utils.Frame
+
+	backupIn  <-chan utils.Frame
+	backupOut chan<- utils.Frame
+
+	// Servers that have connected and shaken hands, which the master makes its primary or
+	// its backup if it needs one.
+	backups chan serverConn
+
+	// A server that has been sent a PING, or a PROMOTE, and has yet to answer it. Only one
+	// server joins at a time.
+	joining *joiningServer
+
+	// When the last ping to each server was sent, or zero if it has been answered.
+	primaryPing time.Time
+	backupPing  time.Time
 
 	counter uint64
 }
 
+// A server that has connected to the master, and the channels to talk to it.
+type serverConn struct {
+	conn net.Conn
+	in   <-chan utils.Frame
+	out  chan<- utils.Frame
+}
+
+// A server that the master is waiting on to answer, and the role it's to take once it
+// does. It has until the deadline fires.
+type joiningServer struct {
+	server   serverConn
+	request  utils.FrameType
+	primary  bool
+	promoted bool
+	deadline *time.Timer
+}
+
+// The versions of the keys a session watches, as of when it watched them.
+type watchState struct {
+	epoch uint64
+	keys  []db.WatchedKey
+}
+
+// A reply owed to a session. Replies the master makes itself wait behind the ones still
+// on their way back from the primary, so that a session gets them in order.
+type pendingReply struct {
+	forwarded bool
+	done      bool
+	result    reply.Reply
+
+	// Set for a WATCH, whose reply has the versions of the keys.
+	watch bool
+
+	// For forwarded requests: the request and its ID, and when it became the oldest
+	// request the session is waiting on, which is when it starts to time out.
+	id      uint64
+	sender  string
+	request string
+	oldest  time.Time
+}
+
+// A request from a session, or word that it has opened, with the channel it reads its
+// replies from, or that its client has gone away.
+type sessionRequest struct {
+	session string
+	body    string
+	opened  chan<- reply.Reply
+	closed  bool
+}
+
+// Requests that wait as long as the client asks them to, so they never time out.
+var blockingCommands = map[string]bool{"BLPOP": true, "BRPOP": true, "BLMOVE": true}
+
+// Returns whether the session already watches a key in a database.
+func (watched *watchState) has(index int, key string) bool {
+	for _, w := range watched.keys {
+		if w.DB == index && w.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
 func NewMaster() *Master {
 	return &Master{primary: nil, backup: nil,
-		sessions:  make(map[string]chan<- string),
-		primaryIn: nil, primaryOut: nil,
-		backupIn: nil, backupOut: nil,
+		sessions: make(map[string]chan<- reply.Reply), transactions: make(map[string][]string),
+		watches: make(map[string]*watchState), pendingWatches: make(map[string][]string),
+		databases: make(map[string]int), pubsub: newPubsub(),
+		replies: make(map[string][]*pendingReply), held: make(map[string][]string),
+		inflight: make(map[uint64]*pendingReply), primaryIn: nil, primaryOut: nil,
+		backupIn: nil, backupOut: nil, backups: make(chan serverConn),
 		counter: 0}
 }
 
-// This is run if no servers are discovered on startup. Alternates between polling and sleeping.
+// Listens for servers for as long as the master runs, and waits for a primary and a
+// backup to connect. Servers that connect later take the place of one that went away.
 func (master *Master) WaitForConnections() {
 	fmt.Println("Waiting for server connections...")
 	listener, err := net.Listen("tcp", utils.DELIMITER+utils.SERVER_PORT)
 	if err != nil {
 		log.Fatal("Unable to get a socket: ", err)
 	}
-	defer listener.Close()
+	go master.acceptServers(listener)
 
-	// Wait for a primary and backup to connect.
-	for master.primary == nil {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatal("Unable to connect: ", err)
+	// The master loop attaches the servers that connect once it's running.
+	for master.primary == nil || master.backup == nil {
+		servers, joiningIn, joiningDeadline := master.serverChans()
+		select {
+		case server := <-servers:
+			master.attachServer(server)
+		case frame, ok := <-joiningIn:
+			master.handleJoining(frame, ok)
+		case <-joiningDeadline:
+			master.dropJoining("Server didn't answer the " + master.joining.request.String())
 		}
+	}
+}
 
-		// Ping the server to check if it's ok.
-		in := utils.InChanFromConn(conn, "primary")
-		out := utils.OutChanFromConn(conn, "primary")
-		err = pingServer(in, out, true)
-
+// Accepts the servers that connect to the master, and hands them to the master once
+// they've shaken hands.
+func (master *Master) acceptServers(listener net.Listener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println(err)
+			fmt.Println("Error connecting to server:", err)
 			continue
 		}
-
-		// Add backup variables to our master.
-		master.primary = conn
-		master.primaryIn = in
-		master.primaryOut = out
-		if err != nil {
-			fmt.Println(err)
+		if err = utils.Handshake(conn); err != nil {
+			fmt.Println("Handshake with the server failed:", err)
+			conn.Close()
 			continue
 		}
-		fmt.Println("Primary is running!")
+		in := utils.InFrameChanFromConn(conn, "server")
+		out := utils.OutFrameChanFromConn(conn, "server")
+		master.backups <- serverConn{conn: conn, in: in, out: out}
 	}
-	for master.backup == nil {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatal("Unable to connect: ", err)
-		}
-
-		// Ping the server to check if it's ok.
-		in := utils.InChanFromConn(conn, "backup")
-		out := utils.OutChanFromConn(conn, "backup")
-		err = pingServer(in, out, false)
+}
 
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
+// Makes a new server the primary if there isn't one, or else the backup if there isn't
+// one, once it answers. A server that isn't needed is disconnected.
+func (master *Master) attachServer(server serverConn) {
+	if master.primary != nil && master.backup != nil {
+		fmt.Println("Already have a primary and a backup, disconnecting", server.conn.RemoteAddr())
+		server.conn.Close()
+		return
+	}
+	master.join(server, master.primary == nil, false)
+}
 
-		// Add backup variables to our master.
-		master.backup = conn
-		master.backupIn = in
-		master.backupOut = out
-		fmt.Println("Backup is running!")
+// Sends a server a PROMOTE if it's to be the primary, or else a PING, which also tells it
+// which one it is. The master loop finishes attaching it when its ACK comes in, and
+// disconnects it if that takes longer than DEADLINE.
+func (master *Master) join(server serverConn, primary bool, promoted bool) {
+	request := utils.FRAME_PING
+	if primary {
+		request = utils.FRAME_PROMOTE
+	}
+	master.joining = &joiningServer{server: server, request: request, primary: primary,
+		promoted: promoted, deadline: time.NewTimer(utils.DEADLINE)}
+	select {
+	case server.out <- utils.Frame{Type: request}:
+	default:
+		master.dropJoining("Server isn't reading, couldn't send the " + request.String())
+	}
+}
 
-		master.backupOut <- utils.SYNDEL + utils.PRIMARY + utils.EQUALS + master.primary.RemoteAddr().String()
+// Returns the channels the master waits on for servers: the one new servers come in on,
+// and the ones the joining server's answer and its deadline come in on. The first is nil
+// while a server is joining, and the others are nil while none is.
+func (master *Master) serverChans() (<-chan serverConn, <-chan utils.Frame, <-chan time.Time) {
+	if master.joining == nil {
+		return master.backups, nil, nil
 	}
+	return nil, master.joining.server.in, master.joining.deadline.C
 }
 
-func (master *Master) checkServers() {
-	fmt.Println("Checking server status...")
-	master.primary.SetDeadline(time.Now().Add(utils.DEADLINE))
-	err := pingServer(master.primaryIn, master.primaryOut, false)
-	if err != nil {
-		// TODO: promote backup
-		log.Fatal("checkServers() failed: primary")
+// Returns whether the master is waiting on the backup to take over as the primary.
+func (master *Master) promoting() bool {
+	return master.joining != nil && master.joining.promoted
+}
+
+// Handles the joining server's answer to its PING or PROMOTE, which makes it the primary
+// or the backup if it's an ACK. The server has disconnected if ok is false.
+func (master *Master) handleJoining(frame utils.Frame, ok bool) {
+	if !ok {
+		master.dropJoining("Connection error")
+		return
+	} else if frame.Type == utils.FRAME_ERROR {
+		master.dropJoining("Request rejected: " + string(frame.Payload))
+		return
+	} else if frame.Type != utils.FRAME_ACK {
+		master.dropJoining("Invalid protocol")
+		return
 	}
-	master.primary.SetDeadline(utils.NO_DEADLINE)
-	fmt.Println("Primary is fine! Pinging backup...")
+	joining := master.joining
+	joining.deadline.Stop()
+	master.joining = nil
+	server := joining.server
 
-	master.backup.SetDeadline(time.Now().Add(utils.DEADLINE))
-	err = pingServer(master.backupIn, master.backupOut, false)
-	if err != nil {
-		// TODO: Wait for backup
-		log.Fatal("checkServers() failed: backup")
+	if joining.primary {
+		master.primary = server.conn
+		master.primaryIn = server.in
+		master.primaryOut = server.out
+		master.primaryPing = time.Time{}
+		if joining.promoted {
+			fmt.Println("Promotion success!")
+			master.epoch++
+			master.failForwarded()
+		} else {
+			fmt.Println("Primary is running!")
+		}
+		return
+	}
+	if master.primary == nil {
+		// The primary went away while the server was joining, so it takes its place.
+		master.join(server, true, false)
+		return
 	}
-	master.backup.SetDeadline(utils.NO_DEADLINE)
-	fmt.Println("Backup is fine!")
+	master.backup = server.conn
+	master.backupIn = server.in
+	master.backupOut = server.out
+	master.backupPing = time.Time{}
+	fmt.Println("Backup is running!")
+
+	master.sendBackup(primaryFrame(master.primary))
 }
 
-// Check server's status by sending a short message.
-func pingServer(in <-chan string, out chan<- string, primary bool) error {
-	request := utils.STATUS
-	if primary {
-		request = utils.PROMOTE
+// Disconnects the joining server, which didn't answer like it should have.
+func (master *Master) dropJoining(reason string) {
+	joining := master.joining
+	master.joining = nil
+	joining.deadline.Stop()
+	joining.server.conn.Close()
+	if !joining.promoted {
+		fmt.Println(reason)
+		return
 	}
 
-	// Send a STATUS message.
-	out <- utils.SYNDEL + request
-	message, ok := <-in
-	if !ok {
-		return errors.New("Connection error")
-	}
-	fmt.Println("message:", message)
+	// The backup is gone as well, so wait for servers like there never was one.
+	fmt.Println("Promotion failed:", reason)
+	master.failForwarded()
+}
 
-	arr := strings.Split(message, utils.DELIMITER)
-	header, body := arr[0], arr[1]
-	if header != utils.ACK {
-		return errors.New("Invalid protocol")
+// Pings the servers, which answer in between their other messages. A server that still
+// hasn't answered the last ping has failed, and is disconnected, which the master loop
+// handles like any other disconnection.
+func (master *Master) checkServers() {
+	fmt.Println("Checking server status...")
+	if master.primary != nil {
+		if master.primaryPing.IsZero() {
+			master.toPrimary(utils.Frame{Type: utils.FRAME_PING})
+			master.primaryPing = time.Now()
+		} else if time.Since(master.primaryPing) > utils.DEADLINE {
+			fmt.Println("checkServers() failed: primary")
+			master.primary.Close()
+		}
+	}
+	if master.backup != nil {
+		if master.backupPing.IsZero() {
+			master.sendBackup(utils.Frame{Type: utils.FRAME_PING})
+			master.backupPing = time.Now()
+		} else if time.Since(master.backupPing) > utils.DEADLINE {
+			fmt.Println("checkServers() failed: backup")
+			master.backup.Close()
+		}
 	}
+}
 
-	// Hopefully receive an "OK" in response.
-	if body != utils.OK {
-		return errors.New("Request rejected.")
+// Sends a frame to the backup, unless it's stuck, which the next ping finds out.
+func (master *Master) sendBackup(frame utils.Frame) {
+	select {
+	case master.backupOut <- frame:
+	default:
+		fmt.Println("Backup isn't keeping up, dropped:", frame)
 	}
-	return nil
+}
+
+// Tells a backup where the primary is, so it can connect to it.
+func primaryFrame(primary net.Conn) utils.Frame {
+	return utils.Frame{Type: utils.FRAME_PRIMARY, Payload: []byte(primary.RemoteAddr().String())}
 }
 
 // Serves any number of clients. TODO: load test.
@@ -166,95 +372,498 @@ func (master *Master) Serve() {
 		conn, err := listener.Accept()
 		if err != nil {
 			fmt.Println(err)
+			continue
 		}
 		fmt.Println("client connected on address", conn.LocalAddr())
 
 		// Create a new session ID, and add the session to our multiplexer set.
 		id := utils.CLIENT + strconv.FormatUint(master.counter, 10)
-		master.sessions[id] = session(conn, mux, id)
+		session(conn, mux, id)
 		master.counter += 1
 	}
 }
 
 // Creates a multiplexer for all client sessions to write to. Dispatches to the primary
-// server, and determines which session channel to write back to.
-func (master *Master) funnelRequests() chan<- string {
-	multiplexer := make(chan string)
+// server, and determines which session channel to write back to. The loop waits on
+// whatever happens next, and health checks happen on a ticker of their own.
+func (master *Master) funnelRequests() chan<- sessionRequest {
+	multiplexer := make(chan sessionRequest, MAX_BATCH)
 	signaler := master.handleSignals()
 	go func() {
 		defer close(multiplexer)
-		begin := time.Now()
-	loop:
+		health := time.NewTicker(utils.WAIT_PERIOD)
+		defer health.Stop()
+		expiry := time.NewTicker(REQUEST_TIMEOUT / 10)
+		defer expiry.Stop()
 		for {
-			elapsed := time.Since(begin)
+			if !master.drainPrimary() {
+				// Primary disconnected.
+				master.promoteBackup()
+				continue
+			}
+			// Requests wait while the backup takes over, since they'd only fail without
+			// a primary.
+			requests := (<-chan sessionRequest)(multiplexer)
+			if master.promoting() {
+				requests = nil
+			}
+			servers, joiningIn, joiningDeadline := master.serverChans()
 			select {
-			case request := <-multiplexer:
+			case request := <-requests:
+				// Pipelined requests are all handled at once.
 				master.handleClientRequest(request)
+				master.drainRequests(multiplexer)
 			case reply, ok := <-master.primaryIn:
 				// Get a server reply, and determine which session to send to.
 				if !ok {
 					// Primary disconnected.
 					master.promoteBackup()
-					goto longsleep
+					continue
 				}
 				master.handlePrimaryIn(reply)
+			case frame, ok := <-master.backupIn:
+				master.handleBackupIn(frame, ok)
+			case server := <-servers:
+				master.attachServer(server)
+			case frame, ok := <-joiningIn:
+				master.handleJoining(frame, ok)
+			case <-joiningDeadline:
+				master.dropJoining("Server didn't answer the " + master.joining.request.String())
+			case <-health.C:
+				// Ping servers and make sure they're up.
+				master.checkServers()
+			case <-expiry.C:
+				master.expireRequests()
 			case signal := <-signaler:
 				fmt.Println(signal, "received.")
 				master.shutdown()
-			default:
-				// Ping servers and make sure they're up.
-				if elapsed > utils.WAIT_PERIOD {
-					master.checkServers()
-					begin = time.Now()
-				}
 			}
-			time.Sleep(50 * time.Millisecond)
 		}
-	longsleep:
-		time.Sleep(time.Second)
-		goto loop
 	}()
 	return multiplexer
 }
 
+// Handles the client requests that are already waiting, up to MAX_BATCH of them.
+func (master *Master) drainRequests(multiplexer <-chan sessionRequest) {
+	for i := 1; i < MAX_BATCH; i++ {
+		select {
+		case request := <-multiplexer:
+			master.handleClientRequest(request)
+		default:
+			return
+		}
+	}
+}
+
+// Handles the messages from the primary that were read while sending to it, and then
+// the ones waiting on the channel, up to MAX_BATCH of them. Returns false if the primary
+// has disconnected.
+func (master *Master) drainPrimary() bool {
+	for i := 0; i < MAX_BATCH || len(master.inbox) > 0; i++ {
+		if len(master.inbox) > 0 {
+			message := master.inbox[0]
+			master.inbox = master.inbox[1:]
+			master.handlePrimaryIn(message)
+			continue
+		}
+		select {
+		case frame, ok := <-master.primaryIn:
+			if !ok {
+				return false
+			}
+			master.handlePrimaryIn(frame)
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// Sends a frame to the primary. The primary may be blocked on sending us replies in the
+// meantime, so they're read into the inbox until the frame goes through.
+func (master *Master) toPrimary(frame utils.Frame) {
+	for {
+		select {
+		case master.primaryOut <- frame:
+			return
+		case reply, ok := <-master.primaryIn:
+			if !ok {
+				// The frame is lost along with the primary.
+				return
+			}
+			master.inbox = append(master.inbox, reply)
+		}
+	}
+}
+
 // Send any sessions request to the server.
-func (master *Master) handleClientRequest(request string) {
-	// Check if message is in a valid format.
-	arr := strings.Split(request, utils.DELIMITER)
-	if len(arr) < 2 {
-		fmt.Println("Invalid request", arr)
+func (master *Master) handleClientRequest(request sessionRequest) {
+	sender, body := request.session, request.body
+	if request.opened != nil {
+		// A new client connected.
+		master.sessions[sender] = request.opened
 		return
 	}
-	sender, body := arr[0], arr[1]
-	if body == utils.CLOSED {
+	if request.closed {
 		// One of our client connections closed, delete the mapped value.
-		delete(master.sessions, sender)
-	} else if strings.ToUpper(body) == utils.SHUTDOWN {
+		master.removeSession(sender)
+		return
+	}
+	if _, in := master.sessions[sender]; !in {
+		// The session closed after sending this, and there's no one to reply to.
+		return
+	}
+	if _, waiting := master.pendingWatches[sender]; waiting {
+		// A transaction after the WATCH needs the versions of the keys.
+		master.held[sender] = append(master.held[sender], body)
+		return
+	}
+
+	// Requests the master handles itself are split into arguments here. The primary
+	// splits the others the same way.
+	args, err := utils.SplitArgs(body)
+	if err != nil {
+		master.send(sender, reply.Error(err.Error()))
+	} else if master.handlePubsub(sender, args) {
+		// Published, or (un)subscribed.
+	} else if master.handleSelect(sender, args) {
+		// Selected another database for the session.
+	} else if master.handleTransaction(sender, body, args) {
+		// Queued, or part of MULTI/EXEC/DISCARD/WATCH.
+	} else if len(args) == 1 && strings.ToUpper(args[0]) == utils.SHUTDOWN {
 		// Client has requested that we shutdown the server.
 		master.shutdown()
 	} else {
 		// Otherwise send it out to the server.
-		master.primaryOut <- request
+		master.forward(sender, body, false)
 	}
 }
 
-func (master *Master) handlePrimaryIn(reply string) {
-	// Check if message is in a valid format.
-	arr := strings.Split(reply, utils.DELIMITER)
-	if len(arr) < 2 {
-		fmt.Println("Invalid reply", arr)
+// Forgets about a session, and closes it if it's still open.
+func (master *Master) removeSession(sender string) {
+	if channel, in := master.sessions[sender]; in {
+		close(channel)
+	}
+	delete(master.sessions, sender)
+	delete(master.transactions, sender)
+	delete(master.databases, sender)
+	delete(master.watches, sender)
+	delete(master.pendingWatches, sender)
+	for _, pending := range master.replies[sender] {
+		if pending.forwarded {
+			delete(master.inflight, pending.id)
+		}
+	}
+	delete(master.replies, sender)
+	delete(master.held, sender)
+	master.pubsub.remove(sender)
+
+	// The primary drops the session if it's waiting on a blocking pop.
+	if master.primaryOut != nil {
+		master.toPrimary(utils.Frame{Type: utils.FRAME_CLOSED, Payload: []byte(sender)})
+	}
+}
+
+// Queues a reply or a push on a session, if it's still there. A client that has let its
+// queue fill up is disconnected, and false is returned.
+func (master *Master) push(sender string, result reply.Reply) bool {
+	channel, in := master.sessions[sender]
+	if !in {
+		return false
+	}
+	select {
+	case channel <- result:
+		return true
+	default:
+		fmt.Println("Disconnecting", sender+", which isn't reading its replies")
+		master.removeSession(sender)
+		return false
+	}
+}
+
+// Replies to a session's request, once the replies to its earlier requests have been sent.
+func (master *Master) send(sender string, result reply.Reply) {
+	master.replies[sender] = append(master.replies[sender], &pendingReply{done: true, result: result})
+	master.deliver(sender)
+}
+
+// Sends a session the replies at the front of its queue that are ready, or drops the queue
+// if the session has gone.
+func (master *Master) deliver(sender string) {
+	queue := master.replies[sender]
+	for len(queue) > 0 && queue[0].done {
+		if !master.push(sender, queue[0].result) {
+			delete(master.replies, sender)
+			return
+		}
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(master.replies, sender)
+	} else {
+		master.replies[sender] = queue
+	}
+}
+
+// Sends a session's request to the primary in an envelope with an ID of its own, along
+// with the database the session has selected. The request fails right away if there's no
+// primary to send it to.
+func (master *Master) forward(sender string, body string, watch bool) {
+	master.requestID++
+	pending := &pendingReply{forwarded: true, watch: watch, id: master.requestID, sender: sender,
+		request: body}
+	master.replies[sender] = append(master.replies[sender], pending)
+	if master.primaryOut == nil {
+		master.finish(sender, pending, reply.Error("no primary to send the request to"))
 		return
 	}
+	master.inflight[pending.id] = pending
+	envelope := utils.Envelope{ID: pending.id, Session: sender, DB: master.databases[sender], Body: body}
+	master.toPrimary(envelope.Frame(utils.FRAME_REQUEST))
+}
+
+// Fails every request that was waiting on the old primary, once there's a new one.
+func (master *Master) failForwarded() {
+	// Failing a WATCH sends the requests held behind it to the new primary, so the lost
+	// requests are set aside first.
+	lost := master.inflight
+	master.inflight = make(map[uint64]*pendingReply)
+	for _, pending := range lost {
+		master.finish(pending.sender, pending, reply.Error("primary went away before replying"))
+	}
+}
+
+// Fails the requests that have been the oldest one their session is waiting on for longer
+// than REQUEST_TIMEOUT. Requests behind a blocking pop wait on it rather than on the
+// primary, so they only start to time out once it returns.
+func (master *Master) expireRequests() {
+	now := time.Now()
+	expired := make([]*pendingReply, 0)
+	for _, queue := range master.replies {
+		for _, pending := range queue {
+			if !pending.forwarded || pending.done {
+				continue
+			}
+			if pending.oldest.IsZero() {
+				pending.oldest = now
+			} else if now.Sub(pending.oldest) > REQUEST_TIMEOUT && !waitsForever(pending.request) {
+				expired = append(expired, pending)
+			}
+			break
+		}
+	}
+	for _, pending := range expired {
+		fmt.Println("Request", pending.id, "from", pending.sender, "timed out")
+		master.finish(pending.sender, pending, reply.Error("timed out waiting on the primary"))
+	}
+}
 
-	header, body := arr[0], arr[1]
-	if strings.Contains(header, utils.CLIENT) {
-		// clientID:reply -> "send reply to CLIENT#"
-		if channel, in := master.sessions[header]; in {
-			channel <- body
+// Returns whether a request is a blocking pop, which is up to the primary to time out.
+func waitsForever(request string) bool {
+	end := strings.IndexFunc(request, unicode.IsSpace)
+	if end == -1 {
+		end = len(request)
+	}
+	return blockingCommands[strings.ToUpper(request[:end])]
+}
+
+// Fills in a reply from the primary, and sends it once it's the session's turn.
+func (master *Master) finish(sender string, pending *pendingReply, result reply.Reply) {
+	delete(master.inflight, pending.id)
+	if pending.watch {
+		result = master.finishWatch(sender, master.pendingWatches[sender], result)
+	}
+	pending.result, pending.done = result, true
+	master.deliver(sender)
+	if pending.watch {
+		// Handle what the session sent while it waited on the versions.
+		held := master.held[sender]
+		delete(master.held, sender)
+		for _, body := range held {
+			master.handleClientRequest(sessionRequest{session: sender, body: body})
 		}
+	}
+}
+
+// Handles "SELECT db", which only changes the database that the session's later requests
+// are sent along with. Returns false if the request isn't a SELECT.
+func (master *Master) handleSelect(sender string, fields []string) bool {
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != utils.SELECT {
+		return false
+	}
+	result := reply.OK
+	if _, inMulti := master.transactions[sender]; inMulti {
+		result = reply.Error("SELECT inside MULTI is not allowed")
+	} else if len(fields) != 2 {
+		result = reply.Error("wrong number of arguments for \"SELECT\", expected 1")
+	} else if index, err := strconv.Atoi(fields[1]); err != nil || index < 0 || index >= db.DATABASES {
+		result = reply.Error(db.DB_OUT_OF_RANGE)
 	} else {
-		fmt.Println("Unknown protocol message:", reply)
-		master.primaryOut <- utils.ERRDEL + utils.UNKNOWN
+		master.databases[sender] = index
+	}
+	master.send(sender, result)
+	return true
+}
+
+// Queues requests between MULTI and EXEC, and sends them to the primary as a single
+// transaction on EXEC, along with the versions of any watched keys. Returns false if the
+// request isn't part of a transaction.
+func (master *Master) handleTransaction(sender string, body string, fields []string) bool {
+	queue, inMulti := master.transactions[sender]
+	fail := func(message string) {
+		master.send(sender, reply.Error(message))
+	}
+
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case utils.WATCH:
+		if inMulti {
+			fail("WATCH inside MULTI is not allowed")
+		} else if len(fields) < 2 {
+			fail("wrong number of arguments for \"WATCH\", expected at least 1")
+		} else {
+			// The primary replies with the current version of each key.
+			keys := fields[1:]
+			master.pendingWatches[sender] = keys
+			master.forward(sender, utils.JoinArgs(append([]string{utils.WATCH}, keys...)...), true)
+		}
+	case utils.UNWATCH:
+		if inMulti {
+			// Queued like any other request, so the replies line up.
+			return master.queue(sender, body)
+		}
+		delete(master.watches, sender)
+		master.send(sender, reply.OK)
+	case utils.MULTI:
+		if inMulti {
+			fail("MULTI calls can not be nested")
+		} else {
+			master.transactions[sender] = make([]string, 0)
+			master.send(sender, reply.OK)
+		}
+	case utils.EXEC:
+		if !inMulti {
+			fail("EXEC without MULTI")
+			break
+		}
+
+		// EXEC always forgets the watched keys, whether or not the transaction runs.
+		watched, watching := master.watches[sender]
+		delete(master.transactions, sender)
+		delete(master.watches, sender)
+		if !watching {
+			master.forward(sender, db.Batch(queue), false)
+		} else if watched.epoch != master.epoch {
+			// The primary has changed since, so there's no telling what happened to the keys.
+			master.send(sender, reply.NullArray())
+		} else {
+			master.forward(sender, db.WatchedBatch(queue, watched.keys), false)
+		}
+	case utils.DISCARD:
+		if !inMulti {
+			fail("DISCARD without MULTI")
+		} else {
+			delete(master.transactions, sender)
+			delete(master.watches, sender)
+			master.send(sender, reply.OK)
+		}
+	default:
+		if !inMulti {
+			return false
+		}
+		return master.queue(sender, body)
+	}
+	return true
+}
+
+// Adds a request to a session's transaction.
+func (master *Master) queue(sender string, body string) bool {
+	master.transactions[sender] = append(master.transactions[sender], body)
+	master.send(sender, reply.QUEUED)
+	return true
+}
+
+// Records the versions the primary sent back for a session's WATCH, in the database the
+// session has selected.
+func (master *Master) finishWatch(sender string, keys []string, result reply.Reply) reply.Reply {
+	delete(master.pendingWatches, sender)
+	versions := result.Elements
+	if result.Type != reply.ARRAY || len(versions) != len(keys) {
+		// Not a list of versions, but an error.
+		return result
+	}
+	watched, in := master.watches[sender]
+	if !in || watched.epoch != master.epoch {
+		watched = &watchState{epoch: master.epoch}
+		master.watches[sender] = watched
+	}
+	index := master.databases[sender]
+	for i, key := range keys {
+		if versions[i].Type != reply.INTEGER {
+			return result
+		}
+		if !watched.has(index, key) {
+			// Watching a key twice keeps the version from the first time.
+			version := uint64(versions[i].Integer)
+			watched.keys = append(watched.keys, db.WatchedKey{DB: index, Key: key, Version: version})
+		}
+	}
+	return reply.OK
+}
+
+func (master *Master) handlePrimaryIn(frame utils.Frame) {
+	switch frame.Type {
+	case utils.FRAME_ACK:
+		// The primary answered its ping.
+		master.primaryPing = time.Time{}
+	case utils.FRAME_PUBLISH:
+		// A keyspace event to publish: the channel and the message.
+		if event, err := utils.UnpackFields(frame.Payload); err == nil && len(event) == 2 {
+			master.publish(event[0], event[1])
+		}
+	case utils.FRAME_REPLY:
+		// Send the reply to the session that sent the request with the same ID.
+		envelope, err := utils.EnvelopeFromFrame(frame)
+		if err != nil {
+			fmt.Println("Invalid reply", frame)
+			return
+		}
+		pending, in := master.inflight[envelope.ID]
+		if !in || pending.sender != envelope.Session {
+			// The session has gone away, or the request timed out.
+			fmt.Println("Dropping the reply to request", envelope.ID, "from", envelope.Session)
+			return
+		}
+		result, err := reply.Unmarshal(envelope.Body)
+		if err != nil {
+			fmt.Println("Invalid reply", envelope.Body)
+			result = reply.Error("invalid reply from the primary")
+		}
+		master.finish(pending.sender, pending, result)
+	case utils.FRAME_ERROR:
+		// Errors aren't answered, so that two nodes can't keep answering each other's.
+		fmt.Println("Error from the primary:", frame)
+		if pending, in := master.inflight[frame.ID]; in {
+			master.finish(pending.sender, pending, reply.Error("primary rejected the request"))
+		}
+	default:
+		fmt.Println("Unknown protocol message:", frame)
+		master.toPrimary(utils.ErrorFrame(frame.ID, utils.UNKNOWN))
+	}
+}
+
+// Handles a frame from the backup, which only ever answers pings. The backup has
+// disconnected if ok is false.
+func (master *Master) handleBackupIn(frame utils.Frame, ok bool) {
+	if !ok {
+		fmt.Println("Backup disconnected.")
+		master.waitForBackup()
+	} else if frame.Type == utils.FRAME_ACK {
+		master.backupPing = time.Time{}
+	} else {
+		fmt.Println("Unknown message from backup:", frame)
 	}
 }
 
@@ -263,67 +872,33 @@ func (master *Master) promoteBackup() {
 	master.primary = nil
 	master.primaryIn = nil
 	master.primaryOut = nil
+	master.inbox = nil
+	master.primaryPing = time.Time{}
 
-	// Completely borked.
+	// Completely borked. The next server to connect becomes the primary, and requests
+	// fail until then.
 	if master.backup == nil {
-		master.WaitForConnections()
+		fmt.Println("No backup to promote, waiting for servers...")
+		master.failForwarded()
 		return
 	}
 
-	// Send a message and wait for a response.
+	// The backup takes over once it answers the PROMOTE, and the next server to connect
+	// takes its place.
 	fmt.Println("Promoting backup...")
-	err := pingServer(master.backupIn, master.backupOut, true)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Switch everything primary to backup.
-	fmt.Println("Promotion success!")
-	master.primary = master.backup
-	master.primaryIn = master.backupIn
-	master.primaryOut = master.backupOut
-
-	// Wait for backup to come online.
-	go master.waitForBackup()
+	backup := serverConn{conn: master.backup, in: master.backupIn, out: master.backupOut}
+	master.waitForBackup()
+	master.join(backup, true, true)
 }
 
+// Forgets the backup. The next server to connect takes its place.
 func (master *Master) waitForBackup() {
 	// Clean up old references.
 	master.backup = nil
 	master.backupIn = nil
 	master.backupOut = nil
-
+	master.backupPing = time.Time{}
 	fmt.Println("Waiting for backups...")
-	listener, err := net.Listen("tcp", utils.DELIMITER+utils.SERVER_PORT)
-	if err != nil {
-		log.Fatal("Unable to get a socket: ", err)
-	}
-	defer listener.Close()
-
-	// Wait for a backup server to connect.
-	for master.backup == nil {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("Error connecting to backup:", err)
-			continue
-		}
-
-		in := utils.InChanFromConn(conn, "backup")
-		out := utils.OutChanFromConn(conn, "backup")
-
-		err = pingServer(in, out, false)
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
-
-		master.backupOut <- utils.SYNDEL + utils.PRIMARY + utils.EQUALS + master.primary.RemoteAddr().String()
-
-		fmt.Println("Backup is up!")
-		master.backup = conn
-		master.backupIn = in
-		master.backupOut = out
-	}
 }
 
 // Handles SIGINT and SIGKILL, shutting down gracefully.
@@ -334,47 +909,126 @@ func (master *Master) handleSignals() <-chan os.Signal {
 }
 
 // Client session: gets input from client and sends it to a channel to the master.
-// Each session has its own socket connection.
-func session(client net.Conn, mux chan<- string, id string) chan<- string {
-	session := make(chan string)
+// Each session has its own socket connection, and speaks either RESP or plain text.
+func session(client net.Conn, mux chan<- sessionRequest, id string) {
+	// The master loop is the only one to touch its sessions, so it's told about the new
+	// one on the same channel as the requests, ahead of any of them.
+	session := make(chan reply.Reply, SESSION_QUEUE)
+	mux <- sessionRequest{session: id, opened: session}
 	go func() {
-		// Get IO from client user.
-		clientIn := utils.InChanFromConn(client, "client")
-		clientOut := utils.OutChanFromConn(client, "client")
-		defer client.Close()
-		defer close(clientOut)
-
-		// TODO: associate client IDs for each session.
-	loop:
-		for {
-			// Shuttle data between server and client.
-			select {
-			case request, ok := <-clientIn:
-				if !ok {
-					break loop
-				}
-				// Request format "ID:request".
-				request = id + utils.DELIMITER + request
-				fmt.Println("request:", request)
-				mux <- request
-			case reply, ok := <-session:
-				if !ok {
-					break loop
+		// RESP requests start with an array, which plain text requests never do. Either
+		// way the master sees text requests, so it doesn't have to know which it is.
+		reader := bufio.NewReader(client)
+		if first, err := reader.Peek(1); err == nil && first[0] == RESP_ARRAY {
+			respSession(client, reader, mux, id, session)
+		} else {
+			textSession(bufferedConn{client, reader}, mux, id, session)
+		}
+	}()
+}
+
+// A connection that reads through a buffer, which may already hold what was peeked at.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// Encodings a plain text session can switch to with FORMAT. RESP has a line break after
+// each value, so it's only for RESP sessions.
+var textFormats = map[string]bool{"text": true, "json": true}
+
+// Serves a client that sends a request on each line, and reads the reply on the next.
+// Replies are encoded as text, or as JSON after "FORMAT json".
+func textSession(client net.Conn, mux chan<- sessionRequest, id string, session <-chan reply.Reply) {
+	// Get IO from client user.
+	clientIn := utils.InChanFromConn(client, "client")
+	clientOut := utils.OutChanFromConn(client, "client")
+
+	// FORMAT requests never reach the master, since the writer is the one that encodes. The
+	// reader waits on each one until the writer has sent the replies to the requests before
+	// it, and then answered it, so that each reply is encoded the way it was asked for.
+	formats := make(chan []string)
+	formatted := make(chan struct{})
+	done := make(chan struct{})
+	var outstanding int32
+
+	// Requests and replies are shuttled separately, so that the master can always push a
+	// message to the client, even while the session waits to hand it a request.
+	go func() {
+		for request := range clientIn {
+			if args, err := utils.SplitArgs(request); err == nil && len(args) > 0 &&
+				strings.ToUpper(args[0]) == utils.FORMAT {
+				select {
+				case formats <- args[1:]:
+					<-formatted
+				case <-done:
 				}
-				// No demarshaling required on the client side.
-				clientOut <- reply
+				continue
 			}
+			fmt.Println("request:", id, request)
+			atomic.AddInt32(&outstanding, 1)
+			mux <- sessionRequest{session: id, body: request}
 		}
-		mux <- id + utils.DELIMITER + utils.CLOSED
+		mux <- sessionRequest{session: id, closed: true}
 	}()
-	return session
+
+	defer client.Close()
+	defer close(clientOut)
+	defer close(done)
+
+	encode := reply.EncodeText
+	var format []string
+	for {
+		// A FORMAT waits for the replies before it, and nothing else comes in meanwhile.
+		incoming := formats
+		if format != nil {
+			incoming = nil
+		}
+		select {
+		case args := <-incoming:
+			format = args
+		case result, ok := <-session:
+			// The master closes the session once the client is gone.
+			if !ok {
+				return
+			}
+			if result.Type != reply.PUSH {
+				atomic.AddInt32(&outstanding, -1)
+			}
+			clientOut <- encode(result)
+		}
+		if format == nil || atomic.LoadInt32(&outstanding) > 0 {
+			continue
+		}
+		if len(format) != 1 {
+			clientOut <- encode(reply.Error("wrong number of arguments for \"FORMAT\", expected 1"))
+		} else if name := strings.ToLower(format[0]); !textFormats[name] {
+			clientOut <- encode(reply.Error("unknown format '" + format[0] + "'"))
+		} else {
+			encode = reply.Encoders[name]
+			clientOut <- encode(reply.OK)
+		}
+		format = nil
+		formatted <- struct{}{}
+	}
 }
 
 func (master *Master) shutdown() {
 	// Close sockets and exit.
 	fmt.Println("Shutting down gracefully...")
-	master.primary.Close()
-	master.backup.Close()
+	if master.primary != nil {
+		master.primary.Close()
+	}
+	if master.backup != nil {
+		master.backup.Close()
+	}
+	if master.joining != nil {
+		master.joining.server.conn.Close()
+	}
 
 	os.Exit(0)
 }
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Runs a master loop whose primary answers every request with OK, and returns the
+// channel that sessions send their requests on.
+func startMaster(tb testing.TB) chan<- sessionRequest {
+	master := NewMaster()
+	primaryIn := make(chan utils.Frame, utils.CHANNEL_BUFFER)
+	primaryOut := make(chan utils.Frame, utils.CHANNEL_BUFFER)
+	conn, other := net.Pipe()
+	tb.Cleanup(func() { other.Close() })
+	master.primary, master.primaryIn, master.primaryOut = conn, primaryIn, primaryOut
+
+	go func() {
+		for frame := range primaryOut {
+			switch frame.Type {
+			case utils.FRAME_REQUEST:
+				envelope, _ := utils.EnvelopeFromFrame(frame)
+				envelope.Body = reply.Marshal(reply.OK)
+				primaryIn <- envelope.Frame(utils.FRAME_REPLY)
+			case utils.FRAME_PING:
+				primaryIn <- utils.Frame{Type: utils.FRAME_ACK, ID: frame.ID}
+			}
+		}
+	}()
+	return master.funnelRequests()
+}
+
+// Measures the time from a client sending a request to it reading the reply, through a
+// text session and the master, with a primary that answers right away. With pipelining,
+// the client sends a batch of requests before reading their replies.
+//
+//	go test -run '^$' -bench Master ./server/
+func BenchmarkMasterRequest(b *testing.B) {
+	// The sessions log every request, which would swamp the results.
+	stdout := os.Stdout
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = devNull
+		defer func() { os.Stdout = stdout; devNull.Close() }()
+	}
+
+	for _, pipeline := range []int{1, 16, 128} {
+		b.Run("P="+strconv.Itoa(pipeline), func(b *testing.B) {
+			mux := startMaster(b)
+			client, conn := net.Pipe()
+			defer client.Close()
+			session(conn, mux, utils.CLIENT+"0")
+			reader := bufio.NewReader(client)
+			batch := []byte(strings.Repeat("SET key value\n", pipeline))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += pipeline {
+				if _, err := client.Write(batch); err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < pipeline; j++ {
+					if line, err := reader.ReadString('\n'); err != nil || line != "OK\n" {
+						b.Fatalf("read %q, %v", line, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Returns a master whose primary is played by the test, which reads the frames the master
+// sends it from the returned channel, and answers with handlePrimaryIn.
+func newTestMaster() (*Master, <-chan utils.Frame) {
+	master := NewMaster()
+	requests := make(chan utils.Frame, utils.CHANNEL_BUFFER)
+	master.primaryOut = requests
+	return master, requests
+}
+
+// Opens a session on a test master, and returns the channel its replies go to.
+func openSession(master *Master, id string) <-chan reply.Reply {
+	session := make(chan reply.Reply, SESSION_QUEUE)
+	master.handleClientRequest(sessionRequest{session: id, opened: session})
+	return session
+}
+
+// Returns the next request the master sent the primary.
+func nextRequest(t *testing.T, requests <-chan utils.Frame) utils.Envelope {
+	t.Helper()
+	select {
+	case frame := <-requests:
+		envelope, err := utils.EnvelopeFromFrame(frame)
+		if frame.Type != utils.FRAME_REQUEST || err != nil {
+			t.Fatalf("expected a request, got %v", frame)
+		}
+		return envelope
+	default:
+		t.Fatal("no request was sent to the primary")
+	}
+	return utils.Envelope{}
+}
+
+// Returns the primary's reply to a request.
+func replyFrame(request utils.Envelope, result reply.Reply) utils.Frame {
+	request.Body = reply.Marshal(result)
+	return request.Frame(utils.FRAME_REPLY)
+}
+
+// Checks the replies a session has been sent so far, in the order it was sent them.
+func expectReplies(t *testing.T, session <-chan reply.Reply, want ...string) {
+	t.Helper()
+	got := make([]string, 0)
+	for len(session) > 0 {
+		got = append(got, (<-session).String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replies = %q, want %q", got, want)
+	}
+}
+
+func TestPipelinedRepliesInOrder(t *testing.T) {
+	master, requests := newTestMaster()
+	first, second := openSession(master, "CLI0"), openSession(master, "CLI1")
+
+	// Both sessions pipeline their requests, which go out to the primary interleaved.
+	for _, request := range []sessionRequest{
+		{session: "CLI0", body: "GET a"},
+		{session: "CLI1", body: "GET x"},
+		{session: "CLI0", body: "MULTI"},
+		{session: "CLI0", body: "GET b"},
+		{session: "CLI1", body: "GET y"},
+		{session: "CLI0", body: "DISCARD"},
+		{session: "CLI0", body: "GET c"},
+	} {
+		master.handleClientRequest(request)
+	}
+	getA, getX, getY, getC := nextRequest(t, requests), nextRequest(t, requests),
+		nextRequest(t, requests), nextRequest(t, requests)
+	if getA.Body != "GET a" || getX.Body != "GET x" || getY.Body != "GET y" || getC.Body != "GET c" {
+		t.Fatalf("requests = %q, %q, %q, %q", getA.Body, getX.Body, getY.Body, getC.Body)
+	}
+
+	// The master's own replies to MULTI, the queued GET and DISCARD wait behind GET a.
+	expectReplies(t, first)
+
+	// The primary replies in whatever order it likes, and each session gets its replies in
+	// the order it sent the requests.
+	master.handlePrimaryIn(replyFrame(getC, reply.Bulk("c")))
+	master.handlePrimaryIn(replyFrame(getY, reply.Bulk("y")))
+	expectReplies(t, first)
+	expectReplies(t, second)
+
+	master.handlePrimaryIn(replyFrame(getA, reply.Bulk("a")))
+	expectReplies(t, first, `"a"`, "OK", "QUEUED", "OK", `"c"`)
+	expectReplies(t, second)
+
+	master.handlePrimaryIn(replyFrame(getX, reply.Bulk("x")))
+	expectReplies(t, second, `"x"`, `"y"`)
+}
+
+func TestRepliesMatchedByID(t *testing.T) {
+	master, requests := newTestMaster()
+	first, second := openSession(master, "CLI0"), openSession(master, "CLI1")
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "SELECT 2"})
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "GET a"})
+	master.handleClientRequest(sessionRequest{session: "CLI1", body: "GET b"})
+	master.handleClientRequest(sessionRequest{session: "CLI1", body: "GET c"})
+	getA, getB, getC := nextRequest(t, requests), nextRequest(t, requests), nextRequest(t, requests)
+	if getA.DB != 2 || getB.DB != 0 {
+		t.Errorf("databases = %d, %d, want 2, 0", getA.DB, getB.DB)
+	}
+	if getA.ID == getB.ID || getB.ID == getC.ID || getA.ID == getC.ID {
+		t.Errorf("IDs %d, %d and %d aren't unique", getA.ID, getB.ID, getC.ID)
+	}
+	expectReplies(t, first, "OK")
+
+	// Replies to requests that were never sent, or that name another session, are dropped.
+	unknown := getC
+	unknown.ID = getC.ID + 100
+	master.handlePrimaryIn(replyFrame(unknown, reply.Bulk("unknown")))
+	misdirected := getA
+	misdirected.Session = "CLI1"
+	master.handlePrimaryIn(replyFrame(misdirected, reply.Bulk("misdirected")))
+	expectReplies(t, first)
+	expectReplies(t, second)
+
+	// An error from the primary fails the request it's about, and only that one.
+	master.handlePrimaryIn(utils.ErrorFrame(getB.ID, utils.INVALID))
+	expectReplies(t, second, "ERR primary rejected the request")
+	master.handlePrimaryIn(replyFrame(getC, reply.Bulk("c")))
+	master.handlePrimaryIn(replyFrame(getA, reply.Bulk("a")))
+	expectReplies(t, first, `"a"`)
+	expectReplies(t, second, `"c"`)
+
+	// A request gets one reply, however many times the primary sends it.
+	master.handlePrimaryIn(replyFrame(getA, reply.Bulk("again")))
+	master.handlePrimaryIn(replyFrame(getB, reply.Bulk("b")))
+	expectReplies(t, first)
+	expectReplies(t, second)
+}
+
+// Makes the requests that the master is timing out look like they've waited longer than
+// REQUEST_TIMEOUT.
+func backdate(master *Master) {
+	for _, queue := range master.replies {
+		for _, pending := range queue {
+			if !pending.oldest.IsZero() {
+				pending.oldest = pending.oldest.Add(-2 * REQUEST_TIMEOUT)
+			}
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	master, requests := newTestMaster()
+	first, second := openSession(master, "CLI0"), openSession(master, "CLI1")
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "BLPOP l 0"})
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "GET a"})
+	master.handleClientRequest(sessionRequest{session: "CLI1", body: "GET b"})
+	blpop, getA, getB := nextRequest(t, requests), nextRequest(t, requests), nextRequest(t, requests)
+
+	// Only the oldest request of each session times out, and never a blocking pop.
+	master.expireRequests()
+	backdate(master)
+	master.expireRequests()
+	expectReplies(t, first)
+	expectReplies(t, second, "ERR timed out waiting on the primary")
+
+	// The reply to a request that timed out comes too late to be sent.
+	master.handlePrimaryIn(replyFrame(getB, reply.Bulk("b")))
+	expectReplies(t, second)
+
+	// Once the pop returns, the request behind it starts to time out.
+	master.handlePrimaryIn(replyFrame(blpop, reply.Bulks([]string{"l", "x"})))
+	expectReplies(t, first, `"l", "x"`)
+	master.expireRequests()
+	backdate(master)
+	master.expireRequests()
+	expectReplies(t, first, "ERR timed out waiting on the primary")
+	master.handlePrimaryIn(replyFrame(getA, reply.Bulk("a")))
+	expectReplies(t, first)
+}
+
+func TestRequestsAfterCloseDropped(t *testing.T) {
+	master, requests := newTestMaster()
+	session := openSession(master, "CLI0")
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "GET a"})
+	getA := nextRequest(t, requests)
+	master.handleClientRequest(sessionRequest{session: "CLI0", closed: true})
+	<-requests
+
+	// What the session sent before it closed can still be on its way to the loop.
+	for _, body := range []string{"GET b", "SELECT 1", "MULTI", "SUBSCRIBE c", "PING"} {
+		master.handleClientRequest(sessionRequest{session: "CLI0", body: body})
+	}
+	master.handlePrimaryIn(replyFrame(getA, reply.Bulk("a")))
+	if len(requests) > 0 {
+		t.Errorf("%d requests were sent to the primary for a closed session", len(requests))
+	}
+	if _, open := <-session; open {
+		t.Errorf("the session was sent a reply after it closed")
+	}
+	if len(master.replies) > 0 || len(master.databases) > 0 || len(master.transactions) > 0 {
+		t.Errorf("the master kept state for a closed session: %v, %v, %v",
+			master.replies, master.databases, master.transactions)
+	}
+
+	// Nor is anything kept for a reply that can't be sent.
+	master.send("CLI1", reply.OK)
+	if len(master.replies) > 0 {
+		t.Errorf("replies = %v, want none", master.replies)
+	}
+}
+
+// A server played by the test, which reads what the master sends it from out, and answers
+// on in.
+type testServer struct {
+	conn net.Conn
+	peer net.Conn
+	in   chan utils.Frame
+	out  chan utils.Frame
+}
+
+func newTestServerConn(t *testing.T) (testServer, serverConn) {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	server := testServer{conn: conn, peer: peer, in: make(chan utils.Frame, utils.CHANNEL_BUFFER),
+		out: make(chan utils.Frame, utils.CHANNEL_BUFFER)}
+	return server, serverConn{conn: conn, in: server.in, out: server.out}
+}
+
+// Returns the next frame the master sent a test server.
+func nextFrame(t *testing.T, server testServer) utils.Frame {
+	t.Helper()
+	select {
+	case frame := <-server.out:
+		return frame
+	default:
+		t.Fatal("nothing was sent to the server")
+	}
+	return utils.Frame{}
+}
+
+// Returns whether the master has disconnected a test server.
+func disconnected(server testServer) bool {
+	_, err := server.peer.Read(make([]byte, 1))
+	return err != nil
+}
+
+func TestAttachFinishesOnACK(t *testing.T) {
+	master := NewMaster()
+	first, firstConn := newTestServerConn(t)
+	second, secondConn := newTestServerConn(t)
+
+	// The first server is told to be the primary, and the master doesn't wait on its
+	// answer, or take another server until it has one.
+	master.attachServer(firstConn)
+	if frame := nextFrame(t, first); frame.Type != utils.FRAME_PROMOTE {
+		t.Fatalf("sent %v, want a PROMOTE", frame)
+	}
+	if servers, joiningIn, _ := master.serverChans(); servers != nil || joiningIn == nil {
+		t.Fatalf("master isn't waiting on the joining server alone")
+	}
+	if master.primary != nil {
+		t.Fatalf("primary attached before it answered")
+	}
+	master.handleJoining(utils.Frame{Type: utils.FRAME_ACK}, true)
+	if master.primary != first.conn || master.joining != nil {
+		t.Fatalf("primary wasn't attached on its ACK")
+	}
+
+	// The second is pinged, and told where the primary is once it answers.
+	master.attachServer(secondConn)
+	if frame := nextFrame(t, second); frame.Type != utils.FRAME_PING {
+		t.Fatalf("sent %v, want a PING", frame)
+	}
+	master.handleJoining(utils.Frame{Type: utils.FRAME_ACK}, true)
+	if master.backup != second.conn {
+		t.Fatalf("backup wasn't attached on its ACK")
+	}
+	if frame := nextFrame(t, second); frame.Type != utils.FRAME_PRIMARY {
+		t.Errorf("sent %v, want the primary's address", frame)
+	}
+
+	// A third server isn't needed.
+	third, thirdConn := newTestServerConn(t)
+	master.attachServer(thirdConn)
+	if !disconnected(third) || master.joining != nil {
+		t.Errorf("third server wasn't disconnected")
+	}
+}
+
+func TestJoiningServerDropped(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(master *Master)
+	}{
+		{"error", func(master *Master) {
+			master.handleJoining(utils.ErrorFrame(0, utils.INVALID), true)
+		}},
+		{"unexpected frame", func(master *Master) {
+			master.handleJoining(utils.Frame{Type: utils.FRAME_PING}, true)
+		}},
+		{"disconnected", func(master *Master) {
+			master.handleJoining(utils.Frame{}, false)
+		}},
+		{"deadline", func(master *Master) {
+			master.joining.deadline.Reset(0)
+			_, _, deadline := master.serverChans()
+			<-deadline
+			master.dropJoining("Server didn't answer")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			master := NewMaster()
+			server, conn := newTestServerConn(t)
+			master.attachServer(conn)
+			test.answer(master)
+			if master.primary != nil || master.joining != nil || !disconnected(server) {
+				t.Errorf("server wasn't dropped")
+			}
+			if servers, _, _ := master.serverChans(); servers == nil {
+				t.Errorf("master isn't taking new servers")
+			}
+		})
+	}
+}
+
+func TestPromotionFinishesOnACK(t *testing.T) {
+	master, requests := newTestMaster()
+	backup, backupConn := newTestServerConn(t)
+	master.backup, master.backupIn, master.backupOut = backupConn.conn, backupConn.in, backupConn.out
+	session := openSession(master, "CLI0")
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "GET a"})
+	nextRequest(t, requests)
+
+	// The backup is told to take over, and requests wait until it has.
+	master.promoteBackup()
+	if frame := nextFrame(t, backup); frame.Type != utils.FRAME_PROMOTE {
+		t.Fatalf("sent %v, want a PROMOTE", frame)
+	}
+	if !master.promoting() || master.backup != nil {
+		t.Fatalf("master isn't waiting on the promotion")
+	}
+	expectReplies(t, session)
+
+	master.handleJoining(utils.Frame{Type: utils.FRAME_ACK}, true)
+	if master.primary != backup.conn || master.epoch != 1 || master.promoting() {
+		t.Errorf("backup wasn't promoted on its ACK")
+	}
+	expectReplies(t, session, "ERR primary went away before replying")
+}
+
+func TestExecAbortedByPromotion(t *testing.T) {
+	master, _ := newTestMaster()
+	session := openSession(master, "CLI0")
+	master.watches["CLI0"] = &watchState{epoch: master.epoch}
+	master.epoch++
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "MULTI"})
+	master.handleClientRequest(sessionRequest{session: "CLI0", body: "EXEC"})
+	<-session
+	if result := <-session; result.Type != reply.NULL_ARRAY {
+		t.Errorf("EXEC = %#v, want a null array", result)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Channels and patterns that sessions are subscribed to. Messages are never stored or
+// replicated, so the master delivers them itself, without going through the primary.
+type pubsub struct {
+	// Subscribed sessions, by channel and by pattern.
+	channels map[string]map[string]bool
+	patterns map[string]map[string]bool
+
+	// Channels and patterns, by subscribed session.
+	sessionChannels map[string]map[string]bool
+	sessionPatterns map[string]map[string]bool
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{channels: make(map[string]map[string]bool),
+		patterns:        make(map[string]map[string]bool),
+		sessionChannels: make(map[string]map[string]bool),
+		sessionPatterns: make(map[string]map[string]bool)}
+}
+
+// Adds a session to a set in each of the maps.
+func subscribe(bySubject map[string]map[string]bool, bySession map[string]map[string]bool,
+	subject string, session string) {
+	if bySubject[subject] == nil {
+		bySubject[subject] = make(map[string]bool)
+	}
+	bySubject[subject][session] = true
+	if bySession[session] == nil {
+		bySession[session] = make(map[string]bool)
+	}
+	bySession[session][subject] = true
+}
+
+func unsubscribe(bySubject map[string]map[string]bool, bySession map[string]map[string]bool,
+	subject string, session string) {
+	delete(bySubject[subject], session)
+	if len(bySubject[subject]) == 0 {
+		delete(bySubject, subject)
+	}
+	delete(bySession[session], subject)
+	if len(bySession[session]) == 0 {
+		delete(bySession, session)
+	}
+}
+
+// Returns the number of channels and patterns a session is subscribed to.
+func (ps *pubsub) count(session string) int {
+	return len(ps.sessionChannels[session]) + len(ps.sessionPatterns[session])
+}
+
+// Unsubscribes a session from everything, once it has gone away.
+func (ps *pubsub) remove(session string) {
+	for channel := range ps.sessionChannels[session] {
+		unsubscribe(ps.channels, ps.sessionChannels, channel, session)
+	}
+	for pattern := range ps.sessionPatterns[session] {
+		unsubscribe(ps.patterns, ps.sessionPatterns, pattern, session)
+	}
+}
+
+// Returns the members of a set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Handles the publish/subscribe requests. Returns false if the request isn't one of them.
+func (master *Master) handlePubsub(sender string, fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	command := strings.ToUpper(fields[0])
+	switch command {
+	case utils.SUBSCRIBE, utils.UNSUBSCRIBE, utils.PSUBSCRIBE, utils.PUNSUBSCRIBE,
+		utils.PUBLISH, utils.PUBSUB:
+	default:
+		return false
+	}
+
+	result := reply.Error(command + " inside MULTI is not allowed")
+	if _, inMulti := master.transactions[sender]; !inMulti {
+		ps := master.pubsub
+		switch command {
+		case utils.SUBSCRIBE:
+			result = master.subscribe(sender, fields[1:], ps.channels, ps.sessionChannels, "subscribe")
+		case utils.PSUBSCRIBE:
+			result = master.subscribe(sender, fields[1:], ps.patterns, ps.sessionPatterns, "psubscribe")
+		case utils.UNSUBSCRIBE:
+			result = master.unsubscribe(sender, fields[1:], ps.channels, ps.sessionChannels, "unsubscribe")
+		case utils.PUNSUBSCRIBE:
+			result = master.unsubscribe(sender, fields[1:], ps.patterns, ps.sessionPatterns, "punsubscribe")
+		case utils.PUBLISH:
+			result = master.publishRequest(fields[1:])
+		case utils.PUBSUB:
+			result = master.pubsubRequest(fields[1:])
+		}
+	}
+	master.send(sender, result)
+	return true
+}
+
+// Subscribes a session to channels or patterns, and returns a row for each of them with
+// the number of subscriptions the session has after it.
+func (master *Master) subscribe(sender string, subjects []string,
+	bySubject map[string]map[string]bool, bySession map[string]map[string]bool, kind string) reply.Reply {
+	if len(subjects) == 0 {
+		return reply.Error("wrong number of arguments for \"" + strings.ToUpper(kind) + "\", expected at least 1")
+	}
+	rows := make([]reply.Reply, len(subjects))
+	for i, subject := range subjects {
+		subscribe(bySubject, bySession, subject, sender)
+		rows[i] = subscriptionRow(kind, reply.Bulk(subject), master.pubsub.count(sender))
+	}
+	return reply.Array(rows...)
+}
+
+// Unsubscribes a session from channels or patterns, or from all of them if none are given.
+func (master *Master) unsubscribe(sender string, subjects []string,
+	bySubject map[string]map[string]bool, bySession map[string]map[string]bool, kind string) reply.Reply {
+	if len(subjects) == 0 {
+		subjects = sortedKeys(bySession[sender])
+	}
+	if len(subjects) == 0 {
+		return reply.Array(subscriptionRow(kind, reply.Null(), master.pubsub.count(sender)))
+	}
+	rows := make([]reply.Reply, len(subjects))
+	for i, subject := range subjects {
+		unsubscribe(bySubject, bySession, subject, sender)
+		rows[i] = subscriptionRow(kind, reply.Bulk(subject), master.pubsub.count(sender))
+	}
+	return reply.Array(rows...)
+}
+
+// Returns a row like ["subscribe", "channel", 1]. RESP clients get each row as a push.
+func subscriptionRow(kind string, subject reply.Reply, count int) reply.Reply {
+	return reply.Array(reply.Bulk(kind), subject, reply.Integer(int64(count)))
+}
+
+// Handles "PUBLISH channel message". A message with spaces in it has to be quoted.
+func (master *Master) publishRequest(args []string) reply.Reply {
+	if len(args) != 2 {
+		return reply.Error("wrong number of arguments for \"PUBLISH\", expected 2")
+	}
+	return reply.Integer(int64(master.publish(args[0], args[1])))
+}
+
+// Pushes a message to every session subscribed to the channel, or to a pattern matching
+// it, and returns the number of sessions it went to.
+func (master *Master) publish(channel string, message string) int {
+	receivers := 0
+	push := func(session string, fields ...string) {
+		if master.push(session, reply.Push(reply.Bulks(fields).Elements...)) {
+			receivers++
+		}
+	}
+	for _, session := range sortedKeys(master.pubsub.channels[channel]) {
+		push(session, "message", channel, message)
+	}
+	for pattern, sessions := range master.pubsub.patterns {
+		if !utils.MatchGlob(pattern, channel) {
+			continue
+		}
+		for _, session := range sortedKeys(sessions) {
+			push(session, "pmessage", pattern, channel, message)
+		}
+	}
+	return receivers
+}
+
+// Handles PUBSUB CHANNELS [pattern], PUBSUB NUMSUB [channel ...] and PUBSUB NUMPAT.
+func (master *Master) pubsubRequest(args []string) reply.Reply {
+	if len(args) == 0 {
+		return reply.Error("wrong number of arguments for \"PUBSUB\", expected at least 1")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return reply.Error("wrong number of arguments for \"PUBSUB CHANNELS\", expected 0 or 1")
+		}
+		channels := make([]string, 0)
+		for channel := range master.pubsub.channels {
+			if len(args) == 1 || utils.MatchGlob(args[1], channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		return reply.Bulks(channels)
+	case "NUMSUB":
+		// Each channel followed by its number of subscribers.
+		counts := make([]reply.Reply, 0, 2*(len(args)-1))
+		for _, channel := range args[1:] {
+			counts = append(counts, reply.Bulk(channel),
+				reply.Integer(int64(len(master.pubsub.channels[channel]))))
+		}
+		return reply.Array(counts...)
+	case "NUMPAT":
+		if len(args) != 1 {
+			return reply.Error("wrong number of arguments for \"PUBSUB NUMPAT\", expected 0")
+		}
+		return reply.Integer(int64(len(master.pubsub.patterns)))
+	}
+	return reply.Error("unknown PUBSUB subcommand \"" + args[0] + "\"")
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/eshyong/lettuce/reply"
+	"github.com/eshyong/lettuce/utils"
+)
+
+// RESP constants. Clients that speak RESP, like redis-cli and the Redis client libraries,
+// are told apart from plain text clients by the first byte they send, which always
+// starts an array.
+const (
+	RESP_ARRAY = '*'
+	RESP_BULK  = '$'
+
+	// Limits on a single request, which keep a bad client from making us allocate
+	// whatever it claims to send.
+	RESP_MAX_ARGS = 1024 * 1024
+	RESP_MAX_BULK = 512 * 1024 * 1024
+
+	// Requests a session may send before it has to wait on their replies.
+	RESP_MAX_PENDING = 1024
+)
+
+// Commands whose replies are a row for each channel or pattern. Each row is a reply of
+// its own in RESP.
+var respSubscribeCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+}
+
+func protocolError(message string) error {
+	return errors.New("Protocol error: " + message)
+}
+
+// Reads a line, without the line break at the end of it.
+func readRESPLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// Reads a request: an array of bulk strings, or an inline request on a line of its own,
+// which is split like any other text request.
+func readRESPRequest(reader *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" || line[0] != RESP_ARRAY {
+		return utils.SplitArgs(line)
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > RESP_MAX_ARGS {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([]string, 0)
+	for i := 0; i < count; i++ {
+		line, err := readRESPLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || line[0] != RESP_BULK {
+			return nil, protocolError("expected '$', got '" + line + "'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, protocolError("invalid bulk length")
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		if string(bulk[size:]) != "\r\n" {
+			return nil, protocolError("bulk string isn't followed by CRLF")
+		}
+		args = append(args, string(bulk[:size]))
+	}
+	return args, nil
+}
+
+// A request that is waiting on its reply. Requests the session answers itself already
+// have their reply.
+type respRequest struct {
+	command string
+	reply   *reply.Reply
+}
+
+// Returns a request the session has already answered.
+func answered(result reply.Reply) respRequest {
+	return respRequest{reply: &result}
+}
+
+// Handles HELLO [protover [SETNAME name]], which switches the session to RESP2 or RESP3
+// and replies with a description of the server.
+func hello(args []string, id string, protocol *int32) reply.Reply {
+	version := int(atomic.LoadInt32(protocol))
+	if len(args) > 0 {
+		requested, err := strconv.Atoi(args[0])
+		if err != nil {
+			return reply.Error("Protocol version is not an integer or out of range")
+		}
+		if requested != 2 && requested != 3 {
+			return reply.CodedError("NOPROTO", "unsupported protocol version")
+		}
+		version = requested
+	}
+	for i := 1; i < len(args); i += 2 {
+		// Sessions don't have names, so SETNAME is accepted and ignored.
+		if strings.ToUpper(args[i]) != "SETNAME" || i+1 == len(args) {
+			return reply.Error("Syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+	atomic.StoreInt32(protocol, int32(version))
+
+	number, _ := strconv.ParseInt(strings.TrimPrefix(id, utils.CLIENT), 10, 64)
+	return reply.Map(
+		reply.Bulk("server"), reply.Bulk("lettuce"),
+		reply.Bulk("proto"), reply.Integer(int64(version)),
+		reply.Bulk("id"), reply.Integer(number),
+		reply.Bulk("mode"), reply.Bulk("standalone"),
+		reply.Bulk("role"), reply.Bulk("master"),
+		reply.Bulk("modules"), reply.Array(),
+	)
+}
+
+// Serves a client that speaks RESP. Requests are joined into text requests for the master,
+// and the replies are encoded in RESP on the way back, in the order the requests came in.
+func respSession(client net.Conn, reader *bufio.Reader, mux chan<- sessionRequest, id string,
+	session <-chan reply.Reply) {
+	// RESP2 until the client asks for RESP3 with HELLO.
+	protocol := int32(2)
+	pending := make(chan respRequest, RESP_MAX_PENDING)
+
+	go func() {
+		// Closing the queue tells the writer that the client is gone, or is about to be.
+		defer close(pending)
+		for {
+			args, err := readRESPRequest(reader)
+			if err == utils.ErrUnbalancedQuotes || err == utils.ErrQuoteNotFollowed {
+				pending <- answered(reply.Error(err.Error()))
+				continue
+			} else if err != nil {
+				if err != io.EOF {
+					pending <- answered(reply.Error(err.Error()))
+				}
+				return
+			}
+			if len(args) == 0 {
+				continue
+			}
+
+			command := strings.ToLower(args[0])
+			switch command {
+			case "hello":
+				pending <- answered(hello(args[1:], id, &protocol))
+				continue
+			case "ping":
+				if len(args) > 1 {
+					pending <- answered(reply.Bulk(args[1]))
+				} else {
+					pending <- answered(reply.Status("PONG"))
+				}
+				continue
+			case "quit":
+				pending <- answered(reply.OK)
+				return
+			}
+
+			pending <- respRequest{command: command}
+			fmt.Println("request:", id, args)
+			mux <- sessionRequest{session: id, body: utils.JoinArgs(args...)}
+		}
+	}()
+
+	defer client.Close()
+	defer func(queue <-chan respRequest) {
+		// The reader stops once the client is closed, but may be waiting on the queue.
+		go func() {
+			for range queue {
+			}
+		}()
+	}(pending)
+	writer := bufio.NewWriter(client)
+	write := func(results ...reply.Reply) {
+		encode := reply.EncodeRESP2
+		if atomic.LoadInt32(&protocol) >= 3 {
+			encode = reply.EncodeRESP3
+		}
+		for _, result := range results {
+			writer.WriteString(encode(result))
+		}
+		if err := writer.Flush(); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// Writes the reply to a request. Subscribing replies with a push for each channel.
+	answer := func(request respRequest, result reply.Reply) {
+		if !respSubscribeCommands[request.command] || result.Type != reply.ARRAY {
+			write(result)
+			return
+		}
+		rows := make([]reply.Reply, len(result.Elements))
+		for i, row := range result.Elements {
+			rows[i] = reply.Push(row.Elements...)
+		}
+		write(rows...)
+	}
+
+	// Waits on the reply to a forwarded request, writing any pushes that come first.
+	// Returns false once the master has closed the session.
+	replyTo := func(request respRequest) bool {
+		for {
+			result, ok := <-session
+			if !ok {
+				return false
+			}
+			if result.Type == reply.PUSH {
+				write(result)
+				continue
+			}
+			answer(request, result)
+			return true
+		}
+	}
+
+	for {
+		select {
+		case request, ok := <-pending:
+			if !ok {
+				// Every request has its reply, so the master can close the session.
+				// Pushes may still come until then.
+				pending = nil
+				go func() {
+					mux <- sessionRequest{session: id, closed: true}
+				}()
+			} else if request.reply != nil {
+				write(*request.reply)
+			} else if !replyTo(request) {
+				return
+			}
+		case result, ok := <-session:
+			// The master closes the session once the client is gone.
+			if !ok {
+				return
+			}
+			if result.Type == reply.PUSH {
+				write(result)
+				continue
+			}
+
+			// The reply beat its request here, which is always queued before it's sent.
+			for request := range pending {
+				if request.reply != nil {
+					write(*request.reply)
+					continue
+				}
+				answer(request, result)
+				break
+			}
+		}
+	}
+}
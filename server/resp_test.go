@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eshyong/lettuce/reply"
+)
+
+func TestReadRESPRequest(t *testing.T) {
+	tests := []struct {
+		input string
+		args  []string
+		err   string
+	}{
+		{"*1\r\n$4\r\nPING\r\n", []string{"PING"}, ""},
+		{"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$7\r\nb\r\nc d \r\n", []string{"SET", "a", "b\r\nc d "}, ""},
+		{"*2\r\n$3\r\nGET\r\n$0\r\n\r\n", []string{"GET", ""}, ""},
+		{"*0\r\n", []string{}, ""},
+		{"*1\n$4\nPING\r\n", []string{"PING"}, ""},
+		{"GET \"a b\"\r\n", []string{"GET", "a b"}, ""},
+		{"\r\n", []string{}, ""},
+		{"*x\r\n", nil, "Protocol error: invalid multibulk length"},
+		{"*2000000\r\n", nil, "Protocol error: invalid multibulk length"},
+		{"*1\r\n:1\r\n", nil, "Protocol error: expected '$', got ':1'"},
+		{"*1\r\n$-1\r\n", nil, "Protocol error: invalid bulk length"},
+		{"*1\r\n$999999999999\r\n", nil, "Protocol error: invalid bulk length"},
+		{"*1\r\n$3\r\nGETX\r\n", nil, "Protocol error: bulk string isn't followed by CRLF"},
+		{"*2\r\n$3\r\nGET\r\n", nil, io.EOF.Error()},
+		{"*1\r\n$3\r\nGE", nil, io.ErrUnexpectedEOF.Error()},
+		{"GET \"a\r\n", nil, "unbalanced quotes"},
+	}
+	for _, test := range tests {
+		args, err := readRESPRequest(bufio.NewReader(strings.NewReader(test.input)))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("readRESPRequest(%q) = %q, %v, want error %q", test.input, args, err, test.err)
+			}
+			continue
+		}
+		if err != nil || len(args) != len(test.args) || (len(args) > 0 && !reflect.DeepEqual(args, test.args)) {
+			t.Errorf("readRESPRequest(%q) = %q, %v, want %q", test.input, args, err, test.args)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	tests := []struct {
+		args     []string
+		protocol int32
+		reply    string
+		after    int32
+	}{
+		{nil, 2, "", 2},
+		{nil, 3, "", 3},
+		{[]string{"3"}, 2, "", 3},
+		{[]string{"2"}, 3, "", 2},
+		{[]string{"3", "SETNAME", "name"}, 2, "", 3},
+		{[]string{"3", "setname", "name"}, 2, "", 3},
+		{[]string{"4"}, 2, "NOPROTO unsupported protocol version", 2},
+		{[]string{"x"}, 3, "ERR Protocol version is not an integer or out of range", 3},
+		{[]string{"3", "SETNAME"}, 2, "ERR Syntax error in HELLO option 'SETNAME'", 2},
+		{[]string{"3", "AUTH", "a", "b"}, 2, "ERR Syntax error in HELLO option 'AUTH'", 2},
+	}
+	for _, test := range tests {
+		protocol := test.protocol
+		result := hello(test.args, "CLI7", &protocol)
+		if protocol != test.after {
+			t.Errorf("HELLO %q from RESP%d: protocol = %d, want %d", test.args, test.protocol, protocol, test.after)
+		}
+		if test.reply != "" {
+			if result.String() != test.reply {
+				t.Errorf("HELLO %q = %v, want %s", test.args, result, test.reply)
+			}
+			continue
+		}
+		want := reply.Map(
+			reply.Bulk("server"), reply.Bulk("lettuce"),
+			reply.Bulk("proto"), reply.Integer(int64(test.after)),
+			reply.Bulk("id"), reply.Integer(7),
+			reply.Bulk("mode"), reply.Bulk("standalone"),
+			reply.Bulk("role"), reply.Bulk("master"),
+			reply.Bulk("modules"), reply.Array(),
+		)
+		if !reflect.DeepEqual(result, want) {
+			t.Errorf("HELLO %q = %v, want %v", test.args, result, want)
+		}
+	}
+}
+
+// Opens a session for a client, and plays the master for it, answering every request with
+// the reply the test gives for it. Returns the client's end of the connection.
+func startSession(t *testing.T, replies map[string]reply.Reply) *bufio.ReadWriter {
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	mux := make(chan sessionRequest, MAX_BATCH)
+	session(conn, mux, "CLI0")
+	go func() {
+		var replyTo chan<- reply.Reply
+		for request := range mux {
+			if request.opened != nil {
+				replyTo = request.opened
+			} else if request.closed {
+				close(replyTo)
+				return
+			} else {
+				replyTo <- replies[request.body]
+			}
+		}
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+}
+
+func TestSessionProtocols(t *testing.T) {
+	replies := map[string]reply.Reply{
+		"GET a":     reply.Null(),
+		"EXEC":      reply.NullArray(),
+		"HGETALL h": reply.Map(reply.Bulk("f"), reply.Bulk("v")),
+	}
+	tests := []struct {
+		name     string
+		requests string
+		replies  string
+	}{
+		// Text clients send a request on each line, and read the reply on the next.
+		{"text", "GET a\nEXEC\nHGETALL h\n",
+			"<nil>\n<nil>\n\"f\": \"v\"\n"},
+
+		// RESP clients start with an array, and speak RESP2 until they ask for RESP3.
+		{"RESP2", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$4\r\nEXEC\r\n*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n",
+			"$-1\r\n*-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{"RESP3", "*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n*1\r\n$4\r\nEXEC\r\n*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n",
+			"%6\r\n$6\r\nserver\r\n$7\r\nlettuce\r\n$5\r\nproto\r\n:3\r\n$2\r\nid\r\n:0\r\n" +
+				"$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n" +
+				"_\r\n%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{"RESP inline after an array", "*1\r\n$4\r\nPING\r\nGET a\r\n",
+			"+PONG\r\n$-1\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := startSession(t, replies)
+			go func() {
+				conn.WriteString(test.requests)
+				conn.Flush()
+			}()
+			got := make([]byte, len(test.replies))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("read %q, %v", got, err)
+			}
+			if string(got) != test.replies {
+				t.Errorf("replies = %q, want %q", got, test.replies)
+			}
+		})
+	}
+}
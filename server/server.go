@@ -7,12 +7,18 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/eshyong/lettuce/db"
+	"github.com/eshyong/lettuce/reply"
 	"github.com/eshyong/lettuce/utils"
 )
 
+// Most writes that may be on their way to the backup at once, before it acknowledges them.
+const REPLICATION_WINDOW = 256
+
 type Server struct {
 	// Server can either have a backup or a primary, but not both.
 	master net.Conn
@@ -20,18 +26,71 @@ type Server struct {
 	// TODO: allow any arbitrary number of peers.
 	peer net.Conn
 
-	masterIn  <-chan string
-	masterOut chan<- string
+	masterIn  <-chan utils.Frame
+	masterOut chan<- utils.Frame
 
-	peerIn  <-chan string
-	peerOut chan<- string
+	peerIn  <-chan utils.Frame
+	peerOut chan<- utils.Frame
 
-	queue     []string
 	isPrimary bool
+
+	// The log sequence number of the last write. The primary numbers each write as it
+	// makes it, and the backup applies them strictly in that order, so a backup that's
+	// promoted carries on from the last write it applied.
+	lsn uint64
+
+	// Writes the backup hasn't acknowledged yet, in order. The first few of them, up to
+	// REPLICATION_WINDOW, are on their way, and the rest wait for room.
+	queue []logEntry
+	sent  int
+
+	// Set once the backup has asked for the writes after a gap, until it gets them.
+	missing bool
+
+	// Requests from clients that are waiting on a blocking pop, starting with the pop
+	// itself. The others run once it returns, so that the replies stay in order.
+	held map[string][]utils.Envelope
+}
+
+// A write for the backup to replay, and its place in the primary's log.
+type logEntry struct {
+	lsn     uint64
+	request string
 }
 
 func NewServer() *Server {
-	return &Server{master: nil, store: db.NewStore(), peer: nil, isPrimary: false}
+	return NewServerIn("")
+}
+
+// Returns a server whose store keeps its dump and log in dir.
+func NewServerIn(dir string) *Server {
+	return &Server{master: nil, store: db.NewStoreIn(dir), peer: nil, isPrimary: false,
+		held: make(map[string][]utils.Envelope)}
+}
+
+// Sets when the store fsyncs its append-only log: "always", "everysec" or "never".
+func (server *Server) SetFsyncPolicy(policy string) error {
+	return server.store.SetFsyncPolicy(policy)
+}
+
+// Sets when the store saves itself in the background, as pairs of "seconds changes".
+func (server *Server) SetSaveRules(config string) error {
+	return server.store.SetSaveRules(config)
+}
+
+// Sets which keyspace events get published, as a string of event classes like "KEA".
+func (server *Server) SetNotifyKeyspaceEvents(config string) error {
+	return server.store.SetNotifyKeyspaceEvents(config)
+}
+
+// Sets the most memory the store may use, like "100mb". 0 means no limit.
+func (server *Server) SetMaxMemory(config string) error {
+	return server.store.SetMaxMemory(config)
+}
+
+// Sets which keys the store evicts once it uses more than its maxmemory.
+func (server *Server) SetMaxMemoryPolicy(policy string) error {
+	return server.store.SetMaxMemoryPolicy(policy)
 }
 
 func (server *Server) ConnectToMaster() {
@@ -48,11 +107,16 @@ func (server *Server) ConnectToMaster() {
 	if err != nil {
 		log.Fatal("Could not connect to master ", err)
 	}
-	in := utils.InChanFromConn(conn, "master")
-	out := utils.OutChanFromConn(conn, "master")
+	if err = utils.Handshake(conn); err != nil {
+		log.Fatal("Handshake with the master failed: ", err)
+	}
+	in := utils.InFrameChanFromConn(conn, "master")
+	out := utils.OutFrameChanFromConn(conn, "master")
 
-	// TODO: check errors
-	request, _ := <-in
+	request, ok := <-in
+	if !ok {
+		log.Fatal("Master disconnected.")
+	}
 	fmt.Println(request)
 	err = server.handleMasterPing(out, request)
 	if err != nil {
@@ -75,31 +139,27 @@ func (server *Server) ConnectToMaster() {
 	} else {
 		conn = connectToPrimary(in)
 	}
+	if err = utils.Handshake(conn); err != nil {
+		log.Fatal("Handshake with the peer failed: ", err)
+	}
 	server.peer = conn
-	server.peerIn = utils.InChanFromConn(conn, "peer")
-	server.peerOut = utils.OutChanFromConn(conn, "peer")
+	server.peerIn = utils.InFrameChanFromConn(conn, "peer")
+	server.peerOut = utils.OutFrameChanFromConn(conn, "peer")
 }
 
-func connectToPrimary(in <-chan string) net.Conn {
-	request, _ := <-in
-	arr := strings.Split(request, utils.DELIMITER)
-	if len(arr) < 2 {
-		log.Fatal("Invalid message.")
+func connectToPrimary(in <-chan utils.Frame) net.Conn {
+	request, ok := <-in
+	if !ok {
+		log.Fatal("Master disconnected.")
 	}
-	header, body := arr[0], arr[1]
-
-	if header != utils.SYN {
-		log.Fatal("Unknown protocol.")
-	}
-	arr = strings.Split(body, utils.EQUALS)
-	if len(arr) < 2 {
-		log.Fatal("Invalid message: " + request)
+	if request.Type != utils.FRAME_PRIMARY {
+		log.Fatal("Expected address of primary, got ", request)
 	}
-	name, address := arr[0], arr[1]
-	if name != utils.PRIMARY {
-		log.Fatal("Expected address of primary.")
+	address, _, err := net.SplitHostPort(string(request.Payload))
+	if err != nil {
+		log.Fatal("Invalid address of primary: ", err)
 	}
-	conn, err := net.DialTimeout("tcp", address+utils.DELIMITER+utils.PEER_PORT, utils.TIMEOUT)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, utils.PEER_PORT), utils.TIMEOUT)
 	if err != nil {
 		log.Fatal("Couldn't connect to primary.")
 	}
@@ -131,161 +191,251 @@ func readConfig() (string, error) {
 }
 
 func (server *Server) Serve() {
+	// Periodically pick up keys deleted by the store's expiration sweeper.
+	ticker := time.NewTicker(utils.DIFF_PERIOD)
+	defer ticker.Stop()
 loop:
 	for {
 		// Receive a message from the master server.
 		select {
-		case message, ok := <-server.masterIn:
+		case frame, ok := <-server.masterIn:
 			if !ok {
 				break loop
 			}
-			err := server.handleMasterRequests(server.masterOut, message)
+			err := server.handleMasterRequests(server.masterOut, frame)
 			if err != nil {
 				fmt.Println(err)
 			}
-		case message, ok := <-server.peerIn:
+		case frame, ok := <-server.peerIn:
 			if !ok {
+				// The peer is gone, and it won't be back.
+				close(server.peerOut)
+				server.peerIn = nil
+				server.peerOut = nil
+				server.queue = nil
+				server.sent = 0
 				break
 			}
-			err := server.handlePeerMessage(server.peerOut, message)
+			err := server.handlePeerMessage(server.peerOut, frame)
 			if err != nil {
 				fmt.Println(err)
 			}
+		case <-ticker.C:
+			// Time out any clients that have waited too long on a blocking pop, and
+			// publish the keys that expired in the background.
+			server.wakeClients(server.masterOut)
+			server.publishNotifications(server.masterOut)
+			server.appendDiffs(server.store.Diffs())
 		}
-		if server.isPrimary && len(server.queue) > 0 {
-			// Send diffs to the backup server.
-			request := server.queue[0]
-			server.peerOut <- utils.SYNDEL + utils.DIFF + utils.EQUALS + request
-		}
+		server.replicate()
 	}
 	fmt.Println("Shutting down...")
 }
 
-func (server *Server) handleMasterRequests(out chan<- string, message string) error {
-	// Messages have the format 'HEADER:REQUEST'
-	arr := strings.Split(message, utils.DELIMITER)
-	if len(arr) < 2 {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Invalid request: " + message)
-	}
-	fmt.Println("master message:", message)
+func (server *Server) handleMasterRequests(out chan<- utils.Frame, frame utils.Frame) error {
+	fmt.Println("master message:", frame)
 
 	// Handle a message from the server or a master request.
-	header, request := arr[0], arr[1]
-	if header == utils.SYN {
-		// SYN message
-		return server.handleMasterPing(out, message)
-	} else if strings.Contains(header, utils.CLIENT) {
+	switch frame.Type {
+	case utils.FRAME_PING, utils.FRAME_PROMOTE:
+		return server.handleMasterPing(out, frame)
+	case utils.FRAME_CLOSED:
+		// The client went away, so it can't be waiting on anything.
+		client := string(frame.Payload)
+		server.store.Disconnect(client)
+		delete(server.held, client)
+	case utils.FRAME_REQUEST:
 		// Client request
 		if !server.isPrimary {
 			// Refuse request as backup.
-			out <- utils.ERRDEL + utils.NEG
-			return errors.New("Not primary: " + request)
+			out <- utils.ErrorFrame(frame.ID, utils.NEG)
+			return errors.New("Not primary: " + frame.String())
+		}
+		envelope, err := utils.EnvelopeFromFrame(frame)
+		if err != nil {
+			out <- utils.ErrorFrame(frame.ID, utils.INVALID)
+			return errors.New("Invalid request: " + frame.String())
 		}
-		// Execute request and send reply to server.
-		reply := header + utils.DELIMITER + server.store.Execute(request)
-		out <- reply
+		if held, blocked := server.held[envelope.Session]; blocked {
+			// Clients may send more requests without waiting on the blocking pop.
+			server.held[envelope.Session] = append(held, envelope)
+			return nil
+		}
+		server.executeClientRequest(out, envelope)
 
-		// Append to queue of requests to send to backup.
-		server.queue = append(server.queue, request)
-	} else {
+		// The request may have pushed to a list that other clients are waiting on.
+		server.wakeClients(out)
+		server.publishNotifications(out)
+
+		// Append any changes made by the request to the queue of diffs to send to backup.
+		server.appendDiffs(server.store.Diffs())
+	case utils.FRAME_ERROR:
+		// Errors aren't answered, so that two nodes can't keep answering each other's.
+		return errors.New("Error from the master: " + frame.String())
+	default:
 		// Invalid request
-		out <- utils.ERRDEL + utils.UNKNOWN
-		return errors.New("Unrecognized request: " + request)
+		out <- utils.ErrorFrame(frame.ID, utils.UNKNOWN)
+		return errors.New("Unrecognized request: " + frame.String())
 	}
 	return nil
 }
 
-func (server *Server) handleMasterPing(out chan<- string, message string) error {
-	arr := strings.Split(message, utils.DELIMITER)
-	if len(arr) < 2 {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Invalid message: " + message)
+// Runs a client request, and sends the reply to the master in an envelope with the ID of
+// the request, unless the client has to wait. Replies are marshaled to fit on a line,
+// whatever is in them.
+func (server *Server) executeClientRequest(out chan<- utils.Frame, envelope utils.Envelope) {
+	result, done := server.store.ExecuteFor(envelope.Session, envelope.DB, envelope.Body)
+	if done {
+		server.reply(out, envelope, result)
+	} else {
+		server.held[envelope.Session] = []utils.Envelope{envelope}
 	}
-	header, request := arr[0], arr[1]
-	if header != utils.SYN {
-		return errors.New("Invalid message: " + message)
+}
+
+// Sends the reply to a request, which goes back in the request's envelope.
+func (server *Server) reply(out chan<- utils.Frame, request utils.Envelope, result reply.Reply) {
+	request.Body = reply.Marshal(result)
+	out <- request.Frame(utils.FRAME_REPLY)
+}
+
+// Sends the replies of clients that were waiting on a blocking pop, and runs the requests
+// they sent in the meantime, until one of them blocks again.
+func (server *Server) wakeClients(out chan<- utils.Frame) {
+	for wakeups := server.store.Unblocked(); len(wakeups) > 0; wakeups = server.store.Unblocked() {
+		for _, wakeup := range wakeups {
+			held, in := server.held[wakeup.Client]
+			delete(server.held, wakeup.Client)
+			if !in || len(held) == 0 {
+				continue
+			}
+			server.reply(out, held[0], wakeup.Reply)
+			for i, request := range held[1:] {
+				server.executeClientRequest(out, request)
+				if blocked, ok := server.held[wakeup.Client]; ok {
+					server.held[wakeup.Client] = append(blocked, held[i+2:]...)
+					break
+				}
+			}
+		}
 	}
-	if request == utils.PROMOTE {
+}
+
+// Hands the keyspace events to the master, which publishes them to subscribed clients.
+func (server *Server) publishNotifications(out chan<- utils.Frame) {
+	for _, notification := range server.store.Notifications() {
+		out <- utils.Frame{Type: utils.FRAME_PUBLISH,
+			Payload: utils.PackFields(notification.Channel, notification.Message)}
+	}
+}
+
+func (server *Server) handleMasterPing(out chan<- utils.Frame, frame utils.Frame) error {
+	if frame.Type == utils.FRAME_PROMOTE {
 		if server.isPrimary {
 			// This server is already a primary, so we reject the request.
-			out <- utils.ACKDEL + utils.NEG
+			out <- utils.ErrorFrame(frame.ID, utils.NEG)
 		} else {
 			// Promote self to primary.
 			server.isPrimary = true
-			out <- utils.ACKDEL + utils.OK
+			server.store.SetPrimary(true)
+			out <- utils.Frame{Type: utils.FRAME_ACK, ID: frame.ID}
 		}
-	} else if request == utils.STATUS {
+	} else if frame.Type == utils.FRAME_PING {
 		// Ping to check status?
-		out <- utils.ACKDEL + utils.OK
+		out <- utils.Frame{Type: utils.FRAME_ACK, ID: frame.ID}
 	} else {
 		// Some invalid message not covered by our protocol.
-		out <- utils.ERRDEL + utils.UNKNOWN
-		return errors.New("Unrecognized request: " + request)
+		out <- utils.ErrorFrame(frame.ID, utils.UNKNOWN)
+		return errors.New("Unrecognized request: " + frame.String())
 	}
 	return nil
 }
 
-func (server *Server) handlePeerMessage(out chan<- string, message string) error {
-	fmt.Println("peer message:", message)
+func (server *Server) handlePeerMessage(out chan<- utils.Frame, frame utils.Frame) error {
+	fmt.Println("peer message:", frame)
 	var err error
 	if server.isPrimary {
-		err = server.handleBackupResponse(out, message)
+		err = server.handleBackupResponse(out, frame)
 	} else {
-		err = server.handlePrimaryRequest(out, message)
+		err = server.handlePrimaryRequest(out, frame)
 	}
 	return err
 }
 
-func (server *Server) handleBackupResponse(out chan<- string, message string) error {
-	// We check if our last transaction went through; if there was a mistake we can retransmit it.
-	fmt.Println("backup message:", message)
-	arr := strings.Split(message, utils.DELIMITER)
-	if len(arr) < 2 {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Invalid message: " + message)
-	}
-	header, body := arr[0], arr[1]
-	if header == utils.ERR {
-		return errors.New("Need to retransmit diff request: " + message)
+// Numbers the writes the store has made, and queues them for the backup, if there is one.
+func (server *Server) appendDiffs(diffs []string) {
+	for _, diff := range diffs {
+		server.lsn++
+		if server.peerOut != nil {
+			server.queue = append(server.queue, logEntry{lsn: server.lsn, request: diff})
+		}
 	}
-	if header != utils.ACK {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Unrecognized header: " + header)
+}
+
+// Sends the backup as many of the queued writes as fit in the window, each with its LSN.
+func (server *Server) replicate() {
+	if !server.isPrimary || server.peerOut == nil {
+		return
 	}
-	if body != utils.OK {
-		return errors.New("Request was rejected: " + body)
+	for server.sent < len(server.queue) && server.sent < REPLICATION_WINDOW {
+		entry := server.queue[server.sent]
+		server.peerOut <- utils.Frame{Type: utils.FRAME_DIFF, ID: entry.lsn, Payload: []byte(entry.request)}
+		server.sent++
 	}
-
-	// Our transaction went through, pop from the front of the queue.
-	server.queue = server.queue[1:]
-	return nil
 }
 
-func (server *Server) handlePrimaryRequest(out chan<- string, message string) error {
-	// Messages have the format 'HEADER:REQUEST'
-	arr := strings.Split(message, utils.DELIMITER)
-	if len(arr) < 2 {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Invalid message: " + message)
+// Forgets the writes up to an LSN, which the backup has applied.
+func (server *Server) acknowledge(lsn uint64) {
+	acked := 0
+	for acked < len(server.queue) && server.queue[acked].lsn <= lsn {
+		acked++
 	}
+	server.queue = server.queue[acked:]
+	server.sent -= acked
+	if server.sent < 0 {
+		server.sent = 0
+	}
+}
 
-	header, request := arr[0], arr[1]
-	if header != utils.SYN {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Unrecognized header:" + header)
+func (server *Server) handleBackupResponse(out chan<- utils.Frame, frame utils.Frame) error {
+	// Both answers have the LSN of the last write the backup applied, which covers every
+	// write before it too. An error means a write after it went missing, so everything
+	// after it is sent again.
+	switch frame.Type {
+	case utils.FRAME_ACK:
+		server.acknowledge(frame.ID)
+	case utils.FRAME_ERROR:
+		server.acknowledge(frame.ID)
+		server.sent = 0
+		return errors.New("Retransmitting the writes after " + strconv.FormatUint(frame.ID, 10))
+	default:
+		return errors.New("Unrecognized message: " + frame.String())
 	}
-	if !strings.Contains(request, utils.DIFF) {
+	return nil
+}
+
+// Applies a write from the primary if it's the next one in the log, and acknowledges the
+// last one applied. A write that was already applied is acknowledged again, but not
+// applied twice.
+func (server *Server) handlePrimaryRequest(out chan<- utils.Frame, frame utils.Frame) error {
+	if frame.Type != utils.FRAME_DIFF {
 		// Only handle DIFFs for now.
-		out <- utils.ERRDEL + utils.UNKNOWN
-		return errors.New("Unrecognized request:" + request)
+		out <- utils.ErrorFrame(frame.ID, utils.UNKNOWN)
+		return errors.New("Unrecognized request: " + frame.String())
+	}
+	if frame.ID > server.lsn+1 {
+		// The writes in between went missing. The primary sends them again, and then
+		// the ones after them, so there's only need to ask once.
+		if !server.missing {
+			server.missing = true
+			out <- utils.ErrorFrame(server.lsn, utils.MISSING)
+		}
+		return errors.New("Missing the writes before " + strconv.FormatUint(frame.ID, 10))
 	}
-	arr = strings.Split(request, utils.EQUALS)
-	if len(arr) < 2 {
-		out <- utils.ERRDEL + utils.INVALID
-		return errors.New("Invalid message:" + request)
+	if frame.ID == server.lsn+1 {
+		fmt.Println(server.store.Execute(string(frame.Payload)))
+		server.lsn = frame.ID
+		server.missing = false
 	}
-	fmt.Println(server.store.Execute(arr[1]))
-	out <- utils.ACKDEL + utils.OK
+	out <- utils.Frame{Type: utils.FRAME_ACK, ID: server.lsn}
 	return nil
 }
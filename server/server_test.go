@@ -0,0 +1,136 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/eshyong/lettuce/utils"
+)
+
+// Returns a server whose store keeps its files in a directory of the test's own.
+func newTestServer(t *testing.T, primary bool) *Server {
+	server := NewServerIn(t.TempDir())
+	t.Cleanup(server.store.Close)
+	server.isPrimary = primary
+	server.store.SetPrimary(primary)
+	return server
+}
+
+// Returns the frames sent so far.
+func sentFrames(out chan utils.Frame) []utils.Frame {
+	frames := make([]utils.Frame, 0)
+	for len(out) > 0 {
+		frames = append(frames, <-out)
+	}
+	return frames
+}
+
+func diffFrame(lsn uint64, request string) utils.Frame {
+	return utils.Frame{Type: utils.FRAME_DIFF, ID: lsn, Payload: []byte(request)}
+}
+
+func TestBackupAppliesWritesInOrder(t *testing.T) {
+	server := newTestServer(t, false)
+	out := make(chan utils.Frame, utils.CHANNEL_BUFFER)
+	ack := func(lsn uint64) utils.Frame { return utils.Frame{Type: utils.FRAME_ACK, ID: lsn} }
+
+	steps := []struct {
+		name  string
+		frame utils.Frame
+		sent  []utils.Frame
+		err   bool
+	}{
+		{"first write", diffFrame(1, "RPUSH l a"), []utils.Frame{ack(1)}, false},
+		{"duplicate", diffFrame(1, "RPUSH l a"), []utils.Frame{ack(1)}, false},
+		{"gap", diffFrame(3, "RPUSH l c"), []utils.Frame{utils.ErrorFrame(1, utils.MISSING)}, true},
+		{"still missing", diffFrame(4, "RPUSH l d"), []utils.Frame{}, true},
+		{"missing write", diffFrame(2, "RPUSH l b"), []utils.Frame{ack(2)}, false},
+		{"resent write", diffFrame(3, "RPUSH l c"), []utils.Frame{ack(3)}, false},
+		{"old write", diffFrame(2, "RPUSH l b"), []utils.Frame{ack(3)}, false},
+		{"next write", diffFrame(4, "RPUSH l d"), []utils.Frame{ack(4)}, false},
+		{"another gap", diffFrame(6, "RPUSH l f"), []utils.Frame{utils.ErrorFrame(4, utils.MISSING)}, true},
+		{"not a diff", utils.Frame{Type: utils.FRAME_PING, ID: 9},
+			[]utils.Frame{utils.ErrorFrame(9, utils.UNKNOWN)}, true},
+	}
+	for _, step := range steps {
+		err := server.handlePrimaryRequest(out, step.frame)
+		if (err != nil) != step.err {
+			t.Errorf("%s: err = %v", step.name, err)
+		}
+		if sent := sentFrames(out); !sameFrames(sent, step.sent) {
+			t.Errorf("%s: sent %v, want %v", step.name, sent, step.sent)
+		}
+	}
+	if list := server.store.Execute("LRANGE l 0 -1").String(); list != `"a", "b", "c", "d"` {
+		t.Errorf("list = %s, want each write applied once, in order", list)
+	}
+}
+
+func sameFrames(got []utils.Frame, want []utils.Frame) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].String() != want[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPrimaryResendsAfterGap(t *testing.T) {
+	server := newTestServer(t, true)
+	peerOut := make(chan utils.Frame, 2*REPLICATION_WINDOW)
+	server.peerOut = peerOut
+	lsns := func() []uint64 {
+		sent := make([]uint64, 0)
+		for _, frame := range sentFrames(peerOut) {
+			sent = append(sent, frame.ID)
+		}
+		return sent
+	}
+
+	writes := make([]string, 0)
+	for i := 1; i <= REPLICATION_WINDOW+2; i++ {
+		writes = append(writes, "SET k"+strconv.Itoa(i)+" v")
+	}
+	server.appendDiffs(writes)
+
+	// Only a window's worth of writes is sent before the backup acknowledges them.
+	server.replicate()
+	if sent := lsns(); len(sent) != REPLICATION_WINDOW || sent[0] != 1 {
+		t.Fatalf("sent LSNs %v, want %d from 1", sent, REPLICATION_WINDOW)
+	}
+
+	// An acknowledgement covers every write before it, and makes room for more.
+	if err := server.handleBackupResponse(nil, utils.Frame{Type: utils.FRAME_ACK, ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	server.replicate()
+	if sent := lsns(); len(sent) != 2 || sent[0] != REPLICATION_WINDOW+1 || sent[1] != REPLICATION_WINDOW+2 {
+		t.Errorf("sent LSNs %v after the ACK, want %d and %d", sent, REPLICATION_WINDOW+1, REPLICATION_WINDOW+2)
+	}
+
+	// An acknowledgement that arrives late changes nothing.
+	server.handleBackupResponse(nil, utils.Frame{Type: utils.FRAME_ACK, ID: 1})
+	server.replicate()
+	if sent := lsns(); len(sent) != 0 {
+		t.Errorf("sent LSNs %v after a stale ACK", sent)
+	}
+
+	// A missing write is sent again, along with every write after it.
+	if err := server.handleBackupResponse(nil, utils.ErrorFrame(10, utils.MISSING)); err == nil {
+		t.Error("expected an error for a missing write")
+	}
+	server.replicate()
+	if sent := lsns(); len(sent) != REPLICATION_WINDOW-8 || sent[0] != 11 {
+		t.Errorf("resent LSNs %v, want %d from 11", sent, REPLICATION_WINDOW-8)
+	}
+
+	// Once everything is acknowledged, nothing is left to send.
+	server.handleBackupResponse(nil, utils.Frame{Type: utils.FRAME_ACK, ID: REPLICATION_WINDOW + 2})
+	server.replicate()
+	if len(server.queue) != 0 || len(lsns()) != 0 {
+		t.Errorf("%d writes still queued", len(server.queue))
+	}
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnbalancedQuotes = errors.New("unbalanced quotes in request")
+	ErrQuoteNotFollowed = errors.New("closing quote must be followed by a space or the end of the request")
+)
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// Splits a request into its arguments, which are separated by any amount of whitespace:
+//   - "double quotes" may hold whitespace and the escapes \n, \r, \t, \b, \a, \xHH for
+//     any byte, and a backslash before any other character for the character itself
+//   - 'single quotes' may hold anything, where \' is a single quote
+//   - anything else is taken as it is
+//
+// A closing quote has to end the argument. An empty request has no arguments.
+func SplitArgs(request string) ([]string, error) {
+	args := make([]string, 0)
+	i := 0
+	for {
+		for i < len(request) && isSpace(request[i]) {
+			i++
+		}
+		if i == len(request) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		for i < len(request) && !isSpace(request[i]) {
+			switch request[i] {
+			case '"':
+				end, err := readDoubleQuoted(request, i+1, &arg)
+				if err == nil {
+					end, err = closeQuote(request, end)
+				}
+				if err != nil {
+					return nil, err
+				}
+				i = end
+			case '\'':
+				end, err := readSingleQuoted(request, i+1, &arg)
+				if err == nil {
+					end, err = closeQuote(request, end)
+				}
+				if err != nil {
+					return nil, err
+				}
+				i = end
+			default:
+				arg.WriteByte(request[i])
+				i++
+			}
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// Reads a double quoted string starting just after the quote, and returns the index just
+// after the closing quote.
+func readDoubleQuoted(request string, i int, arg *strings.Builder) (int, error) {
+	for ; i < len(request); i++ {
+		c := request[i]
+		switch {
+		case c == '"':
+			return i + 1, nil
+		case c == '\\' && i+3 < len(request) && request[i+1] == 'x' &&
+			isHexDigit(request[i+2]) && isHexDigit(request[i+3]):
+			b, _ := strconv.ParseUint(request[i+2:i+4], 16, 8)
+			arg.WriteByte(byte(b))
+			i += 3
+		case c == '\\' && i+1 < len(request):
+			i++
+			switch request[i] {
+			case 'n':
+				arg.WriteByte('\n')
+			case 'r':
+				arg.WriteByte('\r')
+			case 't':
+				arg.WriteByte('\t')
+			case 'b':
+				arg.WriteByte('\b')
+			case 'a':
+				arg.WriteByte('\a')
+			default:
+				arg.WriteByte(request[i])
+			}
+		default:
+			arg.WriteByte(c)
+		}
+	}
+	return i, ErrUnbalancedQuotes
+}
+
+// Reads a single quoted string starting just after the quote, and returns the index just
+// after the closing quote.
+func readSingleQuoted(request string, i int, arg *strings.Builder) (int, error) {
+	for ; i < len(request); i++ {
+		c := request[i]
+		switch {
+		case c == '\'':
+			return i + 1, nil
+		case c == '\\' && i+1 < len(request) && request[i+1] == '\'':
+			arg.WriteByte('\'')
+			i++
+		default:
+			arg.WriteByte(c)
+		}
+	}
+	return i, ErrUnbalancedQuotes
+}
+
+// Returns an error unless the argument ends right after its closing quote.
+func closeQuote(request string, i int) (int, error) {
+	if i < len(request) && !isSpace(request[i]) {
+		return i, ErrQuoteNotFollowed
+	}
+	return i, nil
+}
+
+// Returns an argument in a form that SplitArgs reads back as the same argument. Arguments
+// that don't need quotes are left as they are.
+func QuoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, "\"'\\") && strings.IndexFunc(arg, func(r rune) bool {
+		return r <= ' ' || r == 0x7F
+	}) == -1 {
+		return arg
+	}
+	return Quote(arg)
+}
+
+// Returns a string in double quotes, with any quotes, backslashes and control characters
+// in it escaped, so that it fits on a single line.
+func Quote(s string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\n':
+			quoted.WriteString("\\n")
+		case '\r':
+			quoted.WriteString("\\r")
+		case '\t':
+			quoted.WriteString("\\t")
+		case '\b':
+			quoted.WriteString("\\b")
+		case '\a':
+			quoted.WriteString("\\a")
+		default:
+			if c < ' ' || c == 0x7F {
+				quoted.WriteString("\\x" + strconv.FormatUint(uint64(c)>>4, 16) +
+					strconv.FormatUint(uint64(c)&0xF, 16))
+			} else {
+				quoted.WriteByte(c)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// Reads the double quoted string at the start of s, like one written by Quote, and
+// returns it along with the number of bytes it took up in s.
+func Unquote(s string) (string, int, error) {
+	if s == "" || s[0] != '"' {
+		return "", 0, ErrUnbalancedQuotes
+	}
+	var arg strings.Builder
+	end, err := readDoubleQuoted(s, 1, &arg)
+	if err != nil {
+		return "", 0, err
+	}
+	return arg.String(), end, nil
+}
+
+// Joins arguments into a request that SplitArgs splits back into the same arguments.
+func JoinArgs(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = QuoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		request string
+		args    []string
+		err     error
+	}{
+		{"", []string{}, nil},
+		{"  \t ", []string{}, nil},
+		{"GET a", []string{"GET", "a"}, nil},
+		{"  SET\ta \r\n b ", []string{"SET", "a", "b"}, nil},
+		{`SET "a b" 'c d'`, []string{"SET", "a b", "c d"}, nil},
+		{`SET a ""`, []string{"SET", "a", ""}, nil},
+		{`SET a ''`, []string{"SET", "a", ""}, nil},
+		{`"\n\r\t\b\a"`, []string{"\n\r\t\b\a"}, nil},
+		{`"\x00\xff\x41"`, []string{"\x00\xffA"}, nil},
+		{`"\xZZ"`, []string{"xZZ"}, nil},
+		{`"\x4"`, []string{"x4"}, nil},
+		{`"a\"b\\c\q"`, []string{`a"b\cq`}, nil},
+		{`'it\'s' '\n'`, []string{"it's", `\n`}, nil},
+		{`a"b"`, []string{"ab"}, nil},
+		{`a'b'c`, nil, ErrQuoteNotFollowed},
+		{`"a"b`, nil, ErrQuoteNotFollowed},
+		{`'a'b`, nil, ErrQuoteNotFollowed},
+		{`"abc`, nil, ErrUnbalancedQuotes},
+		{`'abc`, nil, ErrUnbalancedQuotes},
+		{`"abc\"`, nil, ErrUnbalancedQuotes},
+		{`"abc\`, nil, ErrUnbalancedQuotes},
+	}
+	for _, test := range tests {
+		args, err := SplitArgs(test.request)
+		if err != test.err || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("SplitArgs(%q) = %q, %v, want %q, %v", test.request, args, err, test.args, test.err)
+		}
+	}
+}
+
+func TestJoinArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		request string
+	}{
+		{[]string{"GET", "a"}, "GET a"},
+		{[]string{"SET", "a b", ""}, `SET "a b" ""`},
+		{[]string{`a"b`, `c\d`, "it's"}, `"a\"b" "c\\d" "it's"`},
+		{[]string{"\n\r\t\b\a", "\x00\x7f"}, `"\n\r\t\b\a" "\x00\x7f"`},
+		{[]string{"héllo", "\xff"}, "héllo \xff"},
+	}
+	for _, test := range tests {
+		if request := JoinArgs(test.args...); request != test.request {
+			t.Errorf("JoinArgs(%q) = %q, want %q", test.args, request, test.request)
+		}
+		if args, err := SplitArgs(test.request); err != nil || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("SplitArgs(%q) = %q, %v, want %q", test.request, args, err, test.args)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []string{"", "plain", `"quoted"`, "a\nb", "\x00\x01\x1f\x7f\xff", `\x41`, "\\"}
+	for _, s := range tests {
+		quoted := Quote(s) + " after"
+		unquoted, n, err := Unquote(quoted)
+		if err != nil || unquoted != s || quoted[n:] != " after" {
+			t.Errorf("Unquote(%q) = %q, %d, %v, want %q", quoted, unquoted, n, err, s)
+		}
+	}
+	for _, s := range []string{"", "plain", `"open`} {
+		if _, _, err := Unquote(s); err != ErrUnbalancedQuotes {
+			t.Errorf("Unquote(%q) err = %v, want %v", s, err, ErrUnbalancedQuotes)
+		}
+	}
+}
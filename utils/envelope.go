@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrMalformedEnvelope = errors.New("malformed envelope")
+
+// A client request on its way from the master to the primary, or the reply on its way
+// back. Each request gets an ID of its own, which its reply carries too, so replies are
+// matched to their requests by ID rather than by the order they come back in.
+type Envelope struct {
+	ID      uint64
+	Session string
+
+	// The database the request runs against.
+	DB int
+
+	// The request, or the marshaled reply.
+	Body string
+}
+
+// Returns a frame of the given type that holds the envelope: a REQUEST or a REPLY.
+func (envelope Envelope) Frame(frameType FrameType) Frame {
+	return Frame{Type: frameType, ID: envelope.ID,
+		Payload: PackFields(envelope.Session, strconv.Itoa(envelope.DB), envelope.Body)}
+}
+
+// Reads the envelope in a frame made by Frame.
+func EnvelopeFromFrame(frame Frame) (Envelope, error) {
+	fields, err := UnpackFields(frame.Payload)
+	if err != nil || len(fields) != 3 {
+		return Envelope{}, ErrMalformedEnvelope
+	}
+	index, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Envelope{}, ErrMalformedEnvelope
+	}
+	return Envelope{ID: frame.ID, Session: fields[0], DB: index, Body: fields[2]}, nil
+}
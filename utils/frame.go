@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Messages between the master and the servers, and between a primary and its backup, are
+// sent in frames:
+//
+//	length   uint32  bytes in the frame after the length
+//	version  uint8   PROTOCOL_VERSION
+//	type     uint8
+//	flags    uint8   reserved for later versions, and 0 until then
+//	id       uint64  the request, ping or diff the frame is about
+//	payload  whatever is left
+//
+// Integers are big-endian. Every version starts with the length and the version, so that
+// a frame from a node that speaks another version can still be recognized as one.
+const (
+	PROTOCOL_VERSION = 1
+
+	// Bytes after the length that every frame has.
+	FRAME_HEADER = 11
+
+	// Largest frame a node accepts, which leaves room for a bulk string as large as a
+	// client may send, and the request it's in.
+	MAX_FRAME = 1024 * 1024 * 1024
+)
+
+type FrameType uint8
+
+const (
+	// Sent by both ends of a new connection before anything else.
+	FRAME_HELLO FrameType = iota + 1
+
+	// From the master to a server.
+	FRAME_PING
+	FRAME_PROMOTE
+	FRAME_PRIMARY
+	FRAME_REQUEST
+	FRAME_CLOSED
+
+	// From a primary to the master.
+	FRAME_REPLY
+	FRAME_PUBLISH
+
+	// From a primary to its backup.
+	FRAME_DIFF
+
+	// Answers to a ping, a promotion or a diff, with the ID of the frame they answer.
+	FRAME_ACK
+	FRAME_ERROR
+)
+
+var frameTypeNames = map[FrameType]string{
+	FRAME_HELLO: "HELLO", FRAME_PING: "PING", FRAME_PROMOTE: "PROMOTE", FRAME_PRIMARY: "PRIMARY",
+	FRAME_REQUEST: "REQUEST", FRAME_CLOSED: "CLOSED", FRAME_REPLY: "REPLY",
+	FRAME_PUBLISH: "PUBLISH", FRAME_DIFF: "DIFF", FRAME_ACK: "ACK", FRAME_ERROR: "ERROR",
+}
+
+func (frameType FrameType) String() string {
+	if name, ok := frameTypeNames[frameType]; ok {
+		return name
+	}
+	return "FRAME" + strconv.Itoa(int(frameType))
+}
+
+type Frame struct {
+	Type    FrameType
+	Flags   uint8
+	ID      uint64
+	Payload []byte
+}
+
+var (
+	ErrFrameTooLarge      = errors.New("frame is too large")
+	ErrFrameTooShort      = errors.New("frame is shorter than its header")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrMalformedPayload   = errors.New("malformed frame payload")
+)
+
+func (frame Frame) String() string {
+	return fmt.Sprintf("%v #%d %q", frame.Type, frame.ID, frame.Payload)
+}
+
+// Returns an ERROR frame about the frame with the given ID.
+func ErrorFrame(id uint64, code string) Frame {
+	return Frame{Type: FRAME_ERROR, ID: id, Payload: []byte(code)}
+}
+
+// Appends a frame to a buffer, and returns the buffer.
+func AppendFrame(buf []byte, frame Frame) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(FRAME_HEADER+len(frame.Payload)))
+	buf = append(buf, PROTOCOL_VERSION, byte(frame.Type), frame.Flags)
+	buf = binary.BigEndian.AppendUint64(buf, frame.ID)
+	return append(buf, frame.Payload...)
+}
+
+// Reads the next frame. Anything other than a whole frame of PROTOCOL_VERSION, like a
+// length that's out of range, is an error, after which the connection can't be trusted.
+func ReadFrame(reader io.Reader) (Frame, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length < FRAME_HEADER {
+		return Frame{}, ErrFrameTooShort
+	}
+	if length > MAX_FRAME {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	// The buffer grows as the frame comes in, rather than taking the length on trust.
+	var body bytes.Buffer
+	if _, err := io.CopyN(&body, reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	data := body.Bytes()
+	if data[0] != PROTOCOL_VERSION {
+		return Frame{}, ErrUnsupportedVersion
+	}
+	return Frame{Type: FrameType(data[1]), Flags: data[2], ID: binary.BigEndian.Uint64(data[3:11]),
+		Payload: data[FRAME_HEADER:]}, nil
+}
+
+// Packs strings into a payload, each after its length as a uvarint.
+func PackFields(fields ...string) []byte {
+	size := 0
+	for _, field := range fields {
+		size += binary.MaxVarintLen64 + len(field)
+	}
+	payload := make([]byte, 0, size)
+	for _, field := range fields {
+		payload = binary.AppendUvarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	return payload
+}
+
+// Unpacks the strings in a payload made by PackFields.
+func UnpackFields(payload []byte) ([]string, error) {
+	fields := make([]string, 0)
+	for len(payload) > 0 {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || size > uint64(len(payload)-n) {
+			return nil, ErrMalformedPayload
+		}
+		payload = payload[n:]
+		fields = append(fields, string(payload[:size]))
+		payload = payload[size:]
+	}
+	return fields, nil
+}
+
+// Makes sure both ends of a new connection speak the same version. Both ends send a HELLO
+// and read the other's, so it doesn't matter which one goes first.
+func Handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(DEADLINE))
+	defer conn.SetDeadline(NO_DEADLINE)
+
+	if _, err := conn.Write(AppendFrame(nil, Frame{Type: FRAME_HELLO})); err != nil {
+		return err
+	}
+	frame, err := ReadFrame(conn)
+	if err == ErrUnsupportedVersion {
+		// Tell the other end why, in case it can read this version.
+		conn.Write(AppendFrame(nil, ErrorFrame(0, err.Error())))
+		return err
+	} else if err != nil {
+		return err
+	}
+	if frame.Type != FRAME_HELLO {
+		return errors.New("expected a HELLO, got " + frame.String())
+	}
+	return nil
+}
+
+// Reads frames from a connection onto a channel, which is closed once the connection is,
+// or once a frame can't be read.
+func InFrameChanFromConn(conn net.Conn, name string) <-chan Frame {
+	in := make(chan Frame, CHANNEL_BUFFER)
+	go func() {
+		defer close(in)
+		reader := bufio.NewReader(conn)
+		for {
+			frame, err := ReadFrame(reader)
+			if err != nil {
+				if err != io.EOF {
+					fmt.Println(name, err)
+					conn.Close()
+				}
+				break
+			}
+			in <- frame
+		}
+		fmt.Println(name + " disconnected at " + conn.RemoteAddr().String())
+	}()
+	return in
+}
+
+// Writes the frames sent on a channel to a connection, a batch at a time. Frames sent
+// after the connection fails are thrown away.
+func OutFrameChanFromConn(conn net.Conn, name string) chan<- Frame {
+	out := make(chan Frame, CHANNEL_BUFFER)
+	go func() {
+		writer := bufio.NewWriter(conn)
+		buf := make([]byte, 0)
+		for frame := range out {
+			buf = AppendFrame(buf[:0], frame)
+			_, err := writer.Write(buf)
+			if err == nil && len(out) == 0 {
+				err = writer.Flush()
+			}
+			if err != nil {
+				fmt.Println(name, err)
+				conn.Close()
+				break
+			}
+		}
+		for range out {
+		}
+	}()
+	return out
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// Returns the bytes allocated while running a function.
+func allocated(run func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	run()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// Frames of every type that the nodes send each other.
+func seedFrames() []Frame {
+	return []Frame{
+		{Type: FRAME_HELLO},
+		{Type: FRAME_PING, ID: 1},
+		{Type: FRAME_PROMOTE},
+		{Type: FRAME_PRIMARY, Payload: []byte("127.0.0.1:8080")},
+		Envelope{ID: 2, Session: "CLI0", DB: 3, Body: "SET a \"b c\""}.Frame(FRAME_REQUEST),
+		{Type: FRAME_CLOSED, Payload: []byte("CLI0")},
+		Envelope{ID: 2, Session: "CLI0", DB: 3, Body: "+\"OK\""}.Frame(FRAME_REPLY),
+		{Type: FRAME_PUBLISH, Payload: PackFields("__keyspace@0__:a", "set")},
+		{Type: FRAME_DIFF, ID: 1 << 40, Payload: PackFields("SELECT 1", "DEL a")},
+		{Type: FRAME_ACK, ID: 1 << 40},
+		ErrorFrame(7, MISSING),
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	for _, frame := range seedFrames() {
+		f.Add(AppendFrame(nil, frame))
+	}
+	f.Add([]byte{0, 0, 0, FRAME_HEADER, PROTOCOL_VERSION + 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0x3f, 0xff, 0xff, 0xff, PROTOCOL_VERSION})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var frame Frame
+		var err error
+		// A length from the input must not be trusted with memory the input doesn't have.
+		n := allocated(func() { frame, err = ReadFrame(bytes.NewReader(data)) })
+		if n > 64*1024+4*uint64(len(data)) {
+			t.Fatalf("allocated %d bytes to read %d", n, len(data))
+		}
+		if err != nil {
+			return
+		}
+		again := AppendFrame(nil, frame)
+		if !bytes.Equal(again, data[:len(again)]) {
+			t.Fatalf("frame %v was read from %x, but appends as %x", frame, data, again)
+		}
+		read, err := ReadFrame(bytes.NewReader(again))
+		if err != nil || !reflect.DeepEqual(read, frame) {
+			t.Fatalf("read %v, %v after appending %v", read, err, frame)
+		}
+	})
+}
+
+func FuzzUnpackFields(f *testing.F) {
+	f.Add(PackFields())
+	f.Add(PackFields(""))
+	f.Add(PackFields("SET a b", "", "DEL a"))
+	f.Add(PackFields(string(make([]byte, 300))))
+	f.Add([]byte{0x80})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var fields []string
+		var err error
+		if n := allocated(func() { fields, err = UnpackFields(payload) }); n > 4096+64*uint64(len(payload)) {
+			t.Fatalf("allocated %d bytes to unpack %d", n, len(payload))
+		}
+		if err != nil {
+			return
+		}
+		again, err := UnpackFields(PackFields(fields...))
+		if err != nil || !reflect.DeepEqual(again, fields) {
+			t.Fatalf("unpacked %q, %v after packing %q", again, err, fields)
+		}
+	})
+}
+
+func FuzzEnvelopeFromFrame(f *testing.F) {
+	for _, frame := range seedFrames() {
+		f.Add(uint8(frame.Type), frame.ID, frame.Payload)
+	}
+	f.Add(uint8(FRAME_REQUEST), uint64(1), PackFields("CLI0", "x", "GET a"))
+	f.Add(uint8(FRAME_REQUEST), uint64(1), PackFields("CLI0", "-1", "GET a", ""))
+	f.Fuzz(func(t *testing.T, frameType uint8, id uint64, payload []byte) {
+		envelope, err := EnvelopeFromFrame(Frame{Type: FrameType(frameType), ID: id, Payload: payload})
+		if err != nil {
+			return
+		}
+		again, err := EnvelopeFromFrame(envelope.Frame(FrameType(frameType)))
+		if err != nil || again != envelope {
+			t.Fatalf("read %+v, %v after framing %+v", again, err, envelope)
+		}
+	})
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var stream []byte
+	frames := seedFrames()
+	for _, frame := range frames {
+		stream = AppendFrame(stream, frame)
+	}
+	reader := bytes.NewReader(stream)
+	for _, want := range frames {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != want.Type || frame.ID != want.ID || !bytes.Equal(frame.Payload, want.Payload) {
+			t.Errorf("read %v, want %v", frame, want)
+		}
+	}
+	if reader.Len() != 0 {
+		t.Errorf("%d bytes left over", reader.Len())
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"too short", []byte{0, 0, 0, FRAME_HEADER - 1}, ErrFrameTooShort},
+		{"too large", []byte{0x40, 0, 0, 1}, ErrFrameTooLarge},
+		{"other version", []byte{0, 0, 0, FRAME_HEADER, PROTOCOL_VERSION + 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			ErrUnsupportedVersion},
+		{"cut short", AppendFrame(nil, Frame{Type: FRAME_PING})[:FRAME_HEADER], io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadFrame(bytes.NewReader(test.data)); err != test.err {
+				t.Errorf("err = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPackFieldsRoundTrip(t *testing.T) {
+	tests := [][]string{{}, {""}, {"a"}, {"SET a b", "", "DEL a"}, {string(make([]byte, 200))}}
+	for _, fields := range tests {
+		unpacked, err := UnpackFields(PackFields(fields...))
+		if err != nil || !reflect.DeepEqual(unpacked, fields) {
+			t.Errorf("UnpackFields(PackFields(%q)) = %q, %v", fields, unpacked, err)
+		}
+	}
+}
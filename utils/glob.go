@@ -0,0 +1,86 @@
+package utils
+
+// Reports whether str matches a glob-style pattern. Unlike path.Match, no character is
+// special to '*':
+//   - '*' matches any sequence of characters, including none
+//   - '?' matches any single character
+//   - "[abc]", "[a-z]" and "[^abc]" match one character in, or not in, a class
+//   - '\' escapes the character after it
+func MatchGlob(pattern string, str string) bool {
+	// Backtrack to just after the last '*' when a match fails.
+	star, retry := -1, 0
+	p, s := 0, 0
+	for s < len(str) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, retry = p, s
+				p++
+				continue
+			case '?':
+				p, s = p+1, s+1
+				continue
+			case '[':
+				if end, ok := matchClass(pattern, p, str[s]); ok {
+					p, s = end, s+1
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == str[s] {
+					p, s = p+2, s+1
+					continue
+				}
+			default:
+				if pattern[p] == str[s] {
+					p, s = p+1, s+1
+					continue
+				}
+			}
+		}
+		if star == -1 {
+			return false
+		}
+		// Let the last '*' swallow one more character, and try again.
+		retry++
+		p, s = star+1, retry
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Matches a character against the class starting at pattern[start], which is a '['.
+// Returns the index just past the class, and whether the character is in it.
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	p := start + 1
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	matched := false
+	for first := true; p < len(pattern) && (first || pattern[p] != ']'); first = false {
+		lo := pattern[p]
+		if lo == '\\' && p+1 < len(pattern) {
+			p++
+			lo = pattern[p]
+		}
+		hi := lo
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			hi = pattern[p+2]
+			p += 2
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		p++
+	}
+	if p >= len(pattern) {
+		// An unterminated class is matched as a literal '['.
+		return start + 1, c == '['
+	}
+	return p + 1, matched != negate
+}
@@ -0,0 +1,51 @@
+package utils
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything/at all", true},
+		{"a*", "abc", true},
+		{"a*", "bac", false},
+		{"*c", "abc", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"*a*", "bbb", false},
+		{"**", "x", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h?llo", "heello", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[c-a]llo", "hbllo", true},
+		{"[]]", "]", true},
+		{"[a-]", "-", true},
+		{`[\]]`, "]", true},
+		{"[abc", "[abc", true},
+		{"[abc", "a", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h\?`, "h?", true},
+		{`\[a]`, "[a]", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:age", false},
+		{"*.txt", "a.txt.bak", false},
+		{"*.txt", "a.bak.txt", true},
+	}
+	for _, test := range tests {
+		if match := MatchGlob(test.pattern, test.str); match != test.match {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", test.pattern, test.str, match, test.match)
+		}
+	}
+}
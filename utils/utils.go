@@ -15,48 +15,63 @@ const (
 	DEADLINE        = time.Second * 5
 	TIMEOUT         = time.Second * 5
 	WAIT_PERIOD     = time.Second * 15
+	DIFF_PERIOD     = time.Millisecond * 100
 	SERVER_PORT     = "8080"
 	PEER_PORT       = "9000"
 
-	// Protocol headers.
-	ACK    = "ACK"
-	SYN    = "SYN"
-	ERR    = "ERR"
-	CLIENT = "CLI"
+	// Messages that can wait in a connection's channels, so that whoever reads them can
+	// take a whole pipeline at once.
+	CHANNEL_BUFFER = 1024
 
-	// For convenience.
-	ACKDEL = ACK + DELIMITER
-	SYNDEL = SYN + DELIMITER
-	ERRDEL = ERR + DELIMITER
-	CLIDEL = CLIENT + DELIMITER
+	// Prefix of session IDs.
+	CLIENT = "CLI"
 
-	// Message delimiters.
+	// Separates a host from its port, and the header of a line sent to a plain text
+	// client from the rest of it.
 	DELIMITER = ":"
-	EQUALS    = "="
 
-	// Requests.
-	PROMOTE = "PROM"
-	PRIMARY = "PRIM"
-	BACKUP  = "BACK"
-	STATUS  = "STAT"
-	DIFF    = "DIFF"
-
-	// Status codes.
+	// Status codes. All but OK are sent in ERROR frames.
 	OK      = "OK"
 	NEG     = "NEG"
 	INVALID = "INVLD"
 	UNKNOWN = "UNKN"
-	CLOSED  = "CLOS"
+	MISSING = "MISS"
 
 	// Special user request for shutdown.
 	SHUTDOWN = "SHUTDOWN"
 
+	// User requests for transactions, which the master handles itself.
+	MULTI   = "MULTI"
+	EXEC    = "EXEC"
+	DISCARD = "DISCARD"
+	QUEUED  = "QUEUED"
+	WATCH   = "WATCH"
+	UNWATCH = "UNWATCH"
+
+	// User requests for publish/subscribe, which the master handles itself.
+	PUBLISH      = "PUBLISH"
+	SUBSCRIBE    = "SUBSCRIBE"
+	UNSUBSCRIBE  = "UNSUBSCRIBE"
+	PSUBSCRIBE   = "PSUBSCRIBE"
+	PUNSUBSCRIBE = "PUNSUBSCRIBE"
+	PUBSUB       = "PUBSUB"
+
+	// User request to select a database, which the master keeps for each session.
+	SELECT = "SELECT"
+
+	// Header of messages pushed to a client, rather than sent in reply to a request.
+	PUSH = "PUSH"
+
+	// User request to pick how replies are encoded, which plain text sessions handle
+	// themselves.
+	FORMAT = "FORMAT"
+
 	// For testing.
 	LOCALHOST = "127.0.0.1"
 )
 
 func InChanFromConn(conn net.Conn, name string) <-chan string {
-	in := make(chan string)
+	in := make(chan string, CHANNEL_BUFFER)
 	go func() {
 		defer close(in)
 		scanner := bufio.NewScanner(conn)
@@ -73,7 +88,7 @@ func InChanFromConn(conn net.Conn, name string) <-chan string {
 }
 
 func OutChanFromConn(conn net.Conn, name string) chan<- string {
-	out := make(chan string)
+	out := make(chan string, CHANNEL_BUFFER)
 	go func() {
 		for {
 			reply, ok := <-out